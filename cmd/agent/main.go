@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,15 +25,91 @@ func (m *flagMap) String() string {
 }
 
 func (m *flagMap) Set(value string) error {
-	kv := strings.Split(value, ":")
-	(*m)[kv[0]] = kv[1]
+	k, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected id:name[:offset[:gain]], got %v", value)
+	}
+	(*m)[k] = v
+	return nil
+}
+
+type bogusValuesFlag []float32
+
+func (bv *bogusValuesFlag) String() string {
+	vs := []string{}
+	for _, v := range *bv {
+		vs = append(vs, fmt.Sprintf("%v", v))
+	}
+	return strings.Join(vs, ",")
+}
+
+func (bv *bogusValuesFlag) Set(value string) error {
+	vs := []float32{}
+	for _, s := range strings.Split(value, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+		if err != nil {
+			return fmt.Errorf("expected comma-separated temperatures, got %v", value)
+		}
+		vs = append(vs, float32(v))
+	}
+	*bv = vs
+	return nil
+}
+
+type derivedSensorsFlag []agent.DerivedSensor
+
+func (ds *derivedSensorsFlag) String() string {
+	return fmt.Sprintf("%v", []agent.DerivedSensor(*ds))
+}
+
+func (ds *derivedSensorsFlag) Set(value string) error {
+	d, err := agent.ParseDerivedSensor(value)
+	if err != nil {
+		return err
+	}
+	*ds = append(*ds, d)
+	return nil
+}
+
+type reconcilePoliciesFlag map[googlesheet.Setting]agent.ReconcilePolicy
+
+func (rp *reconcilePoliciesFlag) String() string {
+	return fmt.Sprintf("%v", map[googlesheet.Setting]agent.ReconcilePolicy(*rp))
+}
+
+func (rp *reconcilePoliciesFlag) Set(value string) error {
+	s, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected setting=policy, got %v", value)
+	}
+	p, err := agent.ParseReconcilePolicy(v)
+	if err != nil {
+		return err
+	}
+	(*rp)[googlesheet.Setting(s)] = p
 	return nil
 }
 
 var (
 	temperatureSensors flagMap = make(flagMap)
-	enableCanBus               = true
-	enableOnewireBus           = true
+	derivedSensors     derivedSensorsFlag
+	bogusValues        = bogusValuesFlag(temperature.DefaultBogusValues)
+	reconcilePolicies  = make(reconcilePoliciesFlag)
+	enableCanBus       = true
+	enableOnewireBus   = true
+
+	sensorMaxChangePerMinute float64
+
+	checkSheet     = true
+	provisionSheet = false
+	sheetDir       = ""
+	settingsFile   = ""
+	rulesFile      = ""
+
+	legionellaWeekday = ""
 
 	heartbeatDelay = time.Minute
 	heartbeatFile  = ""
@@ -43,9 +120,21 @@ func main() {
 	flag.StringVar(&sheetCfg.CredentialsFile, "google-api-credentials-file", "google-api-credentials.json",
 		"File downloaded when following https://developers.google.com/sheets/api/quickstart/go")
 	flag.StringVar(&sheetCfg.SheetId, "google-sheet-id", "",
-		"ID of the Google Sheet to use")
+		"ID of the Google Sheet to use (empty to keep values in memory, with --web-ui-addr)")
 	flag.DurationVar(&sheetCfg.MaxHaveValueAge, "max-sheet-value-age", defaultLogInterval,
 		"Interval between updates of the sheet")
+	flag.DurationVar(&sheetCfg.ReadCacheAge, "sheet-read-cache-age", 10*time.Second,
+		"Age up to which values read from the sheet in one batch are reused")
+	flag.DurationVar(&sheetCfg.WriteInterval, "sheet-write-interval", 5*time.Second,
+		"Interval between batched writes to the sheet (0 to write immediately)")
+	flag.IntVar(&sheetCfg.MaxLogTabs, "max-sheet-log-tabs", 0,
+		"Log tabs kept in the sheet, one per month and header, deleting the oldest (0 to keep all)")
+	flag.StringVar(&sheetCfg.QueueFile, "sheet-queue-file", "sheet-queue.json",
+		"File queueing sheet updates while the sheet is unreachable (empty to drop them)")
+	flag.IntVar(&sheetCfg.Retries, "sheet-retries", 4,
+		"Retries of sheet requests failing on quota, server or network errors")
+	flag.DurationVar(&sheetCfg.RetryBackoff, "sheet-retry-backoff", time.Second,
+		"Delay before the first retry of a sheet request, doubling per retry")
 
 	parserCfg := ultrasource.Config{}
 	flag.BoolVar(&parserCfg.LogDetails, "print-parser-details", false,
@@ -60,14 +149,48 @@ func main() {
 		"Enable applying desired setting as CAN commands")
 	flag.BoolVar(&agentCfg.ApplyAutomaticSettings, "apply-automatic-settings", false,
 		"Enable automatic settings as sheet updates")
+	flag.StringVar(&rulesFile, "rules-file", rulesFile,
+		"JSON file defining the rules of automatic settings, instead of the built-in ones")
+	flag.BoolVar(&agentCfg.RulesDryRun, "rules-dry-run", false,
+		"Only log the automatic settings that rules would make")
+	flag.DurationVar(&agentCfg.Legionella.Interval, "legionella-interval", 0,
+		"Interval between legionella cycles raising the water temp (0 to disable)")
+	flag.StringVar(&legionellaWeekday, "legionella-weekday", legionellaWeekday,
+		"Weekday of legionella cycles, e.g. sunday (empty to disable)")
+	flag.IntVar(&agentCfg.Legionella.Hour, "legionella-hour", 2,
+		"Hour of the day of legionella cycles on --legionella-weekday")
+	flag.Float64Var(&agentCfg.Legionella.TargetCelsius, "legionella-target-temp", 65,
+		"Desired water temp in °C during legionella cycles")
+	flag.Float64Var(&agentCfg.Legionella.HoldCelsius, "legionella-hold-temp", 60,
+		"Water temp in °C that both tank sensors must hold during legionella cycles")
+	flag.DurationVar(&agentCfg.Legionella.Hold, "legionella-hold", 30*time.Minute,
+		"Time that both tank sensors must hold --legionella-hold-temp")
+	flag.DurationVar(&agentCfg.Legionella.Timeout, "legionella-timeout", 6*time.Hour,
+		"Time after which a legionella cycle fails and restores the previous water temp")
+	flag.StringVar(&agentCfg.Legionella.StateFile, "legionella-state-file", "legionella-state.json",
+		"File keeping the state of legionella cycles across restarts (empty to keep it in memory)")
+	flag.BoolVar(&agentCfg.ApplyScheduledSettings, "apply-scheduled-settings", false,
+		"Enable desired settings scheduled in the Schedule tab of the sheet")
+	flag.BoolVar(&agentCfg.ApplySheetConfig, "apply-sheet-config", false,
+		"Enable overriding flags by the Config tab of the sheet while running")
 	flag.DurationVar(&agentCfg.SheetPollingInterval, "sheet-polling-interval", time.Minute,
 		"Interval between polls of the sheet")
+	flag.DurationVar(&agentCfg.SyncTimeout, "sync-timeout", 2*defaultLogInterval,
+		"Time to wait for the Ultrasource to report a sent desired setting before sending it again, or 0 to wait forever. "+
+			"At least --settings-query-interval, by default twice that")
+	flag.IntVar(&agentCfg.SyncRetries, "sync-retries", 3,
+		"Number of times to send a desired setting again before marking it as failed in the sheet")
+	flag.Var(&reconcilePolicies, "reconcile-policy",
+		"Policy for a desired setting changed on the Ultrasource's display in the format setting=policy, "+
+			"with policy panel-wins (default), sheet-wins, sheet-wins-after-delay or notify-only")
+	flag.DurationVar(&agentCfg.ReconcileDelay, "reconcile-delay", 30*time.Minute,
+		"Delay before sheet-wins-after-delay reverts a change on the Ultrasource's display")
 	flag.DurationVar(&agentCfg.SettingsQueryInterval, "settings-query-interval", defaultLogInterval,
 		"Interval between batches of CAN queries of current settings")
 	flag.DurationVar(&agentCfg.SettingsQueryGap, "settings-query-gap", time.Second,
 		"Interval between individual CAN queries")
 	flag.BoolVar(&agentCfg.LogCurrentSettingsToSheet, "log-to-sheet", false,
-		"Log current settings to sheet as table")
+		"Log current settings to sheet as monthly tables")
 	flag.DurationVar(&agentCfg.SettingsLogToSheetInterval, "log-to-sheet-interval", defaultLogInterval,
 		"Interval between logging current settings to sheet/files")
 	flag.BoolVar(&agentCfg.LogCurrentSettingsToFiles, "log-to-files", false,
@@ -76,11 +199,64 @@ func main() {
 		"Interval between logging current settings to sheet/files")
 	flag.StringVar(&agentCfg.LogStore.Dir, "log-to-files-dir", "",
 		"Base dir of CSV settings log files")
+	flag.BoolVar(&agentCfg.AuditToSheet, "audit-to-sheet", false,
+		"Record changes of desired settings in the Audit tab of the sheet")
+	flag.BoolVar(&agentCfg.AuditToFiles, "audit-to-files", false,
+		"Record changes of desired settings in the CSV files of log-to-files-dir")
 	flag.DurationVar(&agentCfg.SettingsLogDelay, "log-delay", time.Minute,
 		"Delay of logging loop to query loop")
 	flag.Var(&temperatureSensors, "temperature-sensor",
-		"Temperature sensor in the format id:name")
+		"Temperature sensor in the format id:name[:offset[:gain]]")
+	flag.Var(&derivedSensors, "derived-sensor",
+		"Sensor computed from others in the format name=expression, e.g. temp_diff=temp5m-temp1m")
+	flag.DurationVar(&agentCfg.DerivedSensorsInterval, "derived-sensors-interval", time.Minute,
+		"Interval between updates of derived sensors")
+	flag.DurationVar(&agentCfg.DerivedSensorsMaxAge, "derived-sensors-max-age", 2*defaultLogInterval,
+		"Age of sensors and settings after which derived sensors no longer use them (0 to use any age)")
+	flag.StringVar(&agentCfg.TemperatureSensorNamesFile, "temperature-sensor-names-file", "",
+		"File with temperature sensor id:name lines, extended by discovered sensors")
+	flag.BoolVar(&agentCfg.DiscoverTemperatureSensors, "discover-temperature-sensors", false,
+		"Scan the 1-wire bus for temperature sensors before each query")
 
+	tempCfg := temperature.Config{}
+	flag.StringVar(&tempCfg.PowerPin, "onewire-power-pin", temperature.DefaultPowerPin,
+		"GPIO powering the 1-wire sensors to reset the bus (empty if always powered)")
+	flag.StringVar(&tempCfg.SysfsRoot, "onewire-sysfs-root", temperature.DefaultSysfsRoot,
+		"Directory listing the 1-wire devices")
+	flag.StringVar(&tempCfg.I2CBus, "i2c-bus", "",
+		"I²C bus with BME280 or SHT3x sensors, e.g. 1 (empty to disable)")
+	flag.DurationVar(&tempCfg.SampleInterval, "temperature-sample-interval", 0,
+		"Interval between reads of all temperature sensors, in addition to each settings query")
+	flag.DurationVar(&tempCfg.ReadTimeout, "temperature-read-timeout", 5*time.Second,
+		"Timeout of a single temperature sensor read")
+	flag.DurationVar(&tempCfg.ResetCooldown, "onewire-reset-cooldown", time.Minute,
+		"Minimum time between two resets of the 1-wire bus")
+	flag.Var(&bogusValues, "temperature-sensor-bogus-values",
+		"Comma-separated temperatures that 1-wire sensors report on errors, "+
+			"e.g. 85,-127 to accept 0°C from outdoor sensors (empty to accept all)")
+	flag.Float64Var(&sensorMaxChangePerMinute, "temperature-sensor-max-change", 2,
+		"Max plausible change of a temperature reading in °C per minute (0 to disable)")
+	flag.IntVar(&tempCfg.Validation.Retries, "temperature-sensor-retries", 2,
+		"Retries of failed or implausible temperature readings")
+	flag.DurationVar(&tempCfg.Validation.RetryBackoff, "temperature-sensor-retry-backoff", time.Second,
+		"Delay before the first retry of a temperature reading, doubling per retry")
+	flag.IntVar(&tempCfg.Validation.MedianOf, "temperature-sensor-median-of", 1,
+		"Smooth temperature readings over the median of the last N readings")
+
+	flag.StringVar(&settingsFile, "settings-file", settingsFile,
+		"JSON file defining the settings of the Ultrasource, instead of the built-in ones")
+	flag.BoolVar(&checkSheet, "check-sheet", checkSheet,
+		"Check on startup that the sheet has all tabs and named ranges the agent needs")
+	flag.BoolVar(&provisionSheet, "provision-sheet", provisionSheet,
+		"Add missing tabs and settings to the sheet on startup")
+	flag.StringVar(&sheetDir, "sheet-dir", sheetDir,
+		"Directory keeping the sheet as CSV files, instead of a Google Sheet")
+	flag.StringVar(&agentCfg.WebUIAddr, "web-ui-addr", "",
+		"Address to serve the web UI on, e.g. :8080 for localhost or 0.0.0.0:8080 for the LAN (empty to disable)")
+	flag.DurationVar(&agentCfg.WebUIHistoryInterval, "web-ui-history-interval", 10*time.Minute,
+		"Interval between rows of the history shown in the web UI")
+	flag.IntVar(&agentCfg.WebUIHistoryRows, "web-ui-history-rows", 144,
+		"Rows of the history shown in the web UI")
 	flag.BoolVar(&enableCanBus, "enable-can-bus", enableCanBus,
 		"Enable CAN bus")
 	flag.BoolVar(&enableOnewireBus, "enable-onewire-bus", enableOnewireBus,
@@ -92,19 +268,79 @@ func main() {
 		"File to touch every --heartbeat-delay")
 
 	flag.Parse()
-	if len(sheetCfg.SheetId) == 0 || len(sheetCfg.CredentialsFile) == 0 {
+	useSheet := len(sheetCfg.SheetId) > 0
+	useDir := len(sheetDir) > 0
+	if (!useSheet && !useDir && len(agentCfg.WebUIAddr) == 0) || (useSheet && len(sheetCfg.CredentialsFile) == 0) ||
+		(useSheet && useDir) {
 		fmt.Println("Usage:")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if settingsFile != "" {
+		if err := agent.LoadSettings(settingsFile); err != nil {
+			log.Fatalf("Unable to load settings: %v", err)
+		}
+	}
+	if rulesFile != "" {
+		rules, err := agent.LoadRules(rulesFile)
+		if err != nil {
+			log.Fatalf("Unable to load rules: %v", err)
+		}
+		agentCfg.Rules = rules
+	}
+	if err := agent.CheckRules(agentCfg); agentCfg.ApplyAutomaticSettings && err != nil {
+		log.Fatalf("Unable to use rules with the settings: %v", err)
+	}
+	if legionellaWeekday != "" {
+		d, err := agent.ParseWeekday(legionellaWeekday)
+		if err != nil {
+			log.Fatalf("Unable to parse --legionella-weekday: %v", err)
+		}
+		agentCfg.Legionella.OnWeekday, agentCfg.Legionella.Weekday = true, d
+	}
+	agentCfg.DeriveSyncTimeout = !isFlagSet("sync-timeout")
+	if err := agent.CheckSyncTimeout(agentCfg); err != nil {
+		log.Fatalf("Unable to use --sync-timeout: %v", err)
+	}
+	if _, err := temperature.NewDirectory("", temperatureSensors); err != nil {
+		log.Fatalf("Unable to use --temperature-sensor: %v", err)
+	}
 	agentCfg.TemperatureSensors = temperatureSensors
+	agentCfg.DerivedSensors = derivedSensors
+	agentCfg.ReconcilePolicies = reconcilePolicies
+	if err := agent.CheckReconcilePolicies(agentCfg); err != nil {
+		log.Fatalf("Unable to use --reconcile-policy: %v", err)
+	}
+	tempCfg.Validation.MaxChangePerMinute = float32(sensorMaxChangePerMinute)
+	tempCfg.Validation.BogusValues = bogusValues
 
 	log.Printf("CAN bus: %v", enableCanBus)
 	log.Printf("1-wire bus: %v", enableOnewireBus)
 	log.Printf("1-wire sensors: %v", agentCfg.TemperatureSensors)
 
 	ctx := context.Background()
-	sheet := googlesheet.NewClient(ctx, googlesheet.NewServiceClient(ctx, sheetCfg), sheetCfg)
+	var sheetSrv googlesheet.ServiceClient
+	if useSheet {
+		sheetSrv = googlesheet.NewServiceClient(ctx, sheetCfg)
+	} else if useDir {
+		var err error
+		sheetSrv, err = googlesheet.NewFileServiceClient(sheetDir)
+		if err != nil {
+			log.Fatalf("Unable to use sheet files in %v: %v", sheetDir, err)
+		}
+	} else {
+		log.Printf("No sheet, keeping values in memory")
+		sheetSrv = googlesheet.NewMemoryServiceClient()
+	}
+	if (useSheet || useDir) && (checkSheet || provisionSheet) {
+		missing, err := googlesheet.Provision(ctx, sheetSrv, sheetCfg, agent.SheetRequirements(agentCfg), provisionSheet)
+		if err != nil {
+			log.Printf("Failed to check sheet: %v", err)
+		} else if len(missing) > 0 {
+			log.Printf("Sheet is missing %v, copy them from the template sheet", missing)
+		}
+	}
+	sheet := googlesheet.NewClient(ctx, sheetSrv, sheetCfg)
 	var parser *ultrasource.Parser
 	var can ultrasource.Client
 	if enableCanBus {
@@ -113,7 +349,11 @@ func main() {
 	}
 	var sensors temperature.Client
 	if enableOnewireBus {
-		sensors = temperature.NewClient()
+		var err error
+		sensors, err = temperature.NewClient(ctx, tempCfg)
+		if err != nil {
+			log.Fatalf("Unable to set up 1-wire bus: %v", err)
+		}
 	}
 
 	if heartbeatFile != "" {
@@ -129,6 +369,16 @@ func main() {
 	agent.RunForever(ctx, sheet, parser, can, sensors, agentCfg)
 }
 
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func touch(fileName string) {
 	currentTime := time.Now().Local()
 	err := os.Chtimes(fileName, currentTime, currentTime)
@@ -6,6 +6,7 @@ require (
 	github.com/karlseguin/expect v1.0.8
 	github.com/vishalkuo/bimap v0.0.0-20220726225509-e0b4f20de28b
 	go.einride.tech/can v0.5.3
+	golang.org/x/sys v0.4.0
 	google.golang.org/api v0.109.0
 	periph.io/x/conn/v3 v3.7.0
 	periph.io/x/host/v3 v3.8.0
@@ -26,7 +27,6 @@ require (
 	golang.org/x/net v0.4.0 // indirect
 	golang.org/x/oauth2 v0.0.0-20221014153046-6fdb5e3db783 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 	golang.org/x/tools v0.4.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
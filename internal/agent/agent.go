@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"sort"
-	"strconv"
 	"time"
 
 	gs "parren.ch/ultrasource/pkg/googlesheet"
@@ -18,8 +16,12 @@ type Config struct {
 	UpdateCurrentSettings      bool
 	ApplyDesiredSettings       bool
 	ApplyAutomaticSettings     bool
+	ApplyScheduledSettings     bool
+	ApplySheetConfig           bool
 	LogCurrentSettingsToSheet  bool
 	LogCurrentSettingsToFiles  bool
+	AuditToSheet               bool
+	AuditToFiles               bool
 	CanPollingInterval         time.Duration
 	SheetPollingInterval       time.Duration
 	SettingsQueryInterval      time.Duration
@@ -27,59 +29,108 @@ type Config struct {
 	SettingsLogToSheetInterval time.Duration
 	SettingsLogToFilesInterval time.Duration
 	SettingsLogDelay           time.Duration
+	SyncTimeout                time.Duration
+	DeriveSyncTimeout          bool
+	SyncRetries                int
+	ReconcilePolicies          map[gs.Setting]ReconcilePolicy
+	ReconcileDelay             time.Duration
+	Rules                      []Rule
+	RulesDryRun                bool
+	Legionella                 LegionellaCycle
 	TemperatureSensors         map[string]string
+	TemperatureSensorNamesFile string
+	DiscoverTemperatureSensors bool
+	DerivedSensors             []DerivedSensor
+	DerivedSensorsInterval     time.Duration
+	DerivedSensorsMaxAge       time.Duration
 	LogStore                   logfiles.LogFileStore
+	WebUIAddr                  string
+	WebUIHistoryInterval       time.Duration
+	WebUIHistoryRows           int
 }
 
 func RunForever(ctx context.Context, sheet gs.Client, parser *us.Parser, can us.Client, sensors temp.Client, cfg Config) {
-	sensorNames := sortSensorNames(cfg)
+	cfg.deriveSyncTimeout()
+	sensorDir := newSensorDirectory(cfg)
+	live := newLiveConfig(cfg)
+	store := newStateStore()
+	audit := newAuditor(sheet, live)
+	if cfg.ApplySheetConfig {
+		log.Println("Applying config from sheet")
+		sc := newSheetConfig(cfg, sensorDir)
+		sc.apply(ctx, sheet, live)
+		cfg = live.get()
+		if cfg.SheetPollingInterval > 0 {
+			go applySheetConfigForever(ctx, sheet, sc, live)
+		}
+	}
 
 	answerMsgs := make(chan settingAnswerMessage, 100)
 	defer close(answerMsgs)
 	if cfg.UpdateCurrentSettings {
 		log.Println("Updating current settings in sheet from messages")
+		var filters *receiveFilters
+		if can != nil {
+			filters = newReceiveFilters(can)
+			filters.require(ReportedSettings)
+		}
 		if cfg.SettingsQueryInterval > 0 {
-			go queryCurrentSettingsForever(ctx, can, sensors, cfg)
+			go queryCurrentSettingsForever(ctx, can, filters, sensors, sensorDir, live)
 		}
 		if cfg.CanPollingInterval > 0 {
 			go receiveAnswerMessagesForever(ctx, can, parser, answerMsgs, cfg)
 		}
-		go updateCurrentSettingsForever(ctx, answerMsgs, sheet, cfg)
+		go updateSheetForever(ctx, store.subscribe(), sheet)
+		go updateCurrentSettingsForever(answerMsgs, store)
 		if sensors != nil {
-			go updateSensorReadingsForever(ctx, sensors.TemperatureReadings(), sheet, cfg)
+			go updateSensorReadingsForever(ctx, sensors.Subscribe(sensorReadingsBuffer), store, sensorDir)
+		}
+		if (len(cfg.DerivedSensors) > 0 || cfg.ApplySheetConfig) && cfg.DerivedSensorsInterval > 0 {
+			go updateDerivedSensorsForever(ctx, store, live)
 		}
 		if cfg.LogCurrentSettingsToSheet {
-			go logCurrentSettingsToSheetForever(ctx, sheet, cfg, sensorNames)
+			go logCurrentSettingsToSheetForever(ctx, sheet, store, live, sensorDir)
 		}
 		if cfg.LogCurrentSettingsToFiles {
-			go logCurrentSettingsToFilesForever(ctx, sheet, cfg, sensorNames)
+			go logCurrentSettingsToFilesForever(ctx, store, live, sensorDir)
 		}
 	}
+	if cfg.WebUIAddr != "" {
+		go serveWebUIForever(ctx, newWebUI(sheet, store, audit, sensorDir, live), cfg)
+	}
 	if cfg.ApplyDesiredSettings {
 		log.Println("Applying changed desired settings from sheet as messages")
-		go updateDesiredSettingsForever(ctx, sheet, can, cfg)
+		go updateDesiredSettingsForever(ctx, sheet, store, can, audit, live)
 	}
 	<-ctx.Done()
 }
 
-func sortSensorNames(cfg Config) []string {
-	ns := make([]string, 0, len(cfg.TemperatureSensors))
-	for _, n := range cfg.TemperatureSensors {
-		ns = append(ns, n)
+func newSensorDirectory(cfg Config) *temp.Directory {
+	dir, err := temp.NewDirectory(cfg.TemperatureSensorNamesFile, cfg.TemperatureSensors)
+	if err != nil {
+		log.Printf("Failed to load sensor names, using only configured ones: %v\n", err)
+		if dir, err = temp.NewDirectory("", cfg.TemperatureSensors); err != nil {
+			log.Fatalf("Failed to use configured sensor names: %v\n", err)
+		}
 	}
-	sort.Strings(ns)
-	return ns
+	return dir
 }
 
+const sensorReadingsBuffer = 16
+
 type settingAnswerMessage struct {
 	msg us.Message
 	set Setting
 }
 
-func queryCurrentSettingsForever(ctx context.Context, xmit us.Transmitter, sensors temp.Client, cfg Config) {
-	runThenTick(ctx, cfg.SettingsQueryInterval, func() {
+func queryCurrentSettingsForever(ctx context.Context, xmit us.Transmitter, filters *receiveFilters,
+	sensors temp.Client, sensorDir *temp.Directory, live *liveConfig,
+) {
+	interval := func(cfg Config) time.Duration { return cfg.SettingsQueryInterval }
+	runThenTickLive(ctx, live, interval, func(cfg Config) {
 		if xmit != nil {
 			log.Println("Querying current settings")
+			filters.require(ReportedSettings)
 			for _, s := range ReportedSettings {
 				f, err := us.BuildFrame(us.IsQuery, s.valueId, nil)
 				if err != nil {
@@ -95,15 +146,42 @@ func queryCurrentSettingsForever(ctx context.Context, xmit us.Transmitter, senso
 			}
 		}
 		if sensors != nil {
+			if cfg.DiscoverTemperatureSensors {
+				discoverSensors(sensors, sensorDir)
+			}
 			log.Println("Querying current sensor readings")
-			for id, name := range cfg.TemperatureSensors {
-				log.Printf("Reading sensor %v: %v\n", name, id)
+			ids := sensorDir.Ids()
+			sensors.Schedule(ids)
+			for _, id := range ids {
+				log.Printf("Reading sensor %v: %v\n", sensorDir.Name(id), id)
 				sensors.RequestTemp(id)
 			}
 		}
 	})
 }
 
+func discoverSensors(sensors temp.Client, sensorDir *temp.Directory) {
+	ids, err := sensors.Discover()
+	if err != nil {
+		log.Printf("Failed to discover sensors: %v\n", err)
+		return
+	}
+	ch, err := sensorDir.Update(ids)
+	if err != nil {
+		log.Printf("Failed to update sensor names: %v\n", err)
+	}
+	for _, id := range ch.New {
+		log.Printf("Found sensor %v: %v\n", sensorDir.Name(id), id)
+	}
+	for _, id := range ch.Missing {
+		log.Printf("Missing sensor %v: %v\n", sensorDir.Name(id), id)
+	}
+	for old, id := range ch.Replaced {
+		log.Printf("Sensor %v: %v seems to be replaced by %v, name it in the sensor names file\n",
+			sensorDir.Name(old), old, id)
+	}
+}
+
 func receiveAnswerMessagesForever(ctx context.Context, recv us.Receiver, parser *us.Parser,
 	out chan<- settingAnswerMessage, cfg Config,
 ) {
@@ -134,27 +212,17 @@ func receiveAnswerMessagesForever(ctx context.Context, recv us.Receiver, parser
 	})
 }
 
-func updateCurrentSettingsForever(ctx context.Context, msgs <-chan settingAnswerMessage, sheet gs.Client, cfg Config) {
+func updateCurrentSettingsForever(msgs <-chan settingAnswerMessage, store *stateStore) {
 	for m := range msgs {
 		if v, ok := m.set.ParseMessage(m.msg); ok {
-			s := m.set.SheetSetting
-			fv := gs.FacetValue{Setting: s, Facet: gs.Have, Value: v}
-			if m.set.isStable {
-				sheet.RefreshFacetValue(ctx, fv)
-			} else {
-				sheet.RefreshFluctuatingHaveValue(ctx, fv)
-			}
-			if m.set.isDesired {
-				vs := sheet.ReadSettingValues(ctx, s)
-				if vs.Want == vs.Have && vs.Sent != vs.Have {
-					sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s, Facet: gs.Sent, Value: vs.Have})
-				}
-			}
+			store.set(newCurrentValue(m.set.SheetSetting, v, fromCan))
 		}
 	}
 }
 
-func updateSensorReadingsForever(ctx context.Context, readings <-chan temp.TemperatureReading, sheet gs.Client, cfg Config) {
+func updateSensorReadingsForever(ctx context.Context, readings <-chan temp.TemperatureReading, store *stateStore,
+	sensorDir *temp.Directory,
+) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -164,51 +232,98 @@ func updateSensorReadingsForever(ctx context.Context, readings <-chan temp.Tempe
 				log.Printf("Failed to read sensor %v: %v\n", r.Id, r.Error)
 				continue
 			}
-			name := cfg.TemperatureSensors[r.Id]
-			fv := gs.FacetValue{Setting: gs.Setting(name), Facet: gs.Have, Value: fmt.Sprintf("%v", r.Temperature)}
-			sheet.RefreshFluctuatingHaveValue(ctx, fv)
+			if r.Quality != temp.Good {
+				log.Printf("Dropping %v reading %v of sensor %v\n", r.Quality, r.Temperature, r.Id)
+				continue
+			}
+			r = sensorDir.Calibrate(r)
+			name := sensorDir.Name(r.Id)
+			store.set(newCurrentValue(gs.Setting(name), fmt.Sprintf("%v", r.Temperature), fromSensor))
+			sensorDir.Observe(r)
+			for q, v := range r.Quantities {
+				name := sensorDir.QuantityName(r.Id, q)
+				store.set(newCurrentValue(gs.Setting(name), fmt.Sprintf("%v", v), fromSensor))
+			}
 		}
 	}
 }
 
-func updateDesiredSettingsForever(ctx context.Context, sheet gs.Client, xmit us.Transmitter, cfg Config) {
-	runThenTick(ctx, cfg.SheetPollingInterval, func() {
+func updateDesiredSettingsForever(ctx context.Context, sheet gs.Client, store *stateStore, xmit us.Transmitter,
+	audit *auditor, live *liveConfig,
+) {
+	sched := newScheduler(audit)
+	syncs := map[gs.Setting]*settingSync{}
+	rules := newRuleEngine(audit)
+	legionella := newLegionellaManager(audit, live.get().Legionella.StateFile)
+	if xmit == nil {
+		// The Sent values stay as they are, rather than showing failures.
+		log.Println("CAN bus disabled. Not sending desired settings")
+	}
+	interval := func(cfg Config) time.Duration { return cfg.SheetPollingInterval }
+	runThenTickLive(ctx, live, interval, func(cfg Config) {
+		if cfg.ApplyScheduledSettings {
+			sched.apply(ctx, sheet, time.Now())
+		}
+		if cfg.Legionella.enabled() || legionella.holds() != nil {
+			legionella.apply(ctx, sheet, store, cfg.Legionella, time.Now())
+		}
 		if cfg.ApplyAutomaticSettings {
-			applyAutomaticWaterTemperatureSetting(ctx, sheet, xmit, cfg)
+			rules.apply(ctx, sheet, store, cfg, legionella.holds(), time.Now())
+		}
+		if xmit != nil {
+			applyDesiredSettings(ctx, sheet, store, xmit, audit, syncs, cfg, time.Now())
 		}
-		applyDesiredSettings(ctx, sheet, xmit, cfg)
 	})
 }
 
-func applyDesiredSettings(ctx context.Context, sheet gs.Client, xmit us.Transmitter, cfg Config) {
+func applyDesiredSettings(ctx context.Context, sheet gs.Client, store *stateStore, xmit us.Transmitter,
+	audit *auditor, syncs map[gs.Setting]*settingSync, cfg Config, now time.Time,
+) {
 	log.Println("Polling for changed desired settings")
 	for _, s := range PushedSettings {
-		vs := sheet.ReadSettingValues(ctx, s.SheetSetting)
-		if vs.Want != vs.Have {
-			if vs.Want == vs.Sent {
-				log.Printf("Picking up value changed externally: %v\n", vs)
-				sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Want, Value: vs.Have})
-				sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Sent, Value: vs.Have})
-			} else if vs.Sent != vs.Want+">" {
-				sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Sent, Value: vs.Want})
-				if xmit != nil {
-					applyDesiredSetting(ctx, s, vs, xmit, sheet)
-				} else {
-					log.Printf("CAN bus disabled. Ignoring changed desired setting %v\n", vs)
-				}
+		vs, err := sheet.ReadSettingValues(ctx, s.SheetSetting)
+		if err != nil {
+			log.Printf("Failed to read desired setting %v: %v\n", s.SheetSetting, err)
+			continue
+		}
+		ss, ok := syncs[s.SheetSetting]
+		if !ok {
+			ss = &settingSync{}
+			syncs[s.SheetSetting] = ss
+		}
+		prev := ss.state
+		answer, _ := store.get(s.SheetSetting)
+		switch ss.next(vs, answer, now, cfg) {
+		case syncPickUp:
+			log.Printf("Picking up value changed externally: %v\n", vs)
+			if audit.writeWant(ctx, s.SheetSetting, vs.Want, vs.Have, byDisplay) != nil {
+				continue
 			}
-		} else if vs.Sent != vs.Have {
-			sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Sent, Value: vs.Have})
+		case syncNotify:
+			policy := cfg.reconcilePolicy(s.SheetSetting)
+			log.Printf("Value changed externally, keeping it for now (%v): %v\n", policy, vs)
+			audit.deviated(ctx, vs, policy)
+		case syncSend:
+			ss.sent(applyDesiredSetting(ctx, s, vs, xmit, sheet, audit), now, cfg)
+		}
+		if ss.state != prev {
+			log.Printf("Sync of %v: %v -> %v\n", s.SheetSetting, prev, ss.state)
+		}
+		if sent := ss.sentValue(vs.Have); sent != vs.Sent {
+			writeFacetValue(ctx, sheet, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Sent, Value: sent})
 		}
 	}
 }
 
-func applyDesiredSetting(ctx context.Context, s Setting, vs gs.SettingValues, xmit us.Transmitter, sheet gs.Client) {
+func applyDesiredSetting(ctx context.Context, s Setting, vs gs.SettingValues, xmit us.Transmitter, sheet gs.Client,
+	audit *auditor,
+) error {
 	log.Printf("Applying desired setting %v\n", vs)
 	f, err := s.MakeUpdateFrame(vs)
 	if err != nil {
 		log.Printf("Failed to create update frame for %v: %v\n", vs, err)
-		return
+		audit.sent(ctx, vs, err)
+		return err
 	}
 	sheet.InvalidateSettingValue(s.SheetSetting)
 
@@ -216,104 +331,84 @@ func applyDesiredSetting(ctx context.Context, s Setting, vs gs.SettingValues, xm
 	err = xmit.TransmitFrame(ctx, f)
 	if err != nil {
 		log.Printf("Failed to send frame: %v: %v\n", f, err)
+		audit.sent(ctx, vs, err)
+		return err
 	}
-	sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s.SheetSetting, Facet: gs.Sent, Value: vs.Want + ">"})
+	audit.sent(ctx, vs, nil)
+	readBackSetting(ctx, s, xmit)
+	return nil
 }
 
-const (
-	triggerWaterTempCelsiusBoth = 60
-	triggerWaterTempCelsiusOne  = 62
-	reducedWaterTempCelsius     = "50"
-)
-
-func applyAutomaticWaterTemperatureSetting(ctx context.Context, sheet gs.Client, xmit us.Transmitter, cfg Config) {
-	log.Println("Polling for automatic water temperature adjustments")
-
-	if isWaterTempAtLeast(triggerWaterTempCelsiusBoth, sheet) >= 2 {
-		log.Printf("Both water temps have reached limit of %v\n", triggerWaterTempCelsiusBoth)
-	} else if isWaterTempAtLeast(triggerWaterTempCelsiusOne, sheet) >= 1 {
-		log.Printf("One water temp has reached limit of %v\n", triggerWaterTempCelsiusOne)
-	} else {
-		return
-	}
-
-	vs := sheet.ReadSettingValues(ctx, gs.WaterProgram)
-	if vs.Want != WaterProgramConstant {
-		log.Printf("Water program is not set to constant, but %v\n", vs.Want)
-		return
-	}
-
-	vs = sheet.ReadSettingValues(ctx, gs.DesiredWaterTemp)
-	celsius, err := strconv.ParseFloat(vs.Want, 32)
+// readBackSetting queries a setting right after sending it, instead of
+// waiting for the next query of all settings. The answer is checked on the
+// next poll of the sheet.
+func readBackSetting(ctx context.Context, s Setting, xmit us.Transmitter) {
+	f, err := us.BuildFrame(us.IsQuery, s.valueId, nil)
 	if err != nil {
-		log.Printf("Failed to parse desired water temp: %v\n", vs.Want)
-	} else if celsius < triggerWaterTempCelsiusBoth {
-		log.Printf("Water temp is already set to %v\n", vs.Want)
+		log.Printf("Failed to create query frame for %v: %v\n", s.valueId, err)
 		return
 	}
-
-	log.Printf("Reducing water temp from %v to %v\n", vs.Want, reducedWaterTempCelsius)
-	sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredWaterTemp, Facet: gs.Want, Value: reducedWaterTempCelsius})
+	log.Printf("Sending CAN frame %v\n", f)
+	if err := xmit.TransmitFrame(ctx, f); err != nil {
+		log.Printf("Failed to send frame: %v: %v\n", f, err)
+	}
 }
 
-func isWaterTempAtLeast(desiredCelsius float64, sheet gs.Client) int {
-	n := 0
-	for _, s := range []gs.Setting{gs.ActualWaterTempHigher, gs.ActualWaterTempLower} {
-		v, ok := sheet.LatestValues()[s]
-		if !ok {
-			log.Printf("Failed to obtain water temp: %v\n", s)
-			continue
-		}
-		celsius, err := strconv.ParseFloat(v, 32)
-		if err != nil {
-			log.Printf("Failed to parse water temp: %v: %v\n", s, v)
-			continue
-		}
-		if celsius < desiredCelsius {
-			continue
-		}
-		n += 1
+// writeFacetValue writes v and logs a failure. It returns whether the
+// write succeeded.
+func writeFacetValue(ctx context.Context, sheet gs.Client, v gs.FacetValue) bool {
+	if err := sheet.WriteFacetValue(ctx, v); err != nil {
+		log.Printf("Failed to write %v: %v\n", v, err)
+		return false
 	}
-	return n
+	return true
 }
 
-func logCurrentSettingsToSheetForever(ctx context.Context, sheet gs.Client, cfg Config, sensorNames []string) {
-	time.Sleep(cfg.SettingsLogDelay)
-	runThenTick(ctx, cfg.SettingsLogToSheetInterval, func() {
+func logCurrentSettingsToSheetForever(ctx context.Context, sheet gs.Client, store *stateStore, live *liveConfig,
+	sensorDir *temp.Directory,
+) {
+	time.Sleep(live.get().SettingsLogDelay)
+	interval := func(cfg Config) time.Duration { return cfg.SettingsLogToSheetInterval }
+	runThenTickLive(ctx, live, interval, func(cfg Config) {
 		log.Println("Logging current settings to sheet")
+		ts := time.Now()
 		header := []interface{}{"Timestamp"}
-		row := []interface{}{gs.FormatTimestamp(time.Now())}
-		appendValuesToLogRow(sheet, cfg, sensorNames, &header, &row)
-		sheet.Write(ctx, "Log!A1", [][]interface{}{header})
-		sheet.AppendOverwritingRows(ctx, "Log!A1", [][]interface{}{row})
+		row := []interface{}{gs.FormatTimestamp(ts)}
+		appendValuesToLogRow(store, cfg, sensorDir, &header, &row)
+		if err := sheet.AppendLogRow(ctx, logTab, ts, header, row); err != nil {
+			log.Printf("Failed to log row: %v\n", err)
+		}
 	})
 }
 
-func logCurrentSettingsToFilesForever(ctx context.Context, sheet gs.Client, cfg Config, sensorNames []string) {
-	time.Sleep(cfg.SettingsLogDelay)
-	runThenTick(ctx, cfg.SettingsLogToFilesInterval, func() {
+func logCurrentSettingsToFilesForever(ctx context.Context, store *stateStore, live *liveConfig, sensorDir *temp.Directory) {
+	time.Sleep(live.get().SettingsLogDelay)
+	interval := func(cfg Config) time.Duration { return cfg.SettingsLogToFilesInterval }
+	runThenTickLive(ctx, live, interval, func(cfg Config) {
 		log.Println("Logging current settings to file")
 		ts := time.Now()
 		header := []interface{}{"Timestamp"}
 		row := []interface{}{logfiles.FormatTimestamp(ts)}
-		appendValuesToLogRow(sheet, cfg, sensorNames, &header, &row)
+		appendValuesToLogRow(store, cfg, sensorDir, &header, &row)
 		if err := cfg.LogStore.Write(ts, header, row); err != nil {
 			log.Printf("Failed to log row: %v\n", err)
 		}
 	})
 }
 
-func appendValuesToLogRow(sheet gs.Client, cfg Config, sensorNames []string, header, row *[]interface{}) {
+func appendValuesToLogRow(store *stateStore, cfg Config, sensorDir *temp.Directory, header, row *[]interface{}) {
+	latest := store.all()
 	for _, s := range ReportedSettings {
 		*header = append(*header, s.SheetSetting)
-		v := sheet.LatestValues()[s.SheetSetting]
-		*row = append(*row, v)
+		*row = append(*row, latest[s.SheetSetting].Text)
 	}
-	for _, name := range sensorNames {
+	for _, name := range sensorDir.Names() {
 		*header = append(*header, name)
-		s := gs.Setting(name)
-		v := sheet.LatestValues()[s]
-		*row = append(*row, v)
+		*row = append(*row, latest[gs.Setting(name)].Text)
+	}
+	for _, d := range cfg.DerivedSensors {
+		*header = append(*header, d.Name)
+		*row = append(*row, latest[gs.Setting(d.Name)].Text)
 	}
 }
 
@@ -333,3 +428,37 @@ func runThenTick(ctx context.Context, interval time.Duration, body func()) {
 		}
 	}
 }
+
+// runThenTickLive is runThenTick with the live config, which may change
+// the interval between runs. Without a positive interval, it runs once.
+func runThenTickLive(ctx context.Context, live *liveConfig, interval func(Config) time.Duration, body func(Config)) {
+	curr := interval(live.get())
+	if curr <= 0 {
+		log.Printf("Running once, as the interval is %v\n", curr)
+		body(live.get())
+		return
+	}
+	runner := make(chan struct{}, 1)
+	runner <- struct{}{}
+	ticker := time.NewTicker(curr)
+	defer ticker.Stop()
+	run := func() {
+		cfg := live.get()
+		body(cfg)
+		if next := interval(cfg); next != curr && next > 0 {
+			log.Printf("Changing interval from %v to %v\n", curr, next)
+			curr = next
+			ticker.Reset(next)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-runner:
+			run()
+		case <-ticker.C:
+			run()
+		}
+	}
+}
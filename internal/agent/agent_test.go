@@ -2,15 +2,23 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"go.einride.tech/can"
+	"parren.ch/ultrasource/pkg/expr"
 	gs "parren.ch/ultrasource/pkg/googlesheet"
+	gst "parren.ch/ultrasource/pkg/googlesheet/googlesheettest"
+	temp "parren.ch/ultrasource/pkg/temperature"
 	us "parren.ch/ultrasource/pkg/ultrasource"
 )
 
@@ -31,7 +39,7 @@ func TestSetNewValue(t *testing.T) {
 		{
 			setting: "heating_program",
 			valueId: us.HeatingProgramId,
-			init:    fakeRow{"konstant", "konstant", "konstant", ""},
+			init:    fakeRow{"konstant", "konstant", "konstant"},
 			update:  "standby",
 			sent:    "Standby",
 			pending: fakeRow{"standby", "standby>", "konstant"},
@@ -40,7 +48,7 @@ func TestSetNewValue(t *testing.T) {
 		{
 			setting: "water_program",
 			valueId: us.WaterProgramId,
-			init:    fakeRow{"konstant", "konstant", "konstant", ""},
+			init:    fakeRow{"konstant", "konstant", "konstant"},
 			update:  "standby",
 			sent:    "Standby",
 			pending: fakeRow{"standby", "standby>", "konstant"},
@@ -49,7 +57,7 @@ func TestSetNewValue(t *testing.T) {
 		{
 			setting: "room_temp",
 			valueId: us.DesiredConstantRoomTempId,
-			init:    fakeRow{"10", "10", "10", ""},
+			init:    fakeRow{"10", "10", "10"},
 			update:  "45",
 			sent:    float32(45),
 			pending: fakeRow{"45", "45>", "10"},
@@ -58,7 +66,7 @@ func TestSetNewValue(t *testing.T) {
 		{
 			setting: "water_temp",
 			valueId: us.DesiredConstantWaterTempId,
-			init:    fakeRow{"10", "10", "10", ""},
+			init:    fakeRow{"10", "10", "10"},
 			update:  "45",
 			sent:    float32(45),
 			pending: fakeRow{"45", "45>", "10"},
@@ -72,7 +80,7 @@ func TestSetNewValue(t *testing.T) {
 
 			parser, can := initCan()
 			sheetClient, sheet := initSheet(ctx)
-			sheet.rows[tt.setting] = tt.init
+			sheet.SetRow(tt.setting, tt.init...)
 
 			agentCfg := Config{
 				UpdateCurrentSettings: true,
@@ -83,13 +91,13 @@ func TestSetNewValue(t *testing.T) {
 			go RunForever(ctx, sheetClient, parser, can, nil, agentCfg)
 
 			time.Sleep(step)
-			if err := sheet.checkRowStart(tt.setting, tt.init); err != nil {
+			if err := sheet.CheckRowStart(tt.setting, tt.init...); err != nil {
 				t.Fatal(err)
 			}
-			sheet.simulateUser(tt.setting, tt.update)
+			sheet.SetRow(tt.setting+"_want", tt.update)
 
 			time.Sleep(step)
-			if err := sheet.checkRowStart(tt.setting, tt.pending); err != nil {
+			if err := sheet.CheckRowStart(tt.setting, tt.pending...); err != nil {
 				t.Fatal(err)
 			}
 			if err := can.checkXmit(us.IsSet, tt.valueId, tt.sent); err != nil {
@@ -99,7 +107,7 @@ func TestSetNewValue(t *testing.T) {
 			can.simulateFrame(mustBuildFrame(t, us.IsAnswer, tt.valueId, tt.sent))
 
 			time.Sleep(step)
-			if err := sheet.checkRowStart(tt.setting, tt.final); err != nil {
+			if err := sheet.CheckRowStart(tt.setting, tt.final...); err != nil {
 				t.Fatal(err)
 			}
 			if err := can.checkNotXmit(us.IsSet, tt.valueId, tt.sent); err != nil {
@@ -116,7 +124,7 @@ func TestQuerySettings(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["actual_water_temp"] = fakeRow{"", "", "", ""}
+	sheet.SetRow("actual_water_temp", "", "", "")
 
 	const queryInterval = step * 5
 
@@ -144,6 +152,28 @@ func TestQuerySettings(t *testing.T) {
 	}
 }
 
+func TestReceiveFilters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer time.Sleep(tick)
+
+	parser, can := initCan()
+	sheetClient, _ := initSheet(ctx)
+
+	agentCfg := Config{
+		UpdateCurrentSettings: true,
+		SettingsQueryInterval: step,
+	}
+	go RunForever(ctx, sheetClient, parser, can, nil, agentCfg)
+
+	time.Sleep(step)
+	can.lock.Lock()
+	defer can.lock.Unlock()
+	if len(can.filters) != 1 || can.filters[0].Device != us.Controller {
+		t.Fatalf("expected filter for %v, but got: %v", us.Controller, can.filters)
+	}
+}
+
 func TestUpdateAndLogValues(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -151,8 +181,8 @@ func TestUpdateAndLogValues(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["actual_water_temp"] = fakeRow{"", "", "", ""}
-	sheet.rows["actual_water_temp_lower"] = fakeRow{"", "", "", ""}
+	sheet.SetRow("actual_water_temp", "", "", "")
+	sheet.SetRow("actual_water_temp_lower", "", "", "")
 
 	const logDelay = step * 10
 	const logInterval = step * 15
@@ -168,97 +198,161 @@ func TestUpdateAndLogValues(t *testing.T) {
 	start := time.Now()
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", ""); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", ""); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", ""); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", ""); err != nil {
 		t.Fatal(err)
 	}
-	if len(sheet.logs) > 0 {
-		t.Fatalf("expected no logs, but got: %v", sheet.logs)
+	if len(sheet.Appends()) > 0 {
+		t.Fatalf("expected no logs, but got: %v", sheet.Appends())
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(12.34)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "12.3"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "12.3"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", ""); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", ""); err != nil {
 		t.Fatal(err)
 	}
-	if len(sheet.logs) > 0 {
-		t.Fatalf("expected no logs yet, but got: %v", sheet.logs)
+	if len(sheet.Appends()) > 0 {
+		t.Fatalf("expected no logs yet, but got: %v", sheet.Appends())
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(34.56)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "12.3"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "12.3"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "34.5"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "34.5"); err != nil {
 		t.Fatal(err)
 	}
-	if len(sheet.logs) > 0 {
-		t.Fatalf("expected no logs yet, but got: %v", sheet.logs)
+	if len(sheet.Appends()) > 0 {
+		t.Fatalf("expected no logs yet, but got: %v", sheet.Appends())
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(23.45)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "23.4"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "23.4"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "34.5"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "34.5"); err != nil {
 		t.Fatal(err)
 	}
-	if len(sheet.logs) > 0 {
-		t.Fatalf("expected no logs yet, but got: %v", sheet.logs)
+	if len(sheet.Appends()) > 0 {
+		t.Fatalf("expected no logs yet, but got: %v", sheet.Appends())
 	}
 
 	time.Sleep(logDelay - time.Since(start) - step)
-	if len(sheet.logs) > 0 {
-		t.Fatalf("expected no logs yet, but got: %v", sheet.logs)
+	if len(sheet.Appends()) > 0 {
+		t.Fatalf("expected no logs yet, but got: %v", sheet.Appends())
 	}
 
 	time.Sleep(logDelay - time.Since(start) + step)
-	if len(sheet.logs) != 1 {
-		t.Fatalf("expected 1 log, but got: %v", sheet.logs)
+	if len(sheet.Appends()) != 1 {
+		t.Fatalf("expected 1 log, but got: %v", sheet.Appends())
 	}
-	if err := sheet.checkLastLog(actualWaterTempHigherIdx, "23.4"); err != nil {
+	if err := sheet.CheckLastAppend(int(actualWaterTempHigherIdx), "23.4"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkLastLog(actualWaterTempLowerIdx, "34.5"); err != nil {
+	if err := sheet.CheckLastAppend(int(actualWaterTempLowerIdx), "34.5"); err != nil {
 		t.Fatal(err)
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(40)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "40"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "40"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "34.5"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "34.5"); err != nil {
 		t.Fatal(err)
 	}
-	if len(sheet.logs) != 1 {
-		t.Fatalf("expected 1 log, but got: %v", sheet.logs)
+	if len(sheet.Appends()) != 1 {
+		t.Fatalf("expected 1 log, but got: %v", sheet.Appends())
 	}
 
 	time.Sleep(logDelay + logInterval - time.Since(start) - step)
-	if len(sheet.logs) != 1 {
-		t.Fatalf("expected 1 logs, but got: %v", sheet.logs)
+	if len(sheet.Appends()) != 1 {
+		t.Fatalf("expected 1 logs, but got: %v", sheet.Appends())
 	}
 
 	time.Sleep(logDelay + logInterval - time.Since(start) + step)
-	if len(sheet.logs) != 2 {
-		t.Fatalf("expected 2 logs, but got: %v", sheet.logs)
+	if len(sheet.Appends()) != 2 {
+		t.Fatalf("expected 2 logs, but got: %v", sheet.Appends())
 	}
-	if err := sheet.checkLastLog(actualWaterTempHigherIdx, "40"); err != nil {
+	if err := sheet.CheckLastAppend(int(actualWaterTempHigherIdx), "40"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkLastLog(actualWaterTempLowerIdx, "34.5"); err != nil {
+	if err := sheet.CheckLastAppend(int(actualWaterTempLowerIdx), "34.5"); err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestDerivedSensors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer time.Sleep(tick)
+
+	parser, can := initCan()
+	sheetClient, sheet := initSheet(ctx)
+	spread, err := expr.Parse("actual_water_temp - actual_water_temp_lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agentCfg := Config{
+		UpdateCurrentSettings:  true,
+		CanPollingInterval:     tick,
+		DerivedSensors:         []DerivedSensor{{Name: "water_temp_spread", Expr: spread}},
+		DerivedSensorsInterval: tick,
+	}
+	go RunForever(ctx, sheetClient, parser, can, nil, agentCfg)
+
+	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(55.5)))
+	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(50)))
+
+	time.Sleep(step)
+	if err := sheet.CheckRowStart("water_temp_spread_have", "5.5"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDerivedSensorsSkipStaleAndNonFinite(t *testing.T) {
+	now := time.Now()
+	store := newStateStore()
+	stale := newCurrentValue("temp1m", "20", fromSensor)
+	stale.At = now.Add(-3 * time.Hour)
+	store.set(stale)
+	store.set(newCurrentValue("temp5m", "21", fromSensor))
+	store.set(newCurrentValue("bathroom_humidity", "0", fromSensor))
+
+	derived := func(name, src string) DerivedSensor {
+		e, err := expr.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DerivedSensor{Name: name, Expr: e}
+	}
+	cfg := Config{
+		DerivedSensors: []DerivedSensor{
+			derived("temp_diff", "temp5m - temp1m"),
+			derived("temp5m_dewpoint", "dewpoint(temp5m, bathroom_humidity)"),
+			derived("temp5m_half", "temp5m / 2"),
+		},
+		DerivedSensorsMaxAge: 2 * time.Hour,
+	}
+	updateDerivedSensors(store, cfg, now)
+	for _, s := range []gs.Setting{"temp_diff", "temp5m_dewpoint"} {
+		if v, ok := store.get(s); ok {
+			t.Fatalf("expected no %v, but got %+v", s, v)
+		}
+	}
+	if v, ok := store.get("temp5m_half"); !ok || v.Text != "10.5" {
+		t.Fatalf("expected temp5m_half 10.5, but got %+v", v)
+	}
+}
+
 func TestAutoResetLegionellaTemp(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -266,8 +360,8 @@ func TestAutoResetLegionellaTemp(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["water_program"] = fakeRow{"konstant", "konstant", "konstant", ""}
-	sheet.rows["water_temp"] = fakeRow{"60", "60", "60", ""}
+	sheet.SetRow("water_program", "konstant", "konstant", "konstant")
+	sheet.SetRow("water_temp", "60", "60", "60")
 
 	agentCfg := Config{
 		UpdateCurrentSettings:  true,
@@ -279,46 +373,46 @@ func TestAutoResetLegionellaTemp(t *testing.T) {
 	go RunForever(ctx, sheetClient, parser, can, nil, agentCfg)
 
 	time.Sleep(step)
-	if err := sheet.checkRowStart("water_temp", fakeRow{"60", "60", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"60", "60", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(59.9)))
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(59.8)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "59.9"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "59.9"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "59.8"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "59.8"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"60", "60", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"60", "60", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(60.0)))
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(59.9)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "59.9"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "59.9"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"60", "60", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"60", "60", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempHigherId, float32(60.0)))
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(60.0)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"50", "50>", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"50", "50>", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	if err := can.checkXmit(us.IsSet, us.DesiredConstantWaterTempId, float32(50)); err != nil {
@@ -333,8 +427,8 @@ func TestAutoResetLegionellaTemp_ifOnlyOneHigher(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["water_program"] = fakeRow{"konstant", "konstant", "konstant", ""}
-	sheet.rows["water_temp"] = fakeRow{"60", "60", "60", ""}
+	sheet.SetRow("water_program", "konstant", "konstant", "konstant")
+	sheet.SetRow("water_temp", "60", "60", "60")
 
 	agentCfg := Config{
 		UpdateCurrentSettings:  true,
@@ -349,13 +443,13 @@ func TestAutoResetLegionellaTemp_ifOnlyOneHigher(t *testing.T) {
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(62.0)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "59"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "59"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "62"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "62"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"50", "50>", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"50", "50>", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	if err := can.checkXmit(us.IsSet, us.DesiredConstantWaterTempId, float32(50)); err != nil {
@@ -363,6 +457,33 @@ func TestAutoResetLegionellaTemp_ifOnlyOneHigher(t *testing.T) {
 	}
 }
 
+func TestAutoResetLegionellaTemp_ifOnlyOneReported(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer time.Sleep(tick)
+
+	parser, can := initCan()
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("water_program", "konstant", "konstant", "konstant")
+	sheet.SetRow("water_temp", "60", "60", "60")
+
+	agentCfg := Config{
+		UpdateCurrentSettings:  true,
+		ApplyDesiredSettings:   true,
+		ApplyAutomaticSettings: true,
+		CanPollingInterval:     tick,
+		SheetPollingInterval:   tick,
+	}
+	go RunForever(ctx, sheetClient, parser, can, nil, agentCfg)
+
+	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(62.0)))
+
+	time.Sleep(step)
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"50", "50>", "60"}...); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAutoResetLegionellaTemp_ifWrongProgram(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -370,8 +491,8 @@ func TestAutoResetLegionellaTemp_ifWrongProgram(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["water_program"] = fakeRow{"standby", "standby", "standby", ""}
-	sheet.rows["water_temp"] = fakeRow{"60", "60", "60", ""}
+	sheet.SetRow("water_program", "standby", "standby", "standby")
+	sheet.SetRow("water_temp", "60", "60", "60")
 
 	agentCfg := Config{
 		UpdateCurrentSettings:  true,
@@ -386,13 +507,13 @@ func TestAutoResetLegionellaTemp_ifWrongProgram(t *testing.T) {
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(60.0)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"60", "60", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"60", "60", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	if err := can.checkNotXmit(us.IsSet, us.DesiredConstantWaterTempId, float32(50)); err != nil {
@@ -407,8 +528,8 @@ func TestAutoResetLegionellaTemp_ifAlreadyLower(t *testing.T) {
 
 	parser, can := initCan()
 	sheetClient, sheet := initSheet(ctx)
-	sheet.rows["water_program"] = fakeRow{"standby", "standby", "standby", ""}
-	sheet.rows["water_temp"] = fakeRow{"10", "10>", "60", ""}
+	sheet.SetRow("water_program", "standby", "standby", "standby")
+	sheet.SetRow("water_temp", "10", "10>", "60")
 
 	agentCfg := Config{
 		UpdateCurrentSettings:  true,
@@ -423,13 +544,13 @@ func TestAutoResetLegionellaTemp_ifAlreadyLower(t *testing.T) {
 	can.simulateFrame(mustBuildFrame(t, us.IsAnswer, us.ActualWaterTempLowerId, float32(60.0)))
 
 	time.Sleep(step)
-	if err := sheet.checkHave("actual_water_temp", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkHave("actual_water_temp_lower", "60"); err != nil {
+	if err := sheet.CheckRowStart("actual_water_temp_lower_have", "60"); err != nil {
 		t.Fatal(err)
 	}
-	if err := sheet.checkRowStart("water_temp", fakeRow{"10", "10>", "60"}); err != nil {
+	if err := sheet.CheckRowStart("water_temp", fakeRow{"10", "10>", "60"}...); err != nil {
 		t.Fatal(err)
 	}
 	if err := can.checkNotXmit(us.IsSet, us.DesiredConstantWaterTempId, float32(50)); err != nil {
@@ -437,131 +558,697 @@ func TestAutoResetLegionellaTemp_ifAlreadyLower(t *testing.T) {
 	}
 }
 
-type (
-	fakeCell int
-	logCell  int
+func TestScheduledSettings(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	fakeRow []interface{}
-	fakeLog struct {
-		rng string
-		row fakeRow
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("water_temp", "10", "10", "10")
+	start := time.Date(2023, 3, 30, 8, 0, 0, 0, time.Local)
+	sheet.SetRow(scheduleRows, "2023-03-30 08:00", "water_temp", "45", "2023-03-30 10:00", "daily")
+	status := fmt.Sprintf("%v!F2:G2", scheduleTab)
+
+	sched := newScheduler(newAuditor(sheetClient, newLiveConfig(Config{})))
+	for _, tt := range []struct {
+		now    time.Time
+		want   string
+		status fakeRow
+	}{
+		{start.Add(-time.Minute), "10", fakeRow{}},
+		{start.Add(time.Minute), "45", fakeRow{"applied 2023-03-30 08:00:00", "10"}},
+		{start.Add(2 * time.Hour), "10", fakeRow{"ended 2023-03-30 08:00:00", "10"}},
+		{start.Add(3 * time.Hour), "10", fakeRow{"ended 2023-03-30 08:00:00", "10"}},
+		{start.Add(25 * time.Hour), "45", fakeRow{"applied 2023-03-31 08:00:00", "10"}},
+		// The end of the 2023-03-31 occurrence was missed.
+		{start.Add(49 * time.Hour), "45", fakeRow{"applied 2023-04-01 08:00:00", "10"}},
+		{start.Add(51 * time.Hour), "10", fakeRow{"ended 2023-04-01 08:00:00", "10"}},
+	} {
+		sched.apply(ctx, sheetClient, tt.now)
+		if err := sheet.CheckRowStart("water_temp", fakeRow{tt.want}...); err != nil {
+			t.Fatalf("at %v: %v", tt.now, err)
+		}
+		if err := sheet.CheckRowStart(status, tt.status...); err != nil {
+			t.Fatalf("at %v: %v", tt.now, err)
+		}
 	}
+}
+
+func TestRules(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	fakeSheet struct {
-		rows map[string]fakeRow
-		logs []fakeLog
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("heating_program", "standby", "standby", "standby")
+	sheet.SetRow("room_temp", "10", "10", "10")
+	rules, err := parseRules([]byte(`{"rules": [{
+		"name": "frost-guard",
+		"when": "actual_outside_temp < 2 and room_temp_want < 15",
+		"rearm": "actual_outside_temp > 5",
+		"states": {"heating_program": "standby"},
+		"set": "room_temp",
+		"to": "15",
+		"cooldown": "1h"
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
 	}
+	store := newStateStore()
+	cfg := Config{Rules: rules}
+	re := newRuleEngine(newAuditor(sheetClient, newLiveConfig(cfg)))
+	start := time.Date(2023, 1, 10, 22, 0, 0, 0, time.Local)
 
-	fakeCan struct {
-		lock sync.Mutex
-		recv []can.Frame
-		xmit []can.Frame
+	for _, tt := range []struct {
+		// at is the time since start, when the outside temp is outside.
+		at      time.Duration
+		outside string
+		// reset undoes the rule's room_temp in the sheet first, so that
+		// only the cooldown or the rearm keeps the rule from firing again.
+		reset string
+		// dryRun only logs what the rule would set.
+		dryRun bool
+		// want is the room_temp Want value afterwards.
+		want string
+	}{
+		{0, "3", "", true, "10"},
+		{time.Minute, "1", "", true, "10"},
+		{2 * time.Minute, "1", "", false, "15"},
+		// Cooling down.
+		{3 * time.Minute, "1", "10", false, "10"},
+		// Not rearmed.
+		{2 * time.Hour, "1", "", false, "10"},
+		{3 * time.Hour, "6", "", false, "10"},
+		{4 * time.Hour, "1", "", false, "15"},
+	} {
+		if tt.reset != "" {
+			sheet.SetRow("room_temp_want", tt.reset)
+		}
+		store.set(newCurrentValue("actual_outside_temp", tt.outside, fromCan))
+		cfg.RulesDryRun = tt.dryRun
+		re.apply(ctx, sheetClient, store, cfg, nil, start.Add(tt.at))
+		if err := sheet.CheckRowStart("room_temp", tt.want); err != nil {
+			t.Fatalf("at %v: %v", tt.at, err)
+		}
 	}
-)
 
-const (
-	cellUser fakeCell = 0
-	cellSent fakeCell = 1
-	cellHave fakeCell = 2
-	cellDate fakeCell = 3
+	// Held, e.g. by a legionella cycle.
+	sheet.SetRow("room_temp_want", "10")
+	store.set(newCurrentValue("actual_outside_temp", "6", fromCan))
+	re.apply(ctx, sheetClient, store, cfg, nil, start.Add(7*time.Hour))
+	store.set(newCurrentValue("actual_outside_temp", "1", fromCan))
+	re.apply(ctx, sheetClient, store, cfg, map[gs.Setting]bool{"room_temp": true}, start.Add(8*time.Hour))
+	if err := sheet.CheckRowStart("room_temp", "10"); err != nil {
+		t.Fatal(err)
+	}
 
-	actualWaterTempHigherIdx logCell = 9
-	actualWaterTempLowerIdx  logCell = 10
-)
+	sheet.SetRow("heating_program_want", "konstant")
+	re.apply(ctx, sheetClient, store, cfg, nil, start.Add(10*time.Hour))
+	if err := sheet.CheckRowStart("room_temp", "10"); err != nil {
+		t.Fatal(err)
+	}
 
-var (
-	dated_re = regexp.MustCompile("(.*)_dated")
-	user_re  = regexp.MustCompile("(.*)_want")
-	have_re  = regexp.MustCompile("(.*)_have")
-	sent_re  = regexp.MustCompile("(.*)_sent")
-)
+	for _, bad := range []string{
+		`{"rules": [{"name": "x", "when": "1 <", "set": "room_temp", "to": "15"}]}`,
+		`{"rules": [{"name": "x", "when": "1", "set": "actual_outside_temp", "to": "15"}]}`,
+		`{"rules": [{"name": "x", "when": "1", "set": "room_temp", "to": "15", "cooldown": "often"}]}`,
+		`{"rules": [{"name": "x", "when": "1", "set": "room_temp", "to": "warm"}]}`,
+		`{"rules": [{"name": "x", "when": "1", "set": "water_program", "to": "sometimes"}]}`,
+	} {
+		if _, err := parseRules([]byte(bad)); err == nil {
+			t.Fatalf("expected an error for %v", bad)
+		}
+	}
+}
 
-func initSheet(ctx context.Context) (gs.Client, *fakeSheet) {
-	sheetCfg := gs.Config{}
-	sheet := &fakeSheet{
-		rows: map[string]fakeRow{},
+func TestLegionellaCycle(t *testing.T) {
+	ctx := context.Background()
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("water_temp", "50", "50", "50")
+	store := newStateStore()
+	audit := newAuditor(sheetClient, newLiveConfig(Config{}))
+	file := filepath.Join(t.TempDir(), "legionella.json")
+	lm := newLegionellaManager(audit, file)
+	start := time.Date(2023, 1, 8, 1, 0, 0, 0, time.Local) // a Sunday
+	lc := LegionellaCycle{OnWeekday: true, Weekday: time.Sunday, Hour: 2, TargetCelsius: 65, HoldCelsius: 60,
+		Hold: 30 * time.Minute, Timeout: 6 * time.Hour}
+	const succeeded = "succeeded: held 60 °C for 30m0s"
+	const timedOut = "failed: did not hold 60 °C for 30m0s within 6h0m0s"
+	day := 24 * time.Hour
+
+	for _, tt := range []struct {
+		at time.Duration
+		// higher and lower are the tank sensors read at that time, if set.
+		higher string
+		lower  string
+		// edit is a Want value written by someone in the sheet before.
+		edit string
+		// restart restarts the agent before.
+		restart bool
+		want    string
+		result  string
+	}{
+		{0, "50", "50", "", false, "50", ""},
+		{time.Hour, "50", "50", "", false, "65", ""},
+		{90 * time.Minute, "61", "58", "", false, "65", ""},
+		{100 * time.Minute, "62", "60", "", false, "65", ""},
+		// Dropped before holding long enough.
+		{110 * time.Minute, "62", "59", "", false, "65", ""},
+		{120 * time.Minute, "63", "61", "", false, "65", ""},
+		// Not confirmed without readings since.
+		{150 * time.Minute, "", "", "", false, "65", ""},
+		{155 * time.Minute, "64", "62", "", false, "50", succeeded},
+		// Not again on the same day, also after a restart.
+		{5 * time.Hour, "50", "50", "", true, "50", succeeded},
+		// Next Sunday, but never hot enough.
+		{7*day + time.Hour, "50", "50", "", false, "65", succeeded},
+		{7*day + 7*time.Hour, "59", "59", "", false, "50", timedOut},
+		// Interrupted by a restart, which restores the previous value.
+		{14*day + time.Hour, "50", "50", "", false, "65", timedOut},
+		{14*day + 2*time.Hour, "61", "61", "", true, "50", "failed: interrupted by a restart"},
+		// Changed in the sheet during the cycle, so not restored.
+		{21*day + time.Hour, "50", "50", "", false, "65", "failed: interrupted by a restart"},
+		{21*day + 2*time.Hour, "50", "50", "55", false, "55", "failed: water temp changed to 55"},
+	} {
+		now := start.Add(tt.at)
+		if tt.edit != "" {
+			sheet.SetRow("water_temp_want", tt.edit)
+		}
+		if tt.restart {
+			lm = newLegionellaManager(audit, file)
+		}
+		for s, text := range map[gs.Setting]string{gs.ActualWaterTempHigher: tt.higher, gs.ActualWaterTempLower: tt.lower} {
+			if text != "" {
+				v := newCurrentValue(s, text, fromCan)
+				v.At = now
+				store.set(v)
+			}
+		}
+		lm.apply(ctx, sheetClient, store, lc, now)
+		if err := sheet.CheckRowStart("water_temp", tt.want); err != nil {
+			t.Fatalf("at %v: %v", tt.at, err)
+		}
+		if v, _ := store.get(legionellaResult); v.Text != tt.result {
+			t.Fatalf("at %v: expected result %q, but got %q", tt.at, tt.result, v.Text)
+		}
 	}
-	sheetClient := gs.NewClient(ctx, sheet, sheetCfg)
-	return sheetClient, sheet
 }
 
-func (s *fakeSheet) resolve(rng string) []interface{} {
-	if m := dated_re.FindStringSubmatch(rng); m != nil {
-		r := s.row(m[1])
-		return r[cellHave:]
+func TestParseSettings(t *testing.T) {
+	if len(PushedSettings) != 4 || len(ReportedSettings) != 22 {
+		t.Fatalf("expected 4 pushed and 22 reported built-in settings, but got %v and %v",
+			len(PushedSettings), len(ReportedSettings))
+	}
+	pushed, reported, err := parseSettings([]byte(`{"settings": [
+		{"name": "water_temp", "valueId": {"group": 2, "id": 5051}, "converter": "celsius", "max": 55, "pushed": true},
+		{"name": "water_program", "valueId": {"group": 2, "id": 5050}, "converter": "map",
+			"values": {"Standby": "off"}, "stable": true},
+		{"name": "actual_water_temp", "valueId": {"group": 2, "id": 4}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if m := user_re.FindStringSubmatch(rng); m != nil {
-		r := s.row(m[1])
-		return r[cellUser : cellUser+1]
+	if len(pushed) != 1 || len(reported) != 3 || !reported[1].isStable {
+		t.Fatalf("expected 1 pushed and 3 reported settings, but got %+v and %+v", pushed, reported)
 	}
-	if m := have_re.FindStringSubmatch(rng); m != nil {
-		r := s.row(m[1])
-		return r[cellHave : cellHave+1]
+	if _, err := pushed[0].MakeUpdateFrame(gs.SettingValues{Want: "60"}); err == nil {
+		t.Fatalf("expected 60 to be above max")
 	}
-	if m := sent_re.FindStringSubmatch(rng); m != nil {
-		r := s.row(m[1])
-		return r[cellSent : cellSent+1]
+	if v, _ := reported[1].ParseMessage(us.Message{Value: "Standby"}); v != "off" {
+		t.Fatalf("expected off, but got %v", v)
+	}
+
+	for _, bad := range []string{
+		`{"settings": [{"name": "x", "valueId": {"group": 99}}]}`,
+		`{"settings": [{"name": "x", "valueId": {"group": 1, "id": 2051}, "converter": "map", "pushed": true}]}`,
+		`{"settings": [{"name": "x", "valueId": {"group": 2, "id": 5050}, "converter": "map", "values": {"Off": "off"}}]}`,
+		`{"settings": [{"name": "x", "valueId": {"group": 2, "id": 5051}, "converter": "kelvin"}]}`,
+		`{"settings": [{"name": "x", "valueId": {"group": 2, "id": 5051}, "min": 10}]}`,
+		`{"settings": [{"name": "x", "valueId": {"group": 2, "id": 4}}, {"name": "x", "valueId": {"group": 2, "id": 6}}]}`,
+		`{"settings": [{"name": "x", "valueid": {"group": 2, "id": 4}, "typo": true}]}`,
+	} {
+		if _, _, err := parseSettings([]byte(bad)); err == nil {
+			t.Fatalf("expected an error for %v", bad)
+		}
 	}
-	return s.row(rng)
 }
 
-func (s *fakeSheet) row(name string) fakeRow {
-	row, ok := s.rows[name]
-	if !ok {
-		row = fakeRow{"", "", "", ""}
-		s.rows[name] = row
+func TestSettingSync(t *testing.T) {
+	cfg := Config{SyncTimeout: time.Minute, SyncRetries: 2, ReconcileDelay: 10 * time.Minute}
+	start := time.Date(2023, 3, 30, 8, 0, 0, 0, time.Local)
+	noBus := errors.New("no bus")
+	type step struct {
+		want, sent, have string
+		at               time.Duration
+		// readBack is the pump's answer at the time, if any.
+		readBack string
+		sendErr  error
+		action   syncAction
+		state    syncState
+		shown    string
+	}
+	for _, tt := range []struct {
+		name   string
+		policy ReconcilePolicy
+		steps  []step
+	}{
+		{"confirmed", "", []step{
+			{"10", "10", "10", 0, "", nil, syncWait, syncIdle, "10"},
+			{"45", "10", "10", 0, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", 30 * time.Second, "", nil, syncWait, syncAwaiting, "45>"},
+			{"45", "45>", "45", 40 * time.Second, "", nil, syncWait, syncConfirmed, "45"},
+			{"45", "45", "45", time.Minute, "", nil, syncWait, syncIdle, "45"},
+		}},
+		{"retried until failed", "", []step{
+			{"45", "10", "10", 0, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", time.Minute, "", noBus, syncSend, syncSending, "45>"},
+			{"45", "45>", "10", 2 * time.Minute, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", 3 * time.Minute, "", nil, syncWait, syncFailed, "failed 45: no answer after 3 tries"},
+			{"45", "failed", "10", 4 * time.Minute, "", nil, syncWait, syncFailed, "failed 45: no answer after 3 tries"},
+			{"50", "failed", "10", 5 * time.Minute, "", nil, syncSend, syncAwaiting, "50>"},
+		}},
+		{"failed to send", "", []step{
+			{"45", "10", "10", 0, "", noBus, syncSend, syncSending, "45>"},
+			{"45", "45>", "10", 0, "", noBus, syncSend, syncSending, "45>"},
+			{"45", "45>", "10", 0, "", noBus, syncSend, syncFailed, "failed 45: no bus"},
+		}},
+		{"overridden externally", "", []step{
+			{"45", "45", "45", 0, "", nil, syncWait, syncIdle, "45"},
+			{"45", "45", "50", 0, "", nil, syncPickUp, syncOverridden, "50"},
+			{"50", "50", "50", 0, "", nil, syncWait, syncIdle, "50"},
+		}},
+		{"read back", "", []step{
+			{"45", "10", "10", 0, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", time.Second, "10", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", 2 * time.Second, "45", nil, syncWait, syncAwaiting, "45>"},
+			{"45", "45>", "45", 3 * time.Second, "45", nil, syncWait, syncConfirmed, "45"},
+		}},
+		{"read back until failed", "", []step{
+			{"45", "10", "10", 0, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", time.Second, "10", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", 2 * time.Second, "10", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "10", 3 * time.Second, "10", nil, syncWait, syncFailed, "failed 45: read back 10 after 3 tries"},
+		}},
+		{"sheet wins", SheetWins, []step{
+			{"45", "45", "45", 0, "", nil, syncWait, syncIdle, "45"},
+			{"45", "45", "50", 0, "", nil, syncSend, syncAwaiting, "45>"},
+			{"45", "45>", "45", time.Second, "45", nil, syncWait, syncConfirmed, "45"},
+		}},
+		{"sheet wins after delay", SheetWinsAfterDelay, []step{
+			{"45", "45", "50", 0, "", nil, syncNotify, syncDeviating, "45"},
+			{"45", "45", "50", 5 * time.Minute, "", nil, syncWait, syncDeviating, "45"},
+			{"45", "45", "50", 10 * time.Minute, "", nil, syncSend, syncAwaiting, "45>"},
+		}},
+		{"notify only", NotifyOnly, []step{
+			{"45", "45", "50", 0, "", nil, syncNotify, syncDeviating, "45"},
+			{"45", "45", "50", time.Hour, "", nil, syncWait, syncDeviating, "45"},
+			{"45", "45", "45", 2 * time.Hour, "", nil, syncWait, syncIdle, "45"},
+			{"45", "45", "50", 3 * time.Hour, "", nil, syncNotify, syncDeviating, "45"},
+			{"50", "45", "50", 4 * time.Hour, "", nil, syncWait, syncIdle, "50"},
+		}},
+		{"sent before restart", "", []step{
+			{"45", "45>", "10", 0, "", nil, syncWait, syncAwaiting, "45>"},
+			{"45", "45>", "10", time.Minute, "", nil, syncSend, syncAwaiting, "45>"},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.ReconcilePolicies = map[gs.Setting]ReconcilePolicy{gs.DesiredWaterTemp: tt.policy}
+			ss := &settingSync{}
+			for i, step := range tt.steps {
+				vs := gs.SettingValues{Setting: gs.DesiredWaterTemp, Want: step.want, Sent: step.sent, Have: step.have}
+				now := start.Add(step.at)
+				var answer currentValue
+				if step.readBack != "" {
+					answer = currentValue{Setting: vs.Setting, Text: step.readBack, At: now}
+				}
+				action := ss.next(vs, answer, now, cfg)
+				if action == syncSend {
+					ss.sent(step.sendErr, now, cfg)
+				}
+				if action != step.action || ss.state != step.state {
+					t.Fatalf("step %v: expected %v and %v, but got %v and %v", i, step.action, step.state, action, ss.state)
+				}
+				if shown := ss.sentValue(vs.Have); shown != step.shown {
+					t.Fatalf("step %v: expected Sent %q, but got %q", i, step.shown, shown)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckReconcilePolicies(t *testing.T) {
+	cfg := Config{ReconcilePolicies: map[gs.Setting]ReconcilePolicy{gs.DesiredWaterTemp: SheetWins}}
+	if err := CheckReconcilePolicies(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ReconcilePolicies["water_tmp"] = SheetWins
+	if err := CheckReconcilePolicies(cfg); err == nil {
+		t.Fatalf("expected an error for water_tmp")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	if err := sheet.AddTabs(ctx, "", []string{auditTab}); err != nil {
+		t.Fatal(err)
+	}
+	audit := newAuditor(sheetClient, newLiveConfig(Config{AuditToSheet: true}))
+
+	if err := audit.writeWant(ctx, gs.DesiredWaterTemp, "10", "45", bySchedule); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart("water_temp", "45"); err != nil {
+		t.Fatal(err)
+	}
+	vs := gs.SettingValues{Setting: gs.DesiredWaterTemp, Want: "45", Have: "10"}
+	audit.sent(ctx, vs, nil)
+	if err := sheet.CheckRowStart(auditTab+"!B3:F3", "water_temp", "10", "45", "schedule", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	// A value the agent did not write was changed in the sheet.
+	vs.Want = "50"
+	audit.sent(ctx, vs, errors.New("no bus"))
+	if err := sheet.CheckRowStart(auditTab+"!B4:F4", "water_temp", "10", "50", "sheet",
+		"failed to send: no bus"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart(auditTab+"!B2:F2", "water_temp", "10", "45", "schedule", "written"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart(auditTab+"!A1:F1", auditHeader...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSheetConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	flags := Config{SheetPollingInterval: time.Minute}
+	live := newLiveConfig(flags)
+	sc := newSheetConfig(flags, nil)
+	status := fmt.Sprintf("%v!C2", configTab)
+
+	for _, tt := range []struct {
+		row      fakeRow
+		interval time.Duration
+		status   string
+	}{
+		{fakeRow{"sheet-polling-interval", "5m", ""}, 5 * time.Minute, "applied"},
+		// Invalid values keep the last valid one.
+		{fakeRow{"sheet-polling-interval", "often", ""}, 5 * time.Minute,
+			"error: not a duration like 90s or 2m: \"often\""},
+		{fakeRow{"sheet-polling-interval", "0s", ""}, 5 * time.Minute, "error: must be positive: \"0s\""},
+		{fakeRow{"sheet-id", "x", ""}, time.Minute, "error: unknown or not changeable while running"},
+		// Another option in the same row gets its own status.
+		{fakeRow{"log-to-sheet", "true", ""}, time.Minute, "error: unknown or not changeable while running"},
+	} {
+		sheet.SetRow(configRows, tt.row...)
+		sc.apply(ctx, sheetClient, live)
+		if have := live.get().SheetPollingInterval; have != tt.interval {
+			t.Fatalf("for %v: expected %v, but got %v", tt.row, tt.interval, have)
+		}
+		if err := sheet.CheckRowStart(status, fakeRow{tt.status}...); err != nil {
+			t.Fatalf("for %v: %v", tt.row, err)
+		}
 	}
-	return row
 }
 
-func (s *fakeSheet) Read(ctx context.Context, sheetId, rng string) [][]interface{} {
-	return [][]interface{}{s.resolve(rng)}
+func TestSheetConfigSensors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	flags := Config{TemperatureSensors: map[string]string{"28-1": "temp1m"}}
+	live := newLiveConfig(flags)
+	sensorDir := newSensorDirectory(flags)
+	sc := newSheetConfig(flags, sensorDir)
+
+	for _, tt := range []struct {
+		// sensor is the temperature-sensor row.
+		sensor string
+		// name and calibrated are the name of sensor 28-2 and its
+		// reading of 20°C.
+		name       string
+		calibrated float32
+		// derived are the names of the live derived sensors.
+		derived string
+	}{
+		{"28-2:temp5m:0.5", "temp5m", 20.5, "[temp_diff]"},
+		// Invalid calibrations keep the last valid one.
+		{"28-2:temp5m:abc", "temp5m", 20.5, "[temp_diff]"},
+		// Removed rows restore the flags.
+		{"", "28-2", 20, "[]"},
+	} {
+		rows := [][]interface{}{{"", ""}, {"", ""}}
+		if tt.sensor != "" {
+			rows = [][]interface{}{{"temperature-sensor", tt.sensor}, {"derived-sensor", "temp_diff=temp5m-temp1m"}}
+		}
+		sheet.Set(configTab+"!A2:B3", rows)
+		sc.apply(ctx, sheetClient, live)
+		if have := sensorDir.Name("28-2"); have != tt.name {
+			t.Fatalf("for %q: expected name %v, but got %v", tt.sensor, tt.name, have)
+		}
+		r := sensorDir.Calibrate(temp.TemperatureReading{Id: "28-2", Temperature: 20})
+		if r.Temperature != tt.calibrated {
+			t.Fatalf("for %q: expected %v, but got %v", tt.sensor, tt.calibrated, r.Temperature)
+		}
+		derived := []string{}
+		for _, d := range live.get().DerivedSensors {
+			derived = append(derived, d.Name)
+		}
+		if have := fmt.Sprintf("%v", derived); have != tt.derived {
+			t.Fatalf("for %q: expected derived sensors %v, but got %v", tt.sensor, tt.derived, have)
+		}
+	}
+	if have := sensorDir.Name("28-1"); have != "temp1m" {
+		t.Fatalf("expected flag sensor temp1m, but got %v", have)
+	}
+}
+
+func TestSheetConfigChecksSyncTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	flags := Config{SettingsQueryInterval: time.Hour, SyncTimeout: 2 * time.Hour, DeriveSyncTimeout: true}
+	live := newLiveConfig(flags)
+	sc := newSheetConfig(flags, nil)
+	tooShort := "error: sync-timeout 2h0m0s is shorter than settings-query-interval 3h0m0s"
+
+	for _, tt := range []struct {
+		// timeout is the sync-timeout row, if any.
+		timeout string
+		// wantTimeout is the live sync timeout.
+		wantTimeout time.Duration
+		// statuses are the statuses of the interval and timeout rows.
+		statuses fakeRow
+	}{
+		// The default timeout follows the interval.
+		{"", 6 * time.Hour, fakeRow{"applied", ""}},
+		{"0s", 0, fakeRow{"applied", "applied"}},
+		// A timeout shorter than the interval keeps the last valid values.
+		{"2h", 0, fakeRow{tooShort, tooShort}},
+		{"4h", 4 * time.Hour, fakeRow{"applied", "applied"}},
+	} {
+		timeoutRow := fakeRow{"", ""}
+		if tt.timeout != "" {
+			timeoutRow = fakeRow{"sync-timeout", tt.timeout}
+		}
+		sheet.Set(configTab+"!A2:B3", [][]interface{}{{"settings-query-interval", "3h"}, timeoutRow})
+		sc.apply(ctx, sheetClient, live)
+		cfg := live.get()
+		if cfg.SyncTimeout != tt.wantTimeout || cfg.SettingsQueryInterval != 3*time.Hour {
+			t.Fatalf("for %q: expected timeout %v with interval 3h, but got %v with %v", tt.timeout,
+				tt.wantTimeout, cfg.SyncTimeout, cfg.SettingsQueryInterval)
+		}
+		for i, want := range tt.statuses {
+			if err := sheet.CheckRowStart(fmt.Sprintf("%v!C%v", configTab, i+2), want); err != nil {
+				t.Fatalf("for %q: %v", tt.timeout, err)
+			}
+		}
+	}
 }
 
-func (s *fakeSheet) Write(ctx context.Context, sheetId, rng string, vals [][]interface{}) {
-	r := s.resolve(rng)
-	copy(r, vals[0])
-	log.Printf("    %v\n", s.rows)
+func TestWebUI(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("water_temp", "10", "10", "10")
+	store := newStateStore()
+	store.set(newCurrentValue("temp1m", "21.5", fromSensor))
+	cfg := Config{}
+	live := newLiveConfig(cfg)
+	ui := newWebUI(sheetClient, store, newAuditor(sheetClient, live), newSensorDirectory(cfg), live)
+
+	rec := httptest.NewRecorder()
+	ui.servePage(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "water_temp") ||
+		!strings.Contains(rec.Body.String(), "21.5") {
+		t.Fatalf("expected page with water_temp and temp1m, but got %v: %v", rec.Code, rec.Body)
+	}
+
+	for _, tt := range []struct {
+		value string
+		code  int
+		want  string
+	}{
+		{"45", http.StatusSeeOther, "45"},
+		{"99", http.StatusBadRequest, "45"},
+	} {
+		form := url.Values{"setting": {"water_temp"}, "value": {tt.value}}
+		req := httptest.NewRequest(http.MethodPost, "/want", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		ui.serveWant(rec, req)
+		if rec.Code != tt.code {
+			t.Fatalf("expected %v for %v, but got %v", tt.code, tt.value, rec.Code)
+		}
+		if err := sheet.CheckRowStart("water_temp", fakeRow{tt.want, "10", "10"}...); err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
-func (s *fakeSheet) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) {
-	s.logs = append(s.logs, fakeLog{rng: rng, row: vals[0]})
+func TestWebUIRejectsOtherSites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sheetClient, sheet := initSheet(ctx)
+	sheet.SetRow("water_temp", "10", "10", "10")
+	live := newLiveConfig(Config{})
+	ui := newWebUI(sheetClient, newStateStore(), newAuditor(sheetClient, live), newSensorDirectory(Config{}), live)
+
+	for _, tt := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Origin", "http://evil.example", http.StatusForbidden},
+		{"Origin", "http://example.com", http.StatusSeeOther},
+		{"Sec-Fetch-Site", "same-origin", http.StatusSeeOther},
+	} {
+		form := url.Values{"setting": {"water_temp"}, "value": {"45"}}
+		req := httptest.NewRequest(http.MethodPost, "/want", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(tt.header, tt.value)
+		rec := httptest.NewRecorder()
+		ui.serveWant(rec, req)
+		if rec.Code != tt.code {
+			t.Fatalf("expected %v for %v %v, but got %v", tt.code, tt.header, tt.value, rec.Code)
+		}
+	}
+
+	for _, tt := range []struct{ addr, want string }{
+		{":8080", "localhost:8080"},
+		{"0.0.0.0:8080", "0.0.0.0:8080"},
+		{"192.168.1.2:8080", "192.168.1.2:8080"},
+	} {
+		if have := webUIListenAddr(tt.addr); have != tt.want {
+			t.Fatalf("expected %v for %v, but got %v", tt.want, tt.addr, have)
+		}
+	}
 }
 
-func (s *fakeSheet) simulateUser(n string, v string) {
-	s.rows[n][cellUser] = v
+func TestStateStore(t *testing.T) {
+	store := newStateStore()
+	sub := store.subscribe()
+	store.set(newCurrentValue("temp1m", "21", fromSensor))
+	store.set(newCurrentValue("water_program", "constant", fromCan))
+	store.set(newCurrentValue("temp1m", "21.5", fromSensor))
+
+	if v, ok := store.get("temp1m"); !ok || !v.IsNumber || v.Number != 21.5 || v.Source != fromSensor {
+		t.Fatalf("expected numeric temp1m from sensor, but got %+v", v)
+	}
+	if v, ok := store.get("water_program"); !ok || v.IsNumber || v.Text != "constant" {
+		t.Fatalf("expected textual water_program, but got %+v", v)
+	}
+	if _, ok := store.get("temp5m"); ok {
+		t.Fatalf("expected no temp5m")
+	}
+	if all := store.all(); len(all) != 2 {
+		t.Fatalf("expected 2 values, but got %v", all)
+	}
+	// The subscriber fell behind, so it gets the latest value per setting.
+	<-sub.ready
+	if vs := sub.take(); len(vs) != 2 || vs[0].Text != "21.5" || vs[1].Text != "constant" {
+		t.Fatalf("expected latest temp1m and water_program, but got %+v", vs)
+	}
+	if vs := sub.take(); len(vs) != 0 {
+		t.Fatalf("expected no more values, but got %+v", vs)
+	}
 }
 
-func (s *fakeSheet) checkHave(n string, want string) error {
-	r := s.rows[n]
-	if len(r) <= int(cellHave) {
-		return fmt.Errorf("%v[%v] should be %v, is %v", n, cellHave, want, r)
+func TestSheetRequirements(t *testing.T) {
+	req := SheetRequirements(Config{
+		UpdateCurrentSettings:     true,
+		ApplyDesiredSettings:      true,
+		LogCurrentSettingsToSheet: true,
+		TemperatureSensors:        map[string]string{"28-1": "temp1m"},
+	})
+	rngs := map[string]bool{}
+	for _, rng := range req.Ranges() {
+		rngs[rng] = true
+	}
+	for _, want := range []string{"water_temp", "water_temp_want", "water_temp_sent", "water_temp_have",
+		"actual_water_temp_dated", "temp1m_dated"} {
+		if !rngs[want] {
+			t.Fatalf("expected %v in %v", want, req.Ranges())
+		}
 	}
-	if have := r[cellHave]; have != want {
-		return fmt.Errorf("%v[%v] should be %v, is %v", n, cellHave, want, have)
+	if tabs := req.Tabs(); len(tabs) != 0 {
+		t.Fatalf("expected no tabs, but got %v", tabs)
 	}
-	return nil
 }
 
-func (s *fakeSheet) checkRowStart(n string, wantRow fakeRow) error {
-	r := s.rows[n]
-	if len(r) < len(wantRow) {
-		return fmt.Errorf("%v should start with %v, is %v", n, wantRow, r)
+func TestProvisionAddsTabHeaders(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	cfg := Config{ApplySheetConfig: true, ApplyDesiredSettings: true, ApplyScheduledSettings: true, AuditToSheet: true}
+	if _, err := gs.Provision(ctx, sheet, gs.Config{}, SheetRequirements(cfg), true); err != nil {
+		t.Fatal(err)
 	}
-	for i, want := range wantRow {
-		if have := r[i]; have != want {
-			return fmt.Errorf("%v should start with %v, is %v", n, wantRow, r)
+	for _, tt := range []struct {
+		tab    string
+		header fakeRow
+	}{
+		{configTab, configHeader},
+		{scheduleTab, scheduleHeader},
+		{auditTab, auditHeader},
+		{gs.SettingsTab, fakeRow{"Setting", "Want", "Sent", "Have"}},
+	} {
+		if err := sheet.CheckRowStart(tt.tab+"!A1:G1", tt.header...); err != nil {
+			t.Fatal(err)
 		}
 	}
-	return nil
 }
 
-func (s *fakeSheet) checkLastLog(i logCell, want string) error {
-	log := s.logs[len(s.logs)-1]
-	if have := log.row[i]; have != want {
-		return fmt.Errorf("expected %v at %v, but got %v in %v", want, i, have, log.row)
+type (
+	logCell int
+
+	fakeRow []interface{}
+
+	fakeCan struct {
+		lock    sync.Mutex
+		recv    []can.Frame
+		xmit    []can.Frame
+		filters []us.Filter
 	}
-	return nil
+)
+
+const (
+	actualWaterTempHigherIdx logCell = 9
+	actualWaterTempLowerIdx  logCell = 10
+)
+
+func initSheet(ctx context.Context) (gs.Client, *gst.Sheet) {
+	sheetCfg := gs.Config{}
+	sheet := gst.New()
+	sheetClient := gs.NewClient(ctx, sheet, sheetCfg)
+	return sheetClient, sheet
 }
 
 func initCan() (*us.Parser, *fakeCan) {
@@ -598,6 +1285,14 @@ func (c *fakeCan) Frame() can.Frame {
 	return f
 }
 
+func (c *fakeCan) SetReceiveFilters(fs []us.Filter) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	log.Printf("        Filtering %v\n", fs)
+	c.filters = fs
+	return nil
+}
+
 func (c *fakeCan) simulateFrame(f can.Frame) {
 	log.Printf("        Simulating %v\n", f)
 	c.lock.Lock()
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// The audit tab has a header row, then one row per change of a desired
+// setting, with the columns of auditHeader. The agent writes the header
+// with the first row if the tab is empty.
+const auditTab = "Audit"
+
+var auditHeader = []interface{}{"Timestamp", "Setting", "Old", "New", "Source", "Result"}
+
+// auditSource tells who changed a desired setting.
+type auditSource string
+
+const (
+	// bySheet is a user editing the Want value in the sheet.
+	bySheet auditSource = "sheet"
+	// byDisplay is a user changing the setting on the pump's display.
+	byDisplay  auditSource = "display"
+	byRule     auditSource = "rule"
+	bySchedule auditSource = "schedule"
+	byWebUI    auditSource = "web"
+	// byLegionella is a legionella cycle raising and restoring the water
+	// temp.
+	byLegionella auditSource = "legionella"
+)
+
+type (
+	// auditEvent is a change of a desired setting. New Want values have
+	// the result of writing them, and sent values the result of sending
+	// them to the pump.
+	auditEvent struct {
+		At      time.Time
+		Setting gs.Setting
+		Old     string
+		New     string
+		Source  auditSource
+		Result  string
+	}
+
+	// auditor records the changes of desired settings to the audit tab
+	// and to files. It remembers who wrote each Want value, so sending
+	// the value to the pump is attributed to them.
+	auditor struct {
+		sheet gs.Client
+		live  *liveConfig
+
+		lock   sync.Mutex
+		wantBy map[gs.Setting]wantChange
+
+		// sheetLock keeps rows from being appended before the header.
+		sheetLock sync.Mutex
+		hasHeader bool
+	}
+
+	wantChange struct {
+		value  string
+		source auditSource
+	}
+)
+
+func newAuditor(sheet gs.Client, live *liveConfig) *auditor {
+	return &auditor{sheet: sheet, live: live, wantBy: map[gs.Setting]wantChange{}}
+}
+
+// writeWant writes a new Want value of a setting and records the change.
+func (a *auditor) writeWant(ctx context.Context, s gs.Setting, old, new string, src auditSource) error {
+	err := a.sheet.WriteFacetValue(ctx, gs.FacetValue{Setting: s, Facet: gs.Want, Value: new})
+	result := "written"
+	if err != nil {
+		log.Printf("Failed to write %v of %v: %v\n", new, s, err)
+		result = fmt.Sprintf("failed to write: %v", err)
+	} else {
+		a.lock.Lock()
+		a.wantBy[s] = wantChange{value: new, source: src}
+		a.lock.Unlock()
+	}
+	a.record(ctx, auditEvent{At: time.Now(), Setting: s, Old: old, New: new, Source: src, Result: result})
+	return err
+}
+
+// sent records sending a Want value to the pump. err is nil if it was
+// sent.
+func (a *auditor) sent(ctx context.Context, vs gs.SettingValues, err error) {
+	result := "sent"
+	if err != nil {
+		result = fmt.Sprintf("failed to send: %v", err)
+	}
+	a.record(ctx, auditEvent{At: time.Now(), Setting: vs.Setting, Old: vs.Have, New: vs.Want,
+		Source: a.sourceOf(vs.Setting, vs.Want), Result: result})
+}
+
+// deviated records a change on the pump's display that is not taken over
+// as the Want value.
+func (a *auditor) deviated(ctx context.Context, vs gs.SettingValues, policy ReconcilePolicy) {
+	result := "kept, not reverted"
+	if policy == SheetWinsAfterDelay {
+		result = fmt.Sprintf("reverting after %v", a.live.get().ReconcileDelay)
+	}
+	a.record(ctx, auditEvent{At: time.Now(), Setting: vs.Setting, Old: vs.Want, New: vs.Have, Source: byDisplay,
+		Result: result})
+}
+
+// cycled records how a legionella cycle ended.
+func (a *auditor) cycled(ctx context.Context, result string) {
+	a.record(ctx, auditEvent{At: time.Now(), Setting: legionellaResult, Source: byLegionella, Result: result})
+}
+
+// sourceOf returns who wrote a Want value. Values the agent did not write
+// come from the sheet.
+func (a *auditor) sourceOf(s gs.Setting, want string) auditSource {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if c, ok := a.wantBy[s]; ok && c.value == want {
+		return c.source
+	}
+	return bySheet
+}
+
+func (a *auditor) record(ctx context.Context, e auditEvent) {
+	cfg := a.live.get()
+	row := []interface{}{gs.FormatTimestamp(e.At), string(e.Setting), e.Old, e.New, string(e.Source), e.Result}
+	if cfg.AuditToSheet {
+		a.appendToSheet(ctx, row)
+	}
+	if cfg.AuditToFiles {
+		if err := cfg.LogStore.Write(e.At, auditHeader, row); err != nil {
+			log.Printf("Failed to write audit row: %v\n", err)
+		}
+	}
+}
+
+// appendToSheet appends a row to the audit tab, after the header if the
+// tab is empty.
+func (a *auditor) appendToSheet(ctx context.Context, row []interface{}) {
+	a.sheetLock.Lock()
+	defer a.sheetLock.Unlock()
+	rows := [][]interface{}{row}
+	hasHeader := a.hasHeader
+	if !hasHeader {
+		vals, err := a.sheet.Read(ctx, auditTab+"!A1:F1")
+		if err != nil {
+			log.Printf("Failed to read audit header: %v\n", err)
+		} else {
+			hasHeader = true
+			if len(vals) == 0 {
+				rows = [][]interface{}{auditHeader, row}
+			}
+		}
+	}
+	if err := a.sheet.AppendOverwritingRows(ctx, auditTab+"!A1", rows); err != nil {
+		log.Printf("Failed to append audit row: %v\n", err)
+		return
+	}
+	a.hasHeader = hasHeader
+}
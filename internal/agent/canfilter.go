@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	us "parren.ch/ultrasource/pkg/ultrasource"
+)
+
+// receiveFilters keeps the kernel's CAN receive filters in line with the
+// devices that answer the settings we report. Everything else is dropped
+// before it wakes up the receive loop.
+type receiveFilters struct {
+	lock    sync.Mutex
+	can     us.Client
+	devices map[us.Device]bool
+}
+
+func newReceiveFilters(can us.Client) *receiveFilters {
+	return &receiveFilters{can: can, devices: map[us.Device]bool{}}
+}
+
+// require extends the filters by the devices answering the given settings.
+// Filters are only reinstalled if a device was added.
+func (rf *receiveFilters) require(settings []Setting) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	changed := false
+	for _, s := range settings {
+		if d := s.AnsweredBy(); !rf.devices[d] {
+			rf.devices[d] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	ds := make([]us.Device, 0, len(rf.devices))
+	for d := range rf.devices {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].Type != ds[j].Type {
+			return ds[i].Type < ds[j].Type
+		}
+		return ds[i].Id < ds[j].Id
+	})
+	if err := rf.can.SetReceiveFilters(us.DeviceFilters(ds)); err != nil {
+		log.Printf("Failed to set CAN receive filters, receiving all frames: %v\n", err)
+		// Try again with the next requirement.
+		rf.devices = map[us.Device]bool{}
+	}
+}
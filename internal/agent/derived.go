@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"parren.ch/ultrasource/pkg/expr"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// DerivedSensor is computed from other sensors and settings, and reported
+// like a sensor, e.g. temp_diff = temp5m - temp1m.
+type DerivedSensor struct {
+	Name string
+	Expr *expr.Expr
+}
+
+// ParseDerivedSensor parses e.g. temp_diff=temp5m-temp1m.
+func ParseDerivedSensor(v string) (DerivedSensor, error) {
+	n, src, ok := strings.Cut(v, "=")
+	if !ok {
+		return DerivedSensor{}, fmt.Errorf("expected name=expression, got %v", v)
+	}
+	e, err := expr.Parse(src)
+	if err != nil {
+		return DerivedSensor{}, err
+	}
+	return DerivedSensor{Name: strings.TrimSpace(n), Expr: e}, nil
+}
+
+func updateDerivedSensorsForever(ctx context.Context, store *stateStore, live *liveConfig) {
+	interval := func(cfg Config) time.Duration { return cfg.DerivedSensorsInterval }
+	runThenTickLive(ctx, live, interval, func(cfg Config) {
+		if len(cfg.DerivedSensors) == 0 {
+			return
+		}
+		log.Println("Updating derived sensors")
+		updateDerivedSensors(store, cfg, time.Now())
+	})
+}
+
+// updateDerivedSensors skips sensors with inputs older than
+// Config.DerivedSensorsMaxAge, and with results that are not finite, e.g.
+// the dew point at 0% humidity.
+func updateDerivedSensors(store *stateStore, cfg Config, now time.Time) {
+	for _, d := range cfg.DerivedSensors {
+		v, err := d.Expr.Eval(recentValuesEnv(store, cfg.DerivedSensorsMaxAge, now))
+		if err != nil {
+			log.Printf("Failed to derive %v from %v: %v\n", d.Name, d.Expr, err)
+			continue
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Printf("Failed to derive %v from %v: not a number: %v\n", d.Name, d.Expr, v)
+			continue
+		}
+		store.set(newCurrentValue(gs.Setting(d.Name), formatDerived(v), fromDerived))
+	}
+}
+
+func latestValuesEnv(store *stateStore) expr.Env {
+	return recentValuesEnv(store, 0, time.Time{})
+}
+
+// recentValuesEnv treats values older than maxAge as missing. Zero maxAge
+// takes all values.
+func recentValuesEnv(store *stateStore, maxAge time.Duration, now time.Time) expr.Env {
+	return func(n string) (float64, bool) {
+		v, ok := store.get(gs.Setting(n))
+		if maxAge > 0 && v.At.Add(maxAge).Before(now) {
+			return 0, false
+		}
+		return v.Number, ok && v.IsNumber
+	}
+}
+
+func formatDerived(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// LegionellaCycle configures raising the water temperature regularly, so
+// that legionella in the tank die. A cycle sets the desired water temp to
+// TargetCelsius until both tank sensors held HoldCelsius for Hold, then
+// restores the previous value. It fails after Timeout.
+type LegionellaCycle struct {
+	// Interval between cycles, counted from the last one. Zero disables
+	// cycles by interval.
+	Interval time.Duration
+	// With OnWeekday, a cycle starts every Weekday at Hour.
+	OnWeekday bool
+	Weekday   time.Weekday
+	Hour      int
+
+	TargetCelsius float64
+	HoldCelsius   float64
+	Hold          time.Duration
+	Timeout       time.Duration
+	// StateFile keeps the state of the cycles, so that a restart neither
+	// delays the next cycle nor leaves the water temp raised. Empty keeps
+	// it in memory only.
+	StateFile string
+}
+
+// ParseWeekday parses e.g. sunday.
+func ParseWeekday(v string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(v, d.String()) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("not a weekday like sunday: %q", v)
+}
+
+func (lc LegionellaCycle) enabled() bool {
+	return lc.Interval > 0 || lc.OnWeekday
+}
+
+// legionellaResult is the current value telling how the last cycle ended.
+const legionellaResult gs.Setting = "legionella_cycle"
+
+type legionellaState int
+
+const (
+	legionellaIdle legionellaState = iota
+	// legionellaHeating waits for both sensors to hold the temperature.
+	legionellaHeating
+	// legionellaRestoring restores the previous value, again if that
+	// failed.
+	legionellaRestoring
+)
+
+type (
+	// legionellaManager runs the cycles. It holds the desired water temp
+	// while heating, so that rules do not reduce it.
+	legionellaManager struct {
+		audit *auditor
+		file  string
+		legionellaSaved
+		// holdingSince is when both sensors reached the temperature, or
+		// zero. It is not saved, as a restart ends the cycle.
+		holdingSince time.Time
+	}
+
+	// legionellaSaved is the state kept in LegionellaCycle.StateFile.
+	legionellaSaved struct {
+		State     legionellaState
+		LastStart time.Time
+		Started   time.Time
+		Previous  string
+		Target    string
+		Result    string
+	}
+)
+
+// newLegionellaManager loads the state of the cycles. A cycle that was
+// heating when the agent stopped fails, and restores the previous value.
+func newLegionellaManager(audit *auditor, file string) *legionellaManager {
+	lm := &legionellaManager{audit: audit, file: file}
+	if err := lm.load(); err != nil {
+		log.Printf("Failed to load legionella cycle state, starting afresh: %v\n", err)
+		lm.legionellaSaved = legionellaSaved{}
+	}
+	if lm.State == legionellaHeating {
+		lm.State, lm.Result = legionellaRestoring, "failed: interrupted by a restart"
+		lm.save()
+	}
+	return lm
+}
+
+// holds returns the settings the cycle sets, while it runs.
+func (lm *legionellaManager) holds() map[gs.Setting]bool {
+	if lm.State == legionellaIdle {
+		return nil
+	}
+	return map[gs.Setting]bool{gs.DesiredWaterTemp: true}
+}
+
+func (lm *legionellaManager) apply(ctx context.Context, sheet gs.Client, store *stateStore, lc LegionellaCycle,
+	now time.Time,
+) {
+	if lm.LastStart.IsZero() {
+		// The first interval counts from the first start of the agent.
+		lm.LastStart = now
+		lm.save()
+	}
+	switch lm.State {
+	case legionellaIdle:
+		if lm.isDue(lc, now) {
+			lm.start(ctx, sheet, lc, now)
+		}
+	case legionellaHeating:
+		lm.check(ctx, sheet, store, lc, now)
+	case legionellaRestoring:
+		lm.restore(ctx, sheet, store)
+	}
+}
+
+func (lm *legionellaManager) isDue(lc LegionellaCycle, now time.Time) bool {
+	if lc.Interval > 0 && !now.Before(lm.LastStart.Add(lc.Interval)) {
+		return true
+	}
+	if !lc.OnWeekday || now.Weekday() != lc.Weekday {
+		return false
+	}
+	slot := time.Date(now.Year(), now.Month(), now.Day(), lc.Hour, 0, 0, 0, now.Location())
+	return !now.Before(slot) && lm.LastStart.Before(slot)
+}
+
+func (lm *legionellaManager) start(ctx context.Context, sheet gs.Client, lc LegionellaCycle, now time.Time) {
+	previous, err := sheet.ReadFacetValue(ctx, gs.DesiredWaterTemp, gs.Want)
+	if err != nil {
+		log.Printf("Failed to read desired water temp for legionella cycle: %v\n", err)
+		return
+	}
+	target := strconv.FormatFloat(lc.TargetCelsius, 'f', -1, 64)
+	log.Printf("Starting legionella cycle, raising water temp from %v to %v\n", previous, target)
+	if lm.audit.writeWant(ctx, gs.DesiredWaterTemp, previous, target, byLegionella) != nil {
+		return
+	}
+	lm.legionellaSaved = legionellaSaved{State: legionellaHeating, LastStart: now, Started: now, Previous: previous,
+		Target: target, Result: lm.Result}
+	lm.holdingSince = time.Time{}
+	lm.save()
+}
+
+func (lm *legionellaManager) check(ctx context.Context, sheet gs.Client, store *stateStore, lc LegionellaCycle,
+	now time.Time,
+) {
+	want, err := sheet.ReadFacetValue(ctx, gs.DesiredWaterTemp, gs.Want)
+	if err != nil {
+		log.Printf("Failed to read desired water temp for legionella cycle: %v\n", err)
+	} else if want != lm.Target {
+		// Someone else changed it, so keep their value.
+		lm.end(ctx, store, fmt.Sprintf("failed: water temp changed to %v", want))
+		return
+	}
+	hot, first, last := lm.tankReadings(store, lc.HoldCelsius)
+	if !hot {
+		lm.holdingSince = time.Time{}
+	} else if lm.holdingSince.IsZero() {
+		log.Printf("Legionella cycle reached %v °C\n", lc.HoldCelsius)
+		lm.holdingSince = last
+	}
+	switch {
+	case hot && !first.Before(lm.holdingSince.Add(lc.Hold)):
+		lm.Result = fmt.Sprintf("succeeded: held %v °C for %v", lc.HoldCelsius, lc.Hold)
+	case !now.Before(lm.Started.Add(lc.Timeout)):
+		lm.Result = fmt.Sprintf("failed: did not hold %v °C for %v within %v", lc.HoldCelsius, lc.Hold, lc.Timeout)
+	default:
+		return
+	}
+	lm.State = legionellaRestoring
+	lm.save()
+	lm.restore(ctx, sheet, store)
+}
+
+// tankReadings tells whether the latest readings of both tank sensors are
+// at least celsius, and when the older and the newer one were taken. Only
+// readings taken during the cycle count, so that the hold is never
+// confirmed by a reading from before it.
+func (lm *legionellaManager) tankReadings(store *stateStore, celsius float64) (hot bool, first, last time.Time) {
+	for i, s := range []gs.Setting{gs.ActualWaterTempHigher, gs.ActualWaterTempLower} {
+		v, ok := store.get(s)
+		if !ok || !v.IsNumber || v.Number < celsius || v.At.Before(lm.Started) {
+			return false, time.Time{}, time.Time{}
+		}
+		if i == 0 || v.At.Before(first) {
+			first = v.At
+		}
+		if v.At.After(last) {
+			last = v.At
+		}
+	}
+	return true, first, last
+}
+
+func (lm *legionellaManager) restore(ctx context.Context, sheet gs.Client, store *stateStore) {
+	if want, err := sheet.ReadFacetValue(ctx, gs.DesiredWaterTemp, gs.Want); err == nil && want != lm.Target {
+		// Changed meanwhile, e.g. while the agent was stopped.
+		lm.end(ctx, store, lm.Result)
+		return
+	}
+	log.Printf("Legionella cycle done, restoring water temp to %v\n", lm.Previous)
+	if lm.audit.writeWant(ctx, gs.DesiredWaterTemp, lm.Target, lm.Previous, byLegionella) != nil {
+		return
+	}
+	lm.end(ctx, store, lm.Result)
+}
+
+// end records the result of the cycle.
+func (lm *legionellaManager) end(ctx context.Context, store *stateStore, result string) {
+	lm.State, lm.Result = legionellaIdle, result
+	lm.save()
+	store.set(newCurrentValue(legionellaResult, result, fromAgent))
+	lm.audit.cycled(ctx, result)
+}
+
+func (lm *legionellaManager) load() error {
+	if lm.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(lm.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &lm.legionellaSaved)
+}
+
+// save writes the state file, and logs a failure.
+func (lm *legionellaManager) save() {
+	if lm.file == "" {
+		return
+	}
+	data, err := json.Marshal(lm.legionellaSaved)
+	if err == nil {
+		tmp := lm.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, lm.file)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save legionella cycle state: %v\n", err)
+	}
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// logTab names the monthly tabs current settings are logged to.
+const logTab = "Log"
+
+// SheetRequirements returns the tabs and named ranges of the sheet that
+// the agent uses with the given config.
+func SheetRequirements(cfg Config) gs.Requirements {
+	req := gs.Requirements{}
+	if cfg.UpdateCurrentSettings {
+		for _, s := range ReportedSettings {
+			if s.isStable {
+				req.RequireFacets(s.SheetSetting, gs.Have)
+			} else {
+				req.RequireFacets(s.SheetSetting, gs.HaveWithDate)
+			}
+			if s.isDesired {
+				req.RequireValues(s.SheetSetting, gs.Sent)
+			}
+		}
+		for _, name := range newSensorDirectory(cfg).Names() {
+			req.RequireFacets(gs.Setting(name), gs.HaveWithDate)
+		}
+		for _, d := range cfg.DerivedSensors {
+			req.RequireFacets(gs.Setting(d.Name), gs.HaveWithDate)
+		}
+	}
+	if cfg.ApplySheetConfig {
+		req.RequireTab(configTab, configHeader...)
+	}
+	if cfg.ApplyDesiredSettings {
+		for _, s := range PushedSettings {
+			req.RequireValues(s.SheetSetting, gs.Want, gs.Sent)
+		}
+		if cfg.ApplyScheduledSettings {
+			req.RequireTab(scheduleTab, scheduleHeader...)
+		}
+		if cfg.ApplyAutomaticSettings {
+			requireRules(&req, cfg.rules())
+		}
+		if cfg.Legionella.enabled() {
+			req.RequireValues(gs.DesiredWaterTemp, gs.Want)
+			req.RequireFacets(legionellaResult, gs.HaveWithDate)
+		}
+	}
+	if cfg.AuditToSheet {
+		req.RequireTab(auditTab, auditHeader...)
+	}
+	return req
+}
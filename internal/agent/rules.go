@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"parren.ch/ultrasource/pkg/expr"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// The built-in rules, used unless Config.Rules has others.
+//
+//go:embed rules.json
+var defaultRulesJson []byte
+
+var defaultRules = mustParseRules(defaultRulesJson)
+
+type (
+	// Rule sets the Want value of a setting when its condition holds.
+	//
+	// When is evaluated over the current values and sensors, hour (e.g.
+	// 6.5 for 06:30), weekday (0 for Sunday), and the numeric Want values
+	// of settings as e.g. water_temp_want. States are Want values that
+	// settings must have, e.g. water_program konstant.
+	//
+	// After firing, a rule waits for Cooldown, and with Rearm for that
+	// condition to hold, before it fires again, e.g. when the temperature
+	// has dropped well below the one that fired it.
+	Rule struct {
+		Name     string
+		When     *expr.Expr
+		Rearm    *expr.Expr
+		States   map[gs.Setting]string
+		Set      gs.Setting
+		To       string
+		Cooldown time.Duration
+		// DryRun only logs what the rule would set, every time.
+		DryRun bool
+	}
+
+	// rulesFile defines rules in JSON, see rules.json.
+	rulesFile struct {
+		Rules []ruleDef `json:"rules"`
+	}
+
+	ruleDef struct {
+		Name     string                `json:"name"`
+		When     string                `json:"when"`
+		Rearm    string                `json:"rearm"`
+		States   map[gs.Setting]string `json:"states"`
+		Set      gs.Setting            `json:"set"`
+		To       string                `json:"to"`
+		Cooldown string                `json:"cooldown"`
+		DryRun   bool                  `json:"dryRun"`
+	}
+
+	// ruleEngine applies the rules, and remembers when they fired.
+	ruleEngine struct {
+		audit  *auditor
+		states map[string]ruleState
+	}
+
+	ruleState struct {
+		firedAt  time.Time
+		disarmed bool
+	}
+)
+
+// LoadRules reads rules from a JSON file. The settings they set must be
+// pushed settings, so LoadSettings must be called before, or CheckRules
+// after.
+func LoadRules(file string) ([]Rule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return rules, nil
+}
+
+func mustParseRules(data []byte) []Rule {
+	rules, err := parseRules(data)
+	if err != nil {
+		panic(fmt.Sprintf("bad built-in rules: %v", err))
+	}
+	return rules
+}
+
+func parseRules(data []byte) ([]Rule, error) {
+	var f rulesFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	rules := []Rule{}
+	names := map[string]bool{}
+	for _, d := range f.Rules {
+		if d.Name == "" {
+			return nil, fmt.Errorf("rule without a name: %+v", d)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("rule %v defined twice", d.Name)
+		}
+		names[d.Name] = true
+		r, err := d.rule()
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %v", d.Name, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (d ruleDef) rule() (Rule, error) {
+	r := Rule{Name: d.Name, States: d.States, Set: d.Set, To: d.To, DryRun: d.DryRun}
+	if err := r.check(); err != nil {
+		return Rule{}, err
+	}
+	var err error
+	if r.When, err = expr.Parse(d.When); err != nil {
+		return Rule{}, err
+	}
+	if d.Rearm != "" {
+		if r.Rearm, err = expr.Parse(d.Rearm); err != nil {
+			return Rule{}, err
+		}
+	}
+	if d.Cooldown != "" {
+		if r.Cooldown, err = time.ParseDuration(d.Cooldown); err != nil {
+			return Rule{}, err
+		}
+	}
+	return r, nil
+}
+
+// CheckRules checks the rules of the config against the pushed settings.
+// Rules are checked when they are parsed, but LoadSettings may replace the
+// settings afterwards.
+func CheckRules(cfg Config) error {
+	for _, r := range cfg.rules() {
+		if err := r.check(); err != nil {
+			return fmt.Errorf("rule %v: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// check checks that the rule sets a pushed setting to a value it can send.
+func (r Rule) check() error {
+	s, ok := pushedSetting(r.Set)
+	if !ok {
+		return fmt.Errorf("%q is not a pushed setting", r.Set)
+	}
+	if _, err := s.converter.MakeUpdateFrame(r.To, s.valueId); err != nil {
+		return fmt.Errorf("cannot set %v to %q: %v", r.Set, r.To, err)
+	}
+	return nil
+}
+
+func pushedSetting(s gs.Setting) (Setting, bool) {
+	for _, set := range PushedSettings {
+		if set.SheetSetting == s {
+			return set, true
+		}
+	}
+	return Setting{}, false
+}
+
+// rules returns the configured rules, or the built-in ones.
+func (cfg Config) rules() []Rule {
+	if cfg.Rules == nil {
+		return defaultRules
+	}
+	return cfg.Rules
+}
+
+// requireRules requires the ranges the rules read and write.
+func requireRules(req *gs.Requirements, rules []Rule) {
+	for _, r := range rules {
+		req.RequireValues(r.Set, gs.Want)
+		for s := range r.States {
+			req.RequireValues(s)
+		}
+		for _, e := range []*expr.Expr{r.When, r.Rearm} {
+			if e == nil {
+				continue
+			}
+			for _, n := range e.Vars() {
+				if strings.HasSuffix(n, wantSuffix) {
+					req.RequireValues(gs.Setting(strings.TrimSuffix(n, wantSuffix)), gs.Want)
+				}
+			}
+		}
+	}
+}
+
+// wantSuffix names the Want value of a setting in conditions.
+const wantSuffix = "_want"
+
+func newRuleEngine(audit *auditor) *ruleEngine {
+	return &ruleEngine{audit: audit, states: map[string]ruleState{}}
+}
+
+// apply applies the rules, except those setting a held setting, e.g. one a
+// legionella cycle sets.
+func (re *ruleEngine) apply(ctx context.Context, sheet gs.Client, store *stateStore, cfg Config,
+	held map[gs.Setting]bool, now time.Time,
+) {
+	log.Println("Evaluating rules for automatic settings")
+	env := rulesEnv(ctx, sheet, store, now)
+	for _, r := range cfg.rules() {
+		if held[r.Set] {
+			log.Printf("Rule %v skipped, %v is held\n", r.Name, r.Set)
+			continue
+		}
+		re.applyRule(ctx, sheet, r, env, cfg.RulesDryRun || r.DryRun, now)
+	}
+}
+
+func (re *ruleEngine) applyRule(ctx context.Context, sheet gs.Client, r Rule, env expr.Env, dryRun bool,
+	now time.Time,
+) {
+	st := re.states[r.Name]
+	if st.disarmed {
+		if ok, err := r.Rearm.IsTrue(env); err != nil || !ok {
+			return
+		}
+		log.Printf("Rule %v rearmed by %v\n", r.Name, r.Rearm)
+		st.disarmed = false
+		re.states[r.Name] = st
+	}
+	if r.Cooldown > 0 && now.Before(st.firedAt.Add(r.Cooldown)) {
+		return
+	}
+	for s, want := range r.States {
+		vs, err := sheet.ReadSettingValues(ctx, s)
+		if err != nil {
+			log.Printf("Rule %v failed to read %v: %v\n", r.Name, s, err)
+			return
+		}
+		if vs.Want != want {
+			return
+		}
+	}
+	if ok, err := r.When.IsTrue(env); err != nil {
+		log.Printf("Rule %v failed to evaluate %v: %v\n", r.Name, r.When, err)
+		return
+	} else if !ok {
+		return
+	}
+	old, err := sheet.ReadFacetValue(ctx, r.Set, gs.Want)
+	if err != nil {
+		log.Printf("Rule %v failed to read %v: %v\n", r.Name, r.Set, err)
+		return
+	}
+	if old == r.To {
+		return
+	}
+	if dryRun {
+		// Without effects, also on the cooldown and rearming.
+		log.Printf("Rule %v fired, but is a dry run: would set %v from %v to %v\n", r.Name, r.Set, old, r.To)
+		return
+	}
+	log.Printf("Rule %v fired: setting %v from %v to %v\n", r.Name, r.Set, old, r.To)
+	if re.audit.writeWant(ctx, r.Set, old, r.To, byRule) != nil {
+		return
+	}
+	re.states[r.Name] = ruleState{firedAt: now, disarmed: r.Rearm != nil}
+}
+
+// rulesEnv looks up the names in conditions.
+func rulesEnv(ctx context.Context, sheet gs.Client, store *stateStore, now time.Time) expr.Env {
+	values := latestValuesEnv(store)
+	return func(n string) (float64, bool) {
+		switch n {
+		case "hour":
+			return float64(now.Hour()) + float64(now.Minute())/60, true
+		case "weekday":
+			return float64(now.Weekday()), true
+		}
+		if strings.HasSuffix(n, wantSuffix) {
+			s := gs.Setting(strings.TrimSuffix(n, wantSuffix))
+			if v, err := sheet.ReadFacetValue(ctx, s, gs.Want); err == nil {
+				f, err := strconv.ParseFloat(v, 64)
+				return f, err == nil
+			}
+		}
+		return values(n)
+	}
+}
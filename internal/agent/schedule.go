@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// The schedule tab has a header row, then one entry per row with the
+// columns start, setting, value, end, repeat, status, and previous. End
+// and repeat are optional. The agent writes status and previous.
+const (
+	scheduleTab  = "Schedule"
+	scheduleRows = scheduleTab + "!A2:G"
+)
+
+var scheduleHeader = []interface{}{"Start", "Setting", "Value", "End", "Repeat", "Status", "Previous"}
+
+const (
+	colStart = iota
+	colSetting
+	colValue
+	colEnd
+	colRepeat
+	colStatus
+	colPrevious
+)
+
+// repeatDays maps the repeat rules to their period in days.
+var repeatDays = map[string]int{
+	"":       0,
+	"daily":  1,
+	"weekly": 7,
+}
+
+type (
+	// scheduler sets the Want facet of settings as scheduled in the
+	// schedule tab. The rest is up to the usual Want/Sent/Have flow.
+	scheduler struct {
+		audit *auditor
+		// statuses remembers what was written to the sheet, in case
+		// the sheet is read back from a cache.
+		statuses map[string]scheduleStatus
+	}
+
+	scheduleStatus struct {
+		status   string
+		previous string
+	}
+
+	scheduleEntry struct {
+		row     int
+		start   time.Time
+		setting Setting
+		value   string
+		// duration is zero if the entry has no end.
+		duration time.Duration
+		days     int
+		status   string
+		previous string
+	}
+)
+
+func newScheduler(audit *auditor) *scheduler {
+	return &scheduler{audit: audit, statuses: map[string]scheduleStatus{}}
+}
+
+func (sc *scheduler) apply(ctx context.Context, sheet gs.Client, now time.Time) {
+	log.Println("Polling for scheduled settings")
+	rows, err := sheet.Read(ctx, scheduleRows)
+	if err != nil {
+		log.Printf("Failed to read schedule: %v\n", err)
+		return
+	}
+	for i, row := range rows {
+		if len(row) == 0 || cell(row, colStart) == "" {
+			continue
+		}
+		e, err := parseScheduleEntry(i+2, row)
+		if err != nil {
+			sc.setStatus(ctx, sheet, row, i+2, fmt.Sprintf("error: %v", err), cell(row, colPrevious))
+			continue
+		}
+		if s, ok := sc.statuses[rowKey(row)]; ok {
+			e.status, e.previous = s.status, s.previous
+		}
+		sc.applyEntry(ctx, sheet, row, e, now)
+	}
+}
+
+func (sc *scheduler) applyEntry(ctx context.Context, sheet gs.Client, row []interface{}, e scheduleEntry, now time.Time) {
+	occ, ok := e.occurrence(now)
+	if !ok {
+		return
+	}
+	applied := "applied " + gs.FormatTimestamp(occ)
+	ended := "ended " + gs.FormatTimestamp(occ)
+	missed := "missed " + gs.FormatTimestamp(occ)
+	// An earlier occurrence may still be applied if its end was missed.
+	isApplied := strings.HasPrefix(e.status, "applied ")
+	if e.duration > 0 && !now.Before(occ.Add(e.duration)) {
+		if !isApplied {
+			// Either it ended already, or the agent was down all along.
+			if e.status != ended {
+				sc.setStatus(ctx, sheet, row, e.row, missed, e.previous)
+			}
+			return
+		}
+		log.Printf("Restoring %v to %v after schedule row %v\n", e.setting.SheetSetting, e.previous, e.row)
+		if e.previous != "" && sc.audit.writeWant(ctx, e.setting.SheetSetting, e.value, e.previous, bySchedule) != nil {
+			return
+		}
+		sc.setStatus(ctx, sheet, row, e.row, ended, e.previous)
+		return
+	}
+	if e.status == applied {
+		return
+	}
+	previous := e.previous
+	if !isApplied || e.duration == 0 {
+		vs, err := sheet.ReadSettingValues(ctx, e.setting.SheetSetting)
+		if err != nil {
+			log.Printf("Failed to read setting %v: %v\n", e.setting.SheetSetting, err)
+			return
+		}
+		previous = vs.Want
+	}
+	log.Printf("Setting %v to %v as scheduled in row %v\n", e.setting.SheetSetting, e.value, e.row)
+	if sc.audit.writeWant(ctx, e.setting.SheetSetting, previous, e.value, bySchedule) != nil {
+		return
+	}
+	sc.setStatus(ctx, sheet, row, e.row, applied, previous)
+}
+
+func (sc *scheduler) setStatus(ctx context.Context, sheet gs.Client, row []interface{}, n int, status, previous string) {
+	key := rowKey(row)
+	st := scheduleStatus{status: status, previous: previous}
+	if sc.statuses[key] == st {
+		return
+	}
+	rng := fmt.Sprintf("%v!F%v:G%v", scheduleTab, n, n)
+	if err := sheet.Write(ctx, rng, [][]interface{}{{status, previous}}); err != nil {
+		log.Printf("Failed to write status of schedule row %v: %v\n", n, err)
+		return
+	}
+	sc.statuses[key] = st
+}
+
+// occurrence returns the start of the latest occurrence of an entry before
+// now, if any.
+func (e scheduleEntry) occurrence(now time.Time) (time.Time, bool) {
+	if now.Before(e.start) {
+		return time.Time{}, false
+	}
+	if e.days == 0 {
+		return e.start, true
+	}
+	occ := e.start
+	for n := e.days; !now.Before(e.start.AddDate(0, 0, n)); n += e.days {
+		occ = e.start.AddDate(0, 0, n)
+	}
+	return occ, true
+}
+
+func parseScheduleEntry(n int, row []interface{}) (scheduleEntry, error) {
+	e := scheduleEntry{row: n, value: cell(row, colValue),
+		status: cell(row, colStatus), previous: cell(row, colPrevious)}
+	var err error
+	if e.start, err = gs.ParseTimestamp(row[colStart]); err != nil {
+		return e, fmt.Errorf("bad start: %v", err)
+	}
+	name := gs.Setting(cell(row, colSetting))
+	found := false
+	for _, s := range PushedSettings {
+		if s.SheetSetting == name {
+			e.setting, found = s, true
+		}
+	}
+	if !found {
+		return e, fmt.Errorf("unknown setting %q", name)
+	}
+	if cell(row, colEnd) != "" {
+		end, err := gs.ParseTimestamp(row[colEnd])
+		if err != nil {
+			return e, fmt.Errorf("bad end: %v", err)
+		}
+		if !end.After(e.start) {
+			return e, fmt.Errorf("end before start")
+		}
+		e.duration = end.Sub(e.start)
+	}
+	days, ok := repeatDays[strings.ToLower(cell(row, colRepeat))]
+	if !ok {
+		return e, fmt.Errorf("unknown repeat %q", cell(row, colRepeat))
+	}
+	e.days = days
+	return e, nil
+}
+
+// rowKey identifies an entry by what it schedules.
+func rowKey(row []interface{}) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%v", cell(row, colStart), cell(row, colSetting), cell(row, colValue),
+		cell(row, colEnd), cell(row, colRepeat))
+}
+
+func cell(row []interface{}, i int) string {
+	if i >= len(row) {
+		return ""
+	}
+	return fmt.Sprintf("%v", row[i])
+}
@@ -1,7 +1,11 @@
 package agent
 
 import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
 
 	"github.com/vishalkuo/bimap"
@@ -16,6 +20,7 @@ type Setting struct {
 	converter    *converter
 	isStable     bool
 	isDesired    bool
+	answeredBy   us.Device
 }
 
 type converter struct {
@@ -23,80 +28,156 @@ type converter struct {
 	MakeUpdateFrame func(string, us.ValueId) (can.Frame, error)
 }
 
-const (
-	WaterProgramConstant = "konstant"
+// The built-in settings, used unless LoadSettings reads others.
+//
+//go:embed settings.json
+var defaultSettingsJson []byte
+
+var PushedSettings, ReportedSettings = mustParseSettings(defaultSettingsJson)
+
+type (
+	// settingsFile defines the settings in JSON, see settings.json.
+	settingsFile struct {
+		Settings []settingDef `json:"settings"`
+	}
+
+	// settingDef defines a setting, and how to convert its values from and
+	// to CAN messages. Converter is empty to report values as they are,
+	// "celsius" for temperatures between Min and Max, or "map" to map the
+	// values of a list by Values, e.g. from "Woche 1" to "anwesend".
+	settingDef struct {
+		Name       gs.Setting        `json:"name"`
+		ValueId    us.ValueId        `json:"valueId"`
+		AnsweredBy us.Device         `json:"answeredBy"`
+		Converter  string            `json:"converter"`
+		Values     map[string]string `json:"values"`
+		Min        *float64          `json:"min"`
+		Max        *float64          `json:"max"`
+		// Stable values are only written when they change, fluctuating
+		// ones are written as they are reported.
+		Stable bool `json:"stable"`
+		// Pushed settings have a Want value sent to the pump.
+		Pushed bool `json:"pushed"`
+	}
 )
 
-var (
-	HeatingProgram = Setting{
-		SheetSetting: gs.HeatingProgram,
-		valueId:      us.HeatingProgramId,
-		isStable:     true,
-		isDesired:    true,
-		converter: strMap(map[string]string{
-			"Woche 1":  "anwesend",
-			"Woche 2":  "abwesend",
-			"Konstant": "konstant",
-			"Standby":  "standby",
-		})}
-	SettableDesiredHeatingTemp = Setting{
-		SheetSetting: gs.DesiredHeatingTemp,
-		valueId:      us.DesiredConstantRoomTempId,
-		isStable:     true,
-		isDesired:    true,
-		converter:    &celsius}
-	WaterProgram = Setting{
-		SheetSetting: gs.WaterProgram,
-		valueId:      us.WaterProgramId,
-		isStable:     true,
-		isDesired:    true,
-		converter: strMap(map[string]string{
-			"Konstant": WaterProgramConstant,
-			"Standby":  "standby",
-		})}
-	SettableDesiredWaterTemp = Setting{
-		SheetSetting: gs.DesiredWaterTemp,
-		valueId:      us.DesiredConstantWaterTempId,
-		isStable:     true,
-		isDesired:    true,
-		converter:    &celsius}
+// Without min or max, celsius values must be in this range.
+const (
+	defaultMinCelsius = 0
+	defaultMaxCelsius = 65
 )
 
-var PushedSettings = []Setting{
-	HeatingProgram,
-	SettableDesiredHeatingTemp,
-	WaterProgram,
-	SettableDesiredWaterTemp,
+// LoadSettings replaces the built-in settings by the ones in a JSON file.
+// It must be called before the agent runs.
+func LoadSettings(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	pushed, reported, err := parseSettings(data)
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+	PushedSettings, ReportedSettings = pushed, reported
+	return nil
+}
+
+func mustParseSettings(data []byte) (pushed, reported []Setting) {
+	pushed, reported, err := parseSettings(data)
+	if err != nil {
+		panic(fmt.Sprintf("bad built-in settings: %v", err))
+	}
+	return pushed, reported
+}
+
+// parseSettings parses and validates settings against the datapoints
+// known to the ultrasource package.
+func parseSettings(data []byte) (pushed, reported []Setting, err error) {
+	var f settingsFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, nil, err
+	}
+	names := map[gs.Setting]bool{}
+	for _, d := range f.Settings {
+		if d.Name == "" {
+			return nil, nil, fmt.Errorf("setting without a name: %+v", d)
+		}
+		if names[d.Name] {
+			return nil, nil, fmt.Errorf("setting %v defined twice", d.Name)
+		}
+		names[d.Name] = true
+		s, err := d.setting()
+		if err != nil {
+			return nil, nil, fmt.Errorf("setting %v: %v", d.Name, err)
+		}
+		if s.isDesired {
+			pushed = append(pushed, s)
+		}
+		reported = append(reported, s)
+	}
+	return pushed, reported, nil
+}
+
+func (d settingDef) setting() (Setting, error) {
+	desc, ok := us.ValueDescs[d.ValueId]
+	if !ok {
+		return Setting{}, fmt.Errorf("unknown datapoint %v", d.ValueId)
+	}
+	if d.Pushed && !desc.Settable() {
+		return Setting{}, fmt.Errorf("datapoint %v cannot be set", d.ValueId)
+	}
+	if d.Converter != "celsius" && (d.Min != nil || d.Max != nil) {
+		return Setting{}, fmt.Errorf("min and max need the celsius converter")
+	}
+	if d.Converter != "map" && d.Values != nil {
+		return Setting{}, fmt.Errorf("values need the map converter")
+	}
+	s := Setting{SheetSetting: d.Name, valueId: d.ValueId, answeredBy: d.AnsweredBy, isStable: d.Stable,
+		isDesired: d.Pushed}
+	switch d.Converter {
+	case "":
+		if d.Pushed {
+			return Setting{}, fmt.Errorf("pushed settings need a converter")
+		}
+	case "celsius":
+		min, max := float64(defaultMinCelsius), float64(defaultMaxCelsius)
+		if d.Min != nil {
+			min = *d.Min
+		}
+		if d.Max != nil {
+			max = *d.Max
+		}
+		if min > max {
+			return Setting{}, fmt.Errorf("min %v is above max %v", min, max)
+		}
+		s.converter = celsius(min, max)
+	case "map":
+		inverse := map[string]string{}
+		for k, v := range d.Values {
+			if opts := desc.Options(); opts != nil && !contains(opts, k) {
+				return Setting{}, fmt.Errorf("%q is none of %v", k, opts)
+			}
+			if _, ok := inverse[v]; ok {
+				return Setting{}, fmt.Errorf("%q mapped twice", v)
+			}
+			inverse[v] = k
+		}
+		s.converter = strMap(d.Values)
+	default:
+		return Setting{}, fmt.Errorf("unknown converter %q", d.Converter)
+	}
+	return s, nil
 }
 
-var ReportedSettings = []Setting{
-	HeatingProgram,
-	SettableDesiredHeatingTemp,
-	WaterProgram,
-	SettableDesiredWaterTemp,
-
-	{SheetSetting: "resulting_room_temp", valueId: us.DesiredRoomTempId},
-	{SheetSetting: "heating_temp", valueId: us.DesiredHeatingTempId},
-	{SheetSetting: "actual_heating_temp", valueId: us.ActualHeaterTempId},
-
-	{SheetSetting: "resulting_water_temp", valueId: us.DesiredWaterTempId},
-	{SheetSetting: gs.ActualWaterTempHigher, valueId: us.ActualWaterTempHigherId},
-	{SheetSetting: gs.ActualWaterTempLower, valueId: us.ActualWaterTempLowerId},
-
-	{SheetSetting: "desired_heater_temp", valueId: us.DesiredHeaterTempId},
-	{SheetSetting: "actual_heater_temp", valueId: us.ActualHeaterTempId},
-	{SheetSetting: "actual_heater_return_temp", valueId: us.ActualHeaterReturnTempId},
-
-	{SheetSetting: "actual_outside_temp", valueId: us.ActualOutsideTempId},
-	{SheetSetting: "actual_outside_min_temp", valueId: us.ActualOutsideMinTempId},
-	{SheetSetting: "actual_outside_max_temp", valueId: us.ActualOutsideMaxTempId},
-	{SheetSetting: "actual_outside_avg_temp", valueId: us.ActualOutsideAvgTempId},
-
-	{SheetSetting: "modulation", valueId: us.ActualModulationId},
-	{SheetSetting: "hours", valueId: us.ActualHeaterHoursId},
-	{SheetSetting: "heat_energy", valueId: us.ActualHeaterEnergyId},
-	{SheetSetting: "grid_energy", valueId: us.ActualGridEnergyId},
-	{SheetSetting: "heater_mode", valueId: us.HeaterModeId},
+func contains(vs []string, v string) bool {
+	for _, w := range vs {
+		if w == v {
+			return true
+		}
+	}
+	return false
 }
 
 func (s Setting) ParseMessage(m us.Message) (v string, ok bool) {
@@ -106,29 +187,39 @@ func (s Setting) ParseMessage(m us.Message) (v string, ok bool) {
 	return s.converter.ParseMessage(m)
 }
 
+// AnsweredBy returns the device that answers queries of the setting.
+func (s Setting) AnsweredBy() us.Device {
+	if s.answeredBy == (us.Device{}) {
+		return us.Controller
+	}
+	return s.answeredBy
+}
+
 func (s Setting) MakeUpdateFrame(vs gs.SettingValues) (f can.Frame, err error) {
 	return s.converter.MakeUpdateFrame(vs.Want, s.valueId)
 }
 
-var celsius = converter{
-	ParseMessage: func(m us.Message) (v string, ok bool) {
-		v = fmt.Sprintf("%v", m.Value)
-		ok = true
-		return
-	},
-	MakeUpdateFrame: func(v string, vid us.ValueId) (f can.Frame, err error) {
-		celsius, err := strconv.ParseFloat(v, 32)
-		if err != nil {
-			err = fmt.Errorf("failed to parse number from: %v: %v", v, err)
+func celsius(min, max float64) *converter {
+	return &converter{
+		ParseMessage: func(m us.Message) (v string, ok bool) {
+			v = fmt.Sprintf("%v", m.Value)
+			ok = true
 			return
-		}
-		if celsius > 65 || celsius < 0 {
-			err = fmt.Errorf("outside range 0-65 °C: %v", celsius)
+		},
+		MakeUpdateFrame: func(v string, vid us.ValueId) (f can.Frame, err error) {
+			celsius, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				err = fmt.Errorf("failed to parse number from: %v: %v", v, err)
+				return
+			}
+			if celsius > max || celsius < min {
+				err = fmt.Errorf("outside range %v-%v °C: %v", min, max, celsius)
+				return
+			}
+			f, err = us.BuildFrame(us.IsSet, vid, float32(celsius))
 			return
-		}
-		f, err = us.BuildFrame(us.IsSet, vid, float32(celsius))
-		return
-	}}
+		}}
+}
 
 func strMap(valueByValue map[string]string) *converter {
 	bm := bimap.NewBiMapFromMap(valueByValue)
@@ -0,0 +1,354 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	temp "parren.ch/ultrasource/pkg/temperature"
+)
+
+// The config tab has a header row, then one row per option with the
+// columns key, value, and status. Keys are the names of the agent's
+// flags. The agent writes the status. Options without a row keep the
+// value of their flag.
+const (
+	configTab  = "Config"
+	configRows = configTab + "!A2:C"
+)
+
+var configHeader = []interface{}{"Key", "Value", "Status"}
+
+const (
+	colConfigKey = iota
+	colConfigValue
+	colConfigStatus
+)
+
+// configOptions are the options that can be changed while the agent runs.
+var configOptions = map[string]func(cfg *Config, v string) error{
+	"apply-automatic-settings": boolOption(func(cfg *Config) *bool { return &cfg.ApplyAutomaticSettings }),
+	"apply-scheduled-settings": boolOption(func(cfg *Config) *bool { return &cfg.ApplyScheduledSettings }),
+	"rules-dry-run":            boolOption(func(cfg *Config) *bool { return &cfg.RulesDryRun }),
+	"discover-temperature-sensors": boolOption(func(cfg *Config) *bool {
+		return &cfg.DiscoverTemperatureSensors
+	}),
+	"sheet-polling-interval": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.SheetPollingInterval
+	}),
+	"settings-query-interval": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.SettingsQueryInterval
+	}),
+	"settings-query-gap": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.SettingsQueryGap
+	}),
+	"log-to-sheet-interval": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.SettingsLogToSheetInterval
+	}),
+	"log-to-files-interval": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.SettingsLogToFilesInterval
+	}),
+	"reconcile-delay": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.ReconcileDelay
+	}),
+	"sync-timeout": func(cfg *Config, v string) error {
+		if err := timeoutOption(func(cfg *Config) *time.Duration { return &cfg.SyncTimeout })(cfg, v); err != nil {
+			return err
+		}
+		cfg.DeriveSyncTimeout = false
+		return nil
+	},
+	"derived-sensors-interval": durationOption(func(cfg *Config) *time.Duration {
+		return &cfg.DerivedSensorsInterval
+	}),
+	"derived-sensors-max-age": timeoutOption(func(cfg *Config) *time.Duration {
+		return &cfg.DerivedSensorsMaxAge
+	}),
+	"temperature-sensor": setTemperatureSensor,
+	"derived-sensor":     setDerivedSensor,
+}
+
+// configEntryIds identify the entries of options with a row per entry,
+// which add to or replace the entries of the flag with the same id.
+var configEntryIds = map[string]func(v string) string{
+	"temperature-sensor": func(v string) string {
+		id, _, _ := strings.Cut(v, ":")
+		return strings.TrimSpace(id)
+	},
+	"derived-sensor": func(v string) string {
+		n, _, _ := strings.Cut(v, "=")
+		return strings.TrimSpace(n)
+	},
+}
+
+type (
+	// liveConfig is the config of the running agent. It starts with the
+	// flags and follows the config tab.
+	liveConfig struct {
+		lock sync.Mutex
+		cfg  Config
+	}
+
+	// sheetConfig applies the config tab on top of the flags.
+	sheetConfig struct {
+		flags     Config
+		sensorDir *temp.Directory
+		// statuses remembers what was written to the sheet, in case
+		// the sheet is read back from a cache.
+		statuses map[int]configStatus
+		// valid are the last valid values of the options, by slot.
+		valid map[string]string
+	}
+
+	// configStatus is the status written for the option in a row.
+	configStatus struct {
+		key, value, status string
+	}
+)
+
+func newLiveConfig(cfg Config) *liveConfig {
+	return &liveConfig{cfg: cfg}
+}
+
+func (lc *liveConfig) get() Config {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	return lc.cfg
+}
+
+func (lc *liveConfig) set(cfg Config) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.cfg = cfg
+}
+
+func newSheetConfig(flags Config, sensorDir *temp.Directory) *sheetConfig {
+	return &sheetConfig{flags: flags, sensorDir: sensorDir, statuses: map[int]configStatus{},
+		valid: map[string]string{}}
+}
+
+func applySheetConfigForever(ctx context.Context, sheet gs.Client, sc *sheetConfig, live *liveConfig) {
+	runThenTickLive(ctx, live, func(cfg Config) time.Duration { return cfg.SheetPollingInterval },
+		func(Config) {
+			sc.apply(ctx, sheet, live)
+		})
+}
+
+// configRules are checks across options, with the options they involve.
+var configRules = []struct {
+	keys  []string
+	check func(cfg Config) error
+}{
+	{[]string{"sync-timeout", "settings-query-interval"}, CheckSyncTimeout},
+}
+
+// apply reads the config tab and updates the live config and the names of
+// the sensor directory. Rows with unknown options are skipped, and invalid
+// values keep the last valid one. Values breaking a rule across options
+// keep the last valid ones of all options of the rule. If the tab cannot
+// be read, the live config stays as it is.
+func (sc *sheetConfig) apply(ctx context.Context, sheet gs.Client, live *liveConfig) {
+	log.Println("Polling for config changes")
+	rows, err := sheet.Read(ctx, configRows)
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return
+	}
+	values := map[string]string{}
+	statuses := make([]string, len(rows))
+	for i, row := range rows {
+		key := cell(row, colConfigKey)
+		if key == "" {
+			continue
+		}
+		statuses[i] = "applied"
+		v := cell(row, colConfigValue)
+		slot := configSlot(key, v)
+		if set, ok := configOptions[key]; !ok {
+			statuses[i] = "error: unknown or not changeable while running"
+		} else if err := set(&Config{}, v); err != nil {
+			statuses[i] = fmt.Sprintf("error: %v", err)
+			if v, ok := sc.valid[slot]; ok {
+				values[slot] = v
+			}
+		} else {
+			values[slot] = v
+		}
+	}
+	cfg := sc.build(values)
+	for _, r := range configRules {
+		err := r.check(cfg)
+		if err == nil {
+			continue
+		}
+		for _, key := range r.keys {
+			for i, row := range rows {
+				if cell(row, colConfigKey) == key && statuses[i] == "applied" {
+					statuses[i] = fmt.Sprintf("error: %v", err)
+				}
+			}
+			if v, ok := sc.valid[key]; ok {
+				values[key] = v
+			} else {
+				delete(values, key)
+			}
+		}
+		if cfg = sc.build(values); r.check(cfg) != nil {
+			// The last valid values were valid together with other
+			// values, so fall back to the flags.
+			for _, key := range r.keys {
+				delete(values, key)
+			}
+			cfg = sc.build(values)
+		}
+	}
+	for key, v := range values {
+		sc.valid[key] = v
+	}
+	for i, row := range rows {
+		if statuses[i] != "" {
+			sc.setStatus(ctx, sheet, i+2, row, statuses[i])
+		}
+	}
+	if old := live.get(); fmt.Sprintf("%+v", old) != fmt.Sprintf("%+v", cfg) {
+		log.Printf("Applying config from sheet: %+v\n", cfg)
+	}
+	if sc.sensorDir != nil {
+		if err := sc.sensorDir.SetNames(cfg.TemperatureSensors); err != nil {
+			log.Printf("Failed to apply sensor names: %v\n", err)
+		}
+	}
+	live.set(cfg)
+}
+
+// configSlot is where a row's value goes: the option, or the option and
+// the id of the entry.
+func configSlot(key, v string) string {
+	if id, ok := configEntryIds[key]; ok {
+		return key + " " + id(v)
+	}
+	return key
+}
+
+// build applies valid values of options on top of the flags, in the order
+// of their slots.
+func (sc *sheetConfig) build(values map[string]string) Config {
+	slots := make([]string, 0, len(values))
+	for slot := range values {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+	cfg := sc.flags
+	for _, slot := range slots {
+		key, _, _ := strings.Cut(slot, " ")
+		configOptions[key](&cfg, values[slot])
+	}
+	cfg.deriveSyncTimeout()
+	return cfg
+}
+
+// setStatus writes the status of row n, unless it shows it already. The
+// remembered status only counts while the row has the same option.
+func (sc *sheetConfig) setStatus(ctx context.Context, sheet gs.Client, n int, row []interface{}, status string) {
+	written := configStatus{cell(row, colConfigKey), cell(row, colConfigValue), status}
+	curr := cell(row, colConfigStatus)
+	if s, ok := sc.statuses[n]; ok && s.key == written.key && s.value == written.value {
+		curr = s.status
+	}
+	if curr == status {
+		return
+	}
+	rng := fmt.Sprintf("%v!C%v", configTab, n)
+	if err := sheet.Write(ctx, rng, [][]interface{}{{status}}); err != nil {
+		log.Printf("Failed to write status of config row %v: %v\n", n, err)
+		return
+	}
+	sc.statuses[n] = written
+}
+
+func boolOption(field func(cfg *Config) *bool) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", v)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+func durationOption(field func(cfg *Config) *time.Duration) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration like 90s or 2m: %q", v)
+		}
+		if d <= 0 {
+			return fmt.Errorf("must be positive: %q", v)
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// timeoutOption is a duration option accepting 0 for no limit.
+func timeoutOption(field func(cfg *Config) *time.Duration) func(cfg *Config, v string) error {
+	return func(cfg *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("not a duration like 90s or 2m: %q", v)
+		}
+		if d < 0 {
+			return fmt.Errorf("must not be negative: %q", v)
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// setTemperatureSensor adds or replaces a sensor as id:name[:offset[:gain]].
+func setTemperatureSensor(cfg *Config, v string) error {
+	id, e, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("expected id:name[:offset[:gain]], got %q", v)
+	}
+	id = strings.TrimSpace(id)
+	if _, err := temp.NewDirectory("", map[string]string{id: e}); err != nil {
+		return err
+	}
+	sensors := map[string]string{id: e}
+	for k, e := range cfg.TemperatureSensors {
+		if k != id {
+			sensors[k] = e
+		}
+	}
+	cfg.TemperatureSensors = sensors
+	return nil
+}
+
+// setDerivedSensor adds or replaces a sensor as name=expression.
+func setDerivedSensor(cfg *Config, v string) error {
+	d, err := ParseDerivedSensor(v)
+	if err != nil {
+		return err
+	}
+	ds := []DerivedSensor{}
+	added := false
+	for _, o := range cfg.DerivedSensors {
+		if o.Name == d.Name {
+			o, added = d, true
+		}
+		ds = append(ds, o)
+	}
+	if !added {
+		ds = append(ds, d)
+	}
+	cfg.DerivedSensors = ds
+	return nil
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+type (
+	// source tells where a current value came from.
+	source string
+
+	// currentValue is the latest known value of a setting or sensor.
+	currentValue struct {
+		Setting gs.Setting
+		Text    string
+		// Number is only valid if IsNumber is set.
+		Number   float64
+		IsNumber bool
+		At       time.Time
+		Source   source
+	}
+
+	// stateStore holds the current values of all settings and sensors.
+	// The sheet, the logs, and the rules all read from it.
+	stateStore struct {
+		lock        sync.Mutex
+		values      map[gs.Setting]currentValue
+		subscribers []*subscription
+	}
+
+	// subscription keeps the values set since the subscriber last took
+	// them, only the latest one per setting.
+	subscription struct {
+		lock    sync.Mutex
+		pending map[gs.Setting]currentValue
+		// order keeps the pending settings in the order they were first set.
+		order []gs.Setting
+		// ready is signaled when values are pending.
+		ready chan struct{}
+	}
+)
+
+const (
+	fromCan     source = "can"
+	fromSensor  source = "sensor"
+	fromDerived source = "derived"
+	// fromAgent is what the agent tells about itself, e.g. the result of
+	// the last legionella cycle.
+	fromAgent source = "agent"
+)
+
+func newCurrentValue(s gs.Setting, text string, src source) currentValue {
+	v := currentValue{Setting: s, Text: text, At: time.Now(), Source: src}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		v.Number, v.IsNumber = f, true
+	}
+	return v
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{values: map[gs.Setting]currentValue{}}
+}
+
+// set stores a value and passes it to all subscribers.
+func (st *stateStore) set(v currentValue) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.values[v.Setting] = v
+	for _, sub := range st.subscribers {
+		sub.put(v)
+	}
+}
+
+func (st *stateStore) get(s gs.Setting) (currentValue, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	v, ok := st.values[s]
+	return v, ok
+}
+
+// all returns a copy of all current values.
+func (st *stateStore) all() map[gs.Setting]currentValue {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	vs := make(map[gs.Setting]currentValue, len(st.values))
+	for s, v := range st.values {
+		vs[s] = v
+	}
+	return vs
+}
+
+// subscribe returns a subscription to all values set from now on. If the
+// subscriber falls behind, it still gets the latest value of each setting.
+func (st *stateStore) subscribe() *subscription {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	sub := &subscription{pending: map[gs.Setting]currentValue{}, ready: make(chan struct{}, 1)}
+	st.subscribers = append(st.subscribers, sub)
+	return sub
+}
+
+func (sub *subscription) put(v currentValue) {
+	sub.lock.Lock()
+	if _, ok := sub.pending[v.Setting]; !ok {
+		sub.order = append(sub.order, v.Setting)
+	}
+	sub.pending[v.Setting] = v
+	sub.lock.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending values and clears them.
+func (sub *subscription) take() []currentValue {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	vs := make([]currentValue, 0, len(sub.order))
+	for _, s := range sub.order {
+		vs = append(vs, sub.pending[s])
+	}
+	sub.pending, sub.order = map[gs.Setting]currentValue{}, nil
+	return vs
+}
+
+// updateSheetForever writes current values as Have values to the sheet.
+// Stable settings are written when they change, all others at most every
+// MaxHaveValueAge with the time of the value.
+func updateSheetForever(ctx context.Context, values *subscription, sheet gs.Client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-values.ready:
+			for _, v := range values.take() {
+				updateSheet(ctx, v, sheet)
+			}
+		}
+	}
+}
+
+func updateSheet(ctx context.Context, v currentValue, sheet gs.Client) {
+	set, isReported := reportedSetting(v.Setting)
+	fv := gs.FacetValue{Setting: v.Setting, Facet: gs.Have, Value: v.Text}
+	var err error
+	if isReported && set.isStable {
+		err = sheet.RefreshFacetValue(ctx, fv)
+	} else {
+		err = sheet.RefreshFluctuatingHaveValue(ctx, fv)
+	}
+	if err != nil {
+		log.Printf("Failed to update current value %v: %v\n", fv, err)
+		return
+	}
+	if !isReported || !set.isDesired {
+		return
+	}
+	vs, err := sheet.ReadSettingValues(ctx, v.Setting)
+	if err != nil {
+		log.Printf("Failed to read setting %v: %v\n", v.Setting, err)
+		return
+	}
+	if vs.Want == vs.Have && vs.Sent != vs.Have {
+		writeFacetValue(ctx, sheet, gs.FacetValue{Setting: v.Setting, Facet: gs.Sent, Value: vs.Have})
+	}
+}
+
+func reportedSetting(s gs.Setting) (Setting, bool) {
+	for _, set := range ReportedSettings {
+		if set.SheetSetting == s {
+			return set, true
+		}
+	}
+	return Setting{}, false
+}
@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+// syncState is the state of pushing the Want value of a setting to the
+// pump, until the pump reports it as its Have value.
+type syncState int
+
+const (
+	// syncIdle has the Want value in sync with the Have value, or has not
+	// seen the setting yet.
+	syncIdle syncState = iota
+	// syncSending has a value to send, or to send again.
+	syncSending
+	// syncAwaiting has sent the value and waits for the pump to report it.
+	syncAwaiting
+	// syncConfirmed has seen the pump report the sent value.
+	syncConfirmed
+	// syncFailed gave up on the value until the Want value changes.
+	syncFailed
+	// syncOverridden has seen the value change on the pump's display, and
+	// takes it over as the Want value.
+	syncOverridden
+	// syncDeviating has seen the value change on the pump's display, and
+	// keeps the Want value, to send it again later or never.
+	syncDeviating
+)
+
+var syncStateNames = []string{"idle", "sending", "awaiting confirmation", "confirmed", "failed", "overridden externally",
+	"deviating externally"}
+
+func (s syncState) String() string {
+	return syncStateNames[s]
+}
+
+// syncAction is what to do for a setting after a transition.
+type syncAction int
+
+const (
+	syncWait syncAction = iota
+	// syncSend sends the Want value to the pump.
+	syncSend
+	// syncPickUp writes the Have value as the Want value.
+	syncPickUp
+	// syncNotify tells that the Have value deviates from the Want value.
+	syncNotify
+)
+
+// ReconcilePolicy tells what to do when a setting is changed on the pump's
+// display, e.g. by a tenant, instead of in the sheet.
+type ReconcilePolicy string
+
+const (
+	// PanelWins takes the value over as the Want value.
+	PanelWins ReconcilePolicy = "panel-wins"
+	// SheetWins sends the Want value again right away.
+	SheetWins ReconcilePolicy = "sheet-wins"
+	// SheetWinsAfterDelay sends the Want value again after
+	// Config.ReconcileDelay.
+	SheetWinsAfterDelay ReconcilePolicy = "sheet-wins-after-delay"
+	// NotifyOnly keeps both values, and only records the change.
+	NotifyOnly ReconcilePolicy = "notify-only"
+)
+
+// ParseReconcilePolicy parses e.g. sheet-wins.
+func ParseReconcilePolicy(v string) (ReconcilePolicy, error) {
+	switch p := ReconcilePolicy(v); p {
+	case PanelWins, SheetWins, SheetWinsAfterDelay, NotifyOnly:
+		return p, nil
+	}
+	return "", fmt.Errorf("not a policy like %v, %v, %v or %v: %q", PanelWins, SheetWins, SheetWinsAfterDelay,
+		NotifyOnly, v)
+}
+
+// CheckReconcilePolicies checks that the policies of the config are for
+// pushed settings, after LoadSettings.
+func CheckReconcilePolicies(cfg Config) error {
+	for s := range cfg.ReconcilePolicies {
+		if _, ok := pushedSetting(s); !ok {
+			return fmt.Errorf("%q is not a pushed setting", s)
+		}
+	}
+	return nil
+}
+
+// CheckSyncTimeout checks that a given sync timeout is 0 or at least the
+// settings query interval. The Have value is only queried every interval,
+// so every send would time out.
+func CheckSyncTimeout(cfg Config) error {
+	if !cfg.DeriveSyncTimeout && cfg.SyncTimeout > 0 && cfg.SyncTimeout < cfg.SettingsQueryInterval {
+		return fmt.Errorf("sync-timeout %v is shorter than settings-query-interval %v", cfg.SyncTimeout,
+			cfg.SettingsQueryInterval)
+	}
+	return nil
+}
+
+// deriveSyncTimeout sets the sync timeout to twice the settings query
+// interval, unless a timeout was given.
+func (cfg *Config) deriveSyncTimeout() {
+	if cfg.DeriveSyncTimeout {
+		cfg.SyncTimeout = 2 * cfg.SettingsQueryInterval
+	}
+}
+
+// reconcilePolicy returns the policy of a setting, by default PanelWins.
+func (cfg Config) reconcilePolicy(s gs.Setting) ReconcilePolicy {
+	if p := cfg.ReconcilePolicies[s]; p != "" {
+		return p
+	}
+	return PanelWins
+}
+
+// settingSync is the state machine of a pushed setting. It follows the
+// values in the sheet, and sends a changed Want value again if the pump
+// answers the query after sending it with another value, or does not
+// report it within Config.SyncTimeout, up to Config.SyncRetries times.
+// Changes on the pump's display are handled by the setting's
+// ReconcilePolicy. The Sent value in the sheet shows the state.
+type settingSync struct {
+	state syncState
+	// value is the Want value being sent, or the last one in sync.
+	value string
+	// attempts counts the sends of value.
+	attempts int
+	sentAt   time.Time
+	deadline time.Time
+	// deviatingSince is when the Have value deviated.
+	deviatingSince time.Time
+	// reason tells why the value failed.
+	reason string
+}
+
+// next moves to the state for the values in the sheet and the latest
+// answer of the pump, and returns what to do.
+func (ss *settingSync) next(vs gs.SettingValues, answer currentValue, now time.Time, cfg Config) syncAction {
+	settled := ss.state == syncIdle || ss.state == syncConfirmed || ss.state == syncOverridden
+	if (settled || ss.state == syncDeviating) && vs.Want == vs.Sent && vs.Want != vs.Have {
+		return ss.reconcile(vs, now, cfg)
+	}
+	switch {
+	case vs.Want == vs.Have:
+		if ss.state == syncSending || ss.state == syncAwaiting {
+			ss.state = syncConfirmed
+		} else {
+			ss.state = syncIdle
+		}
+		ss.value, ss.attempts, ss.reason = vs.Want, 0, ""
+	case ss.state == syncIdle && vs.Sent == pendingSent(vs.Want):
+		// Sent before the agent restarted.
+		ss.state, ss.value, ss.attempts, ss.deadline = syncAwaiting, vs.Want, 1, now.Add(cfg.SyncTimeout)
+	case settled || vs.Want != ss.value:
+		ss.state, ss.value, ss.attempts, ss.reason = syncSending, vs.Want, 0, ""
+		return syncSend
+	case ss.state == syncSending:
+		return syncSend
+	case ss.state == syncAwaiting && answer.At.After(ss.sentAt) && answer.Text != ss.value:
+		// The Have value in the sheet may lag behind the answer.
+		if ss.attempts > cfg.SyncRetries {
+			ss.fail(fmt.Sprintf("read back %v after %v tries", answer.Text, ss.attempts))
+			return syncWait
+		}
+		ss.state = syncSending
+		return syncSend
+	case ss.state == syncAwaiting && cfg.SyncTimeout > 0 && !now.Before(ss.deadline):
+		if ss.attempts > cfg.SyncRetries {
+			ss.fail(fmt.Sprintf("no answer after %v tries", ss.attempts))
+			return syncWait
+		}
+		ss.state = syncSending
+		return syncSend
+	}
+	return syncWait
+}
+
+// reconcile handles a Have value changed on the pump's display.
+func (ss *settingSync) reconcile(vs gs.SettingValues, now time.Time, cfg Config) syncAction {
+	policy := cfg.reconcilePolicy(vs.Setting)
+	switch {
+	case policy == PanelWins:
+		ss.state, ss.value = syncOverridden, vs.Have
+		return syncPickUp
+	case policy == SheetWins || policy == SheetWinsAfterDelay && ss.state == syncDeviating &&
+		!now.Before(ss.deviatingSince.Add(cfg.ReconcileDelay)):
+		ss.state, ss.value, ss.attempts, ss.reason = syncSending, vs.Want, 0, ""
+		return syncSend
+	case ss.state != syncDeviating:
+		ss.state, ss.value, ss.deviatingSince = syncDeviating, vs.Want, now
+		return syncNotify
+	}
+	return syncWait
+}
+
+// sent moves on after sending the value. err tells whether sending
+// failed.
+func (ss *settingSync) sent(err error, now time.Time, cfg Config) {
+	ss.attempts++
+	ss.sentAt = now
+	switch {
+	case err == nil:
+		ss.state, ss.deadline = syncAwaiting, now.Add(cfg.SyncTimeout)
+	case ss.attempts > cfg.SyncRetries:
+		ss.fail(err.Error())
+	}
+}
+
+func (ss *settingSync) fail(reason string) {
+	ss.state, ss.reason = syncFailed, reason
+}
+
+// sentValue returns what the Sent value in the sheet shows in the state.
+// A value still to be sent shows as pending too, so that the agent waits
+// for it after a restart instead of taking the Have value.
+func (ss *settingSync) sentValue(have string) string {
+	switch ss.state {
+	case syncSending, syncAwaiting:
+		return pendingSent(ss.value)
+	case syncFailed:
+		return fmt.Sprintf("failed %v: %v", ss.value, ss.reason)
+	case syncDeviating:
+		// Keeps telling the change on the display from one in the sheet.
+		return ss.value
+	default:
+		return have
+	}
+}
+
+// pendingSent marks a Sent value as waiting for the pump.
+func pendingSent(value string) string {
+	return value + ">"
+}
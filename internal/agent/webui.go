@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	temp "parren.ch/ultrasource/pkg/temperature"
+)
+
+// webUI serves a page to see and change the settings, as an alternative
+// to the sheet. Changed Want values are written through the sheet client,
+// so the usual loop applies them. It has no login, so it serves on
+// localhost unless the address names a host, and it only takes changes
+// posted from its own page.
+type webUI struct {
+	sheet     gs.Client
+	store     *stateStore
+	audit     *auditor
+	sensorDir *temp.Directory
+	live      *liveConfig
+
+	lock    sync.Mutex
+	header  []interface{}
+	history [][]interface{}
+}
+
+type (
+	webPage struct {
+		Settings []gs.SettingValues
+		Values   []webValue
+		Header   []interface{}
+		History  [][]interface{}
+		Error    string
+	}
+
+	webValue struct {
+		Name  string
+		Value string
+	}
+)
+
+var webTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Heat pump</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+.error { color: red; }
+</style>
+</head>
+<body>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<h2>Settings</h2>
+<table>
+<tr><th>Setting</th><th>Want</th><th>Sent</th><th>Have</th></tr>
+{{range .Settings}}
+<tr>
+<td>{{.Setting}}</td>
+<td><form method="post" action="/want">
+<input type="hidden" name="setting" value="{{.Setting}}">
+<input name="value" value="{{.Want}}" size="10">
+<input type="submit" value="Set">
+</form></td>
+<td>{{.Sent}}</td>
+<td>{{.Have}}</td>
+</tr>
+{{end}}
+</table>
+<h2>Current values</h2>
+<table>
+{{range .Values}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}
+</table>
+<h2>History</h2>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .History}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func newWebUI(sheet gs.Client, store *stateStore, audit *auditor, sensorDir *temp.Directory, live *liveConfig) *webUI {
+	return &webUI{sheet: sheet, store: store, audit: audit, sensorDir: sensorDir, live: live}
+}
+
+func serveWebUIForever(ctx context.Context, ui *webUI, cfg Config) {
+	if cfg.WebUIHistoryInterval > 0 {
+		go ui.recordHistoryForever(ctx)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ui.servePage)
+	mux.HandleFunc("/want", ui.serveWant)
+	srv := &http.Server{Addr: webUIListenAddr(cfg.WebUIAddr), Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	log.Printf("Serving web UI on %v\n", srv.Addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Failed to serve web UI: %v\n", err)
+	}
+}
+
+// webUIListenAddr binds an address without a host, e.g. :8080, to
+// localhost. 0.0.0.0:8080 serves on all interfaces.
+func webUIListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// isSameOrigin tells whether a request comes from the web UI's own page,
+// so that other sites cannot post changes through a user's browser.
+// Requests without the headers, e.g. from curl, are not from a browser.
+func isSameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (ui *webUI) recordHistoryForever(ctx context.Context) {
+	interval := func(cfg Config) time.Duration { return cfg.WebUIHistoryInterval }
+	runThenTickLive(ctx, ui.live, interval, func(cfg Config) {
+		header := []interface{}{"Timestamp"}
+		row := []interface{}{gs.FormatTimestamp(time.Now())}
+		appendValuesToLogRow(ui.store, cfg, ui.sensorDir, &header, &row)
+		ui.lock.Lock()
+		defer ui.lock.Unlock()
+		ui.header = header
+		// Newest first.
+		ui.history = append([][]interface{}{row}, ui.history...)
+		if len(ui.history) > cfg.WebUIHistoryRows {
+			ui.history = ui.history[:cfg.WebUIHistoryRows]
+		}
+	})
+}
+
+func (ui *webUI) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	ui.render(r.Context(), w, "")
+}
+
+func (ui *webUI) serveWant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a setting and value", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "Changes are only taken from the web UI's own page", http.StatusForbidden)
+		return
+	}
+	name, value := gs.Setting(r.FormValue("setting")), r.FormValue("value")
+	var setting *Setting
+	for _, s := range PushedSettings {
+		if s.SheetSetting == name {
+			setting = &s
+			break
+		}
+	}
+	if setting == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ui.render(r.Context(), w, "Unknown setting "+string(name))
+		return
+	}
+	if _, err := setting.MakeUpdateFrame(gs.SettingValues{Setting: name, Want: value}); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ui.render(r.Context(), w, "Invalid value "+value+" for "+string(name)+": "+err.Error())
+		return
+	}
+	log.Printf("Setting %v to %v from web UI\n", name, value)
+	// The old value is only for the audit, so it may be missing.
+	old, _ := ui.sheet.ReadFacetValue(r.Context(), name, gs.Want)
+	if err := ui.audit.writeWant(r.Context(), name, old, value, byWebUI); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ui.render(r.Context(), w, "Failed to set "+string(name)+": "+err.Error())
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (ui *webUI) render(ctx context.Context, w http.ResponseWriter, errMsg string) {
+	page := webPage{Error: errMsg}
+	for _, s := range PushedSettings {
+		vs, err := ui.sheet.ReadSettingValues(ctx, s.SheetSetting)
+		if err != nil {
+			page.Error = "Failed to read settings: " + err.Error()
+			vs = gs.SettingValues{Setting: s.SheetSetting}
+		}
+		page.Settings = append(page.Settings, vs)
+	}
+	for s, v := range ui.store.all() {
+		page.Values = append(page.Values, webValue{Name: string(s), Value: v.Text})
+	}
+	sort.Slice(page.Values, func(i, j int) bool { return page.Values[i].Name < page.Values[j].Name })
+	ui.lock.Lock()
+	page.Header, page.History = ui.header, ui.history
+	ui.lock.Unlock()
+	if err := webTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render web UI: %v\n", err)
+	}
+}
@@ -0,0 +1,444 @@
+// Package expr evaluates arithmetic expressions over named values,
+// e.g. "temp5m - temp1m" or "dewpoint(bathroom, bathroom_humidity)", and
+// conditions, e.g. "temp1m < 5 and hour >= 22".
+package expr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type (
+	// Env looks up the current value of a name.
+	Env func(name string) (float64, bool)
+
+	Expr struct {
+		src  string
+		root node
+	}
+
+	node interface {
+		eval(env Env) (float64, error)
+		vars(set map[string]bool)
+	}
+
+	number float64
+	name   string
+	unary  struct {
+		op string
+		x  node
+	}
+	binary struct {
+		op   string
+		x, y node
+	}
+	// logical is "and" or "or", which skip y if x decides.
+	logical struct {
+		op   string
+		x, y node
+	}
+	call struct {
+		fn   string
+		args []node
+	}
+
+	function struct {
+		arity int
+		fn    func(args []float64) float64
+	}
+)
+
+var functions = map[string]function{
+	"abs": {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"min": {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max": {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"round": {2, func(a []float64) float64 {
+		p := math.Pow(10, a[1])
+		return math.Round(a[0]*p) / p
+	}},
+	"dewpoint": {2, dewPoint},
+}
+
+// Parse parses an expression of numbers, names, + - * /, parentheses and
+// the functions abs, min, max, round(x, digits) and dewpoint(celsius, rh).
+// Comparisons < <= > >= == != and the operators and, or and not evaluate
+// to 1 for true and 0 for false. Any other value than 0 is true. An
+// operand of and or or that needs a missing value is false, e.g. when a
+// sensor has not reported yet.
+func Parse(src string) (*Expr, error) {
+	p := &parser{src: src}
+	p.next()
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", src, err)
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("failed to parse %q: unexpected %q", src, p.tok)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (e *Expr) Eval(env Env) (float64, error) {
+	return e.root.eval(env)
+}
+
+// IsTrue evaluates a condition. A condition that needs a missing value is
+// false.
+func (e *Expr) IsTrue(env Env) (bool, error) {
+	v, err := e.root.eval(env)
+	if isMissing(err) {
+		return false, nil
+	}
+	return v != 0, err
+}
+
+// Vars returns the sorted names the expression depends on.
+func (e *Expr) Vars() []string {
+	set := map[string]bool{}
+	e.root.vars(set)
+	vs := make([]string, 0, len(set))
+	for v := range set {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	return vs
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+func (n number) eval(env Env) (float64, error) { return float64(n), nil }
+func (n number) vars(set map[string]bool)      {}
+
+// missingError tells that a name has no value.
+type missingError string
+
+func (e missingError) Error() string {
+	return fmt.Sprintf("no value for %v", string(e))
+}
+
+func isMissing(err error) bool {
+	_, ok := err.(missingError)
+	return ok
+}
+
+func (n name) eval(env Env) (float64, error) {
+	v, ok := env(string(n))
+	if !ok {
+		return 0, missingError(n)
+	}
+	return v, nil
+}
+func (n name) vars(set map[string]bool) { set[string(n)] = true }
+
+func (n unary) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if n.op == "not" {
+		return truth(x == 0), err
+	}
+	return -x, err
+}
+func (n unary) vars(set map[string]bool) { n.x.vars(set) }
+
+func (n binary) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "<":
+		return truth(x < y), nil
+	case "<=":
+		return truth(x <= y), nil
+	case ">":
+		return truth(x > y), nil
+	case ">=":
+		return truth(x >= y), nil
+	case "==":
+		return truth(x == y), nil
+	case "!=":
+		return truth(x != y), nil
+	}
+	return 0, fmt.Errorf("unknown operator %v", n.op)
+}
+func (n binary) vars(set map[string]bool) {
+	n.x.vars(set)
+	n.y.vars(set)
+}
+
+func (n logical) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if isMissing(err) {
+		x, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "and" && x == 0 || n.op == "or" && x != 0 {
+		return truth(x != 0), nil
+	}
+	y, err := n.y.eval(env)
+	if isMissing(err) {
+		y, err = 0, nil
+	}
+	return truth(y != 0), err
+}
+func (n logical) vars(set map[string]bool) {
+	n.x.vars(set)
+	n.y.vars(set)
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (n call) eval(env Env) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return functions[n.fn].fn(args), nil
+}
+func (n call) vars(set map[string]bool) {
+	for _, a := range n.args {
+		a.vars(set)
+	}
+}
+
+// dewPoint uses the Magnus formula.
+func dewPoint(a []float64) float64 {
+	const b, c = 17.62, 243.12
+	g := math.Log(a[1]/100) + b*a[0]/(c+a[0])
+	return c * g / (b - g)
+}
+
+type parser struct {
+	src string
+	pos int
+	tok string
+}
+
+// next advances to the next token, or "" at the end.
+func (p *parser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	start := p.pos
+	r := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(r) || r == '.':
+		for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+	case unicode.IsLetter(r) || r == '_':
+		for p.pos < len(p.src) && isNameChar(rune(p.src[p.pos])) {
+			p.pos++
+		}
+	case strings.ContainsRune("<>=!", r) && p.pos+1 < len(p.src) && p.src[p.pos+1] == '=':
+		p.pos += 2
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func (p *parser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("expected %q, got %q", tok, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+// parseOr parses disjunctions: and {"or" and}.
+func (p *parser) parseOr() (node, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "or" {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = logical{op: "or", x: x, y: y}
+	}
+	return x, nil
+}
+
+// parseAnd parses conjunctions: not {"and" not}.
+func (p *parser) parseAnd() (node, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "and" {
+		p.next()
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = logical{op: "and", x: x, y: y}
+	}
+	return x, nil
+}
+
+// parseNot parses negations: "not" not | comparison.
+func (p *parser) parseNot() (node, error) {
+	if p.tok != "not" {
+		return p.parseComparison()
+	}
+	p.next()
+	x, err := p.parseNot()
+	return unary{op: "not", x: x}, err
+}
+
+// parseComparison parses expr [("<" | "<=" | ">" | ">=" | "==" | "!=") expr].
+func (p *parser) parseComparison() (node, error) {
+	x, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.tok; op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		p.next()
+		y, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return binary{op: op, x: x, y: y}, nil
+	}
+	return x, nil
+}
+
+// parseExpr parses sums: term {("+" | "-") term}.
+func (p *parser) parseExpr() (node, error) {
+	x, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "+" || p.tok == "-" {
+		op := p.tok
+		p.next()
+		y, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// parseTerm parses products: factor {("*" | "/") factor}.
+func (p *parser) parseTerm() (node, error) {
+	x, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "*" || p.tok == "/" {
+		op := p.tok
+		p.next()
+		y, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// parseFactor parses numbers, names, calls, negations and parentheses.
+func (p *parser) parseFactor() (node, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case tok == "-":
+		p.next()
+		x, err := p.parseFactor()
+		return unary{op: "-", x: x}, err
+	case tok == "(":
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		return number(v), nil
+	case isNameChar(rune(tok[0])):
+		p.next()
+		if p.tok != "(" {
+			return name(tok), nil
+		}
+		return p.parseCall(tok)
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+func (p *parser) parseCall(fn string) (node, error) {
+	f, ok := functions[strings.ToLower(fn)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %v", fn)
+	}
+	p.next()
+	args := []node{}
+	for p.tok != ")" {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	p.next()
+	if len(args) != f.arity {
+		return nil, fmt.Errorf("%v takes %v arguments, got %v", fn, f.arity, len(args))
+	}
+	return call{fn: strings.ToLower(fn), args: args}, nil
+}
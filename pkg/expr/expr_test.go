@@ -0,0 +1,81 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+var values = map[string]float64{
+	"temp5m":            21.5,
+	"temp1m":            21.1,
+	"bathroom":          20,
+	"bathroom_humidity": 65,
+}
+
+func env(n string) (float64, bool) {
+	v, ok := values[n]
+	return v, ok
+}
+
+func TestEval(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want float64
+		vars []string
+	}{
+		{"1 + 2 * 3", 7, []string{}},
+		{"(1 + 2) * 3", 9, []string{}},
+		{"-2 - -3", 1, []string{}},
+		{"temp5m - temp1m", 0.4, []string{"temp1m", "temp5m"}},
+		{"abs(temp1m - temp5m)", 0.4, []string{"temp1m", "temp5m"}},
+		{"max(temp1m, temp5m) / 2", 10.75, []string{"temp1m", "temp5m"}},
+		{"round(dewpoint(bathroom, bathroom_humidity), 1)", 13.2, []string{"bathroom", "bathroom_humidity"}},
+		{"temp5m > temp1m", 1, []string{"temp1m", "temp5m"}},
+		{"temp5m - 1 >= temp1m", 0, []string{"temp1m", "temp5m"}},
+		{"1 + 1 == 2 and not 2 != 2", 1, []string{}},
+		{"bathroom < 5 or (bathroom_humidity <= 70 and bathroom >= 20)", 1, []string{"bathroom", "bathroom_humidity"}},
+		// The missing value is not needed.
+		{"temp1m > 0 or missing > 0", 1, []string{"missing", "temp1m"}},
+		{"temp1m < 0 and missing > 0", 0, []string{"missing", "temp1m"}},
+		// The missing value makes its operand false.
+		{"missing > 0 and temp1m > 0 or temp1m > 21", 1, []string{"missing", "temp1m"}},
+		{"temp1m > 0 and missing > 0", 0, []string{"missing", "temp1m"}},
+	} {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Parse(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, err := e.Eval(env)
+			if err != nil || math.Abs(have-tt.want) > 1e-9 {
+				t.Fatalf("Have %v, %v; want %v, nil", have, err, tt.want)
+			}
+			if vars := e.Vars(); !reflect.DeepEqual(vars, tt.vars) {
+				t.Fatalf("Have vars %v; want %v", vars, tt.vars)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, src := range []string{"", "1 +", "(1", "1 2", "foo(1)", "min(1)", "1 $ 2", "1 < 2 < 3", "1 and", "1 = 1"} {
+		t.Run(src, func(t *testing.T) {
+			if e, err := Parse(src); err == nil {
+				t.Fatalf("Have %v; want parse error", e)
+			}
+		})
+	}
+	e, _ := Parse("missing + 1")
+	if v, err := e.Eval(env); err == nil {
+		t.Fatalf("Have %v; want missing value error", v)
+	}
+	e, _ = Parse("missing > 0")
+	if ok, err := e.IsTrue(env); ok || err != nil {
+		t.Fatalf("Have %v, %v; want false, nil", ok, err)
+	}
+	e, _ = Parse("1 / (temp5m - temp5m)")
+	if v, err := e.Eval(env); err == nil {
+		t.Fatalf("Have %v; want division error", v)
+	}
+}
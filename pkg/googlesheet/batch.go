@@ -0,0 +1,366 @@
+package googlesheet
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batcher turns the many small reads and writes of the client into few
+// batch requests. All ranges ever read are fetched together, and the
+// result is cached. Writes are applied to the cache right away, and
+// coalesced until the next flush. Writes, appends and added tabs failing
+// while the sheet is unreachable are queued and replayed later.
+type batcher struct {
+	cfg Config
+	srv ServiceClient
+
+	lock      sync.Mutex
+	cache     map[string][][]interface{}
+	fetchedAt time.Time
+	known     []string
+	isKnown   map[string]bool
+	// bad ranges fail batches, so they are only read on their own.
+	bad     map[string]bool
+	pending []ValueRange
+	// queue is nil if no queue file is configured.
+	queue *queue
+}
+
+// The columns of a setting's range.
+var facetColumns = map[Facet]int{Want: 0, Sent: 1, Have: 2}
+
+func newBatcher(srv ServiceClient, cfg Config) *batcher {
+	b := &batcher{cfg: cfg, srv: srv,
+		cache:   map[string][][]interface{}{},
+		isKnown: map[string]bool{},
+		bad:     map[string]bool{}}
+	if cfg.QueueFile != "" {
+		q, err := newQueue(cfg.QueueFile)
+		if err != nil {
+			log.Printf("Failed to load queued sheet updates, dropping them: %v\n", err)
+		} else if !q.empty() {
+			log.Printf("Loaded %v queued sheet updates\n", len(q.entries))
+		}
+		b.queue = q
+	}
+	return b
+}
+
+func (b *batcher) read(ctx context.Context, rng string) ([][]interface{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.bad[rng] {
+		return b.readAlone(ctx, rng)
+	}
+	if !b.isKnown[rng] {
+		b.isKnown[rng] = true
+		b.known = append(b.known, rng)
+		b.fetchedAt = time.Time{}
+	}
+	if time.Since(b.fetchedAt) >= b.cfg.ReadCacheAge {
+		if err := b.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if b.bad[rng] {
+		return nil, fmt.Errorf("unable to read range %v", rng)
+	}
+	return b.cache[rng], nil
+}
+
+// fetch reads all known ranges in one request. If that fails permanently,
+// each range is read on its own to find the bad ones.
+func (b *batcher) fetch(ctx context.Context) error {
+	rngs := []string{}
+	for _, rng := range b.known {
+		if !b.bad[rng] {
+			rngs = append(rngs, rng)
+		}
+	}
+	vals, err := b.srv.BatchGet(ctx, b.cfg.SheetId, rngs)
+	if err == nil && len(vals) != len(rngs) {
+		err = fmt.Errorf("read %v of %v ranges", len(vals), len(rngs))
+	}
+	if err != nil && isTransient(err) {
+		return err
+	}
+	if err == nil {
+		for i, rng := range rngs {
+			b.cache[rng] = vals[i]
+		}
+	} else {
+		log.Printf("Batch read failed, reading %v ranges one by one: %v\n", len(rngs), err)
+		for _, rng := range rngs {
+			if _, err := b.readAlone(ctx, rng); err != nil {
+				log.Printf("Failed to read range %v: %v\n", rng, err)
+			}
+		}
+	}
+	// Unflushed writes are newer than what we just read.
+	if b.queue != nil {
+		for _, vr := range b.queue.writes() {
+			b.patch(vr.Range, vr.Values)
+		}
+	}
+	for _, vr := range b.pending {
+		b.patch(vr.Range, vr.Values)
+	}
+	b.fetchedAt = time.Now()
+	return nil
+}
+
+func (b *batcher) readAlone(ctx context.Context, rng string) ([][]interface{}, error) {
+	vals, err := b.srv.BatchGet(ctx, b.cfg.SheetId, []string{rng})
+	if err == nil && len(vals) != 1 {
+		err = fmt.Errorf("read %v ranges instead of %v", len(vals), rng)
+	}
+	if err != nil {
+		if !isTransient(err) {
+			b.bad[rng] = true
+			delete(b.cache, rng)
+		}
+		return nil, err
+	}
+	delete(b.bad, rng)
+	b.cache[rng] = vals[0]
+	return vals[0], nil
+}
+
+func (b *batcher) write(ctx context.Context, rng string, vals [][]interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.patch(rng, vals)
+	for i, vr := range b.pending {
+		if vr.Range == rng {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			break
+		}
+	}
+	b.pending = append(b.pending, ValueRange{Range: rng, Values: vals})
+	if b.cfg.WriteInterval <= 0 {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *batcher) append(ctx context.Context, rng string, vals [][]interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	vr := ValueRange{Range: rng, Values: vals}
+	if b.queue != nil && !b.queue.empty() {
+		// Still unreachable, stay behind the queued updates.
+		return b.queue.append(vr)
+	}
+	err := b.srv.Append(ctx, b.cfg.SheetId, rng, vals)
+	if err != nil && b.queue != nil && isTransient(err) {
+		log.Printf("Queueing append to %v: %v\n", rng, err)
+		return b.queue.append(vr)
+	}
+	return err
+}
+
+// addTab adds a tab behind the queued updates, so that the writes and
+// appends to the tab follow it.
+func (b *batcher) addTab(ctx context.Context, tab string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	if b.queue != nil && !b.queue.empty() {
+		return b.queue.addTab(tab)
+	}
+	err := b.srv.AddTabs(ctx, b.cfg.SheetId, []string{tab})
+	if err != nil && b.queue != nil && isTransient(err) {
+		log.Printf("Queueing adding tab %v: %v\n", tab, err)
+		return b.queue.addTab(tab)
+	}
+	return err
+}
+
+// queueReplayInterval is how often the queue is replayed if writes
+// are not coalesced.
+const queueReplayInterval = time.Minute
+
+func (b *batcher) flushForever(ctx context.Context) {
+	interval := b.cfg.WriteInterval
+	if interval <= 0 {
+		interval = queueReplayInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.lock.Lock()
+			if err := b.flush(ctx); err != nil {
+				log.Printf("Failed to write to sheet: %v\n", err)
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+// flush replays the queue and writes the pending values. If the sheet is
+// unreachable, they are queued. If the batch fails otherwise, the values
+// are written one by one, so that a bad range does not fail the others.
+// Deferred writes have returned to their writers already, so their failed
+// values stay pending and are written again with the next flush, unless
+// written anew before. Immediate writes return the error instead.
+func (b *batcher) flush(ctx context.Context) error {
+	replayErr := b.replay(ctx)
+	if len(b.pending) == 0 {
+		return nil
+	}
+	pending := b.pending
+	b.pending = nil
+	err := replayErr
+	if err == nil {
+		err = b.srv.BatchUpdate(ctx, b.cfg.SheetId, pending)
+	}
+	if err != nil && b.queue != nil && isTransient(err) {
+		log.Printf("Queueing %v writes: %v\n", len(pending), err)
+		for _, vr := range pending {
+			if err := b.queue.write(vr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+	// The cache has the failed values, so read the sheet again.
+	b.fetchedAt = time.Time{}
+	if replayErr == nil && !isTransient(err) && len(pending) > 1 {
+		log.Printf("Batch write failed, writing %v ranges one by one: %v\n", len(pending), err)
+		failed := []ValueRange{}
+		for _, vr := range pending {
+			if err := b.srv.BatchUpdate(ctx, b.cfg.SheetId, []ValueRange{vr}); err != nil {
+				log.Printf("Failed to write range %v: %v\n", vr.Range, err)
+				failed = append(failed, vr)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		pending = failed
+	}
+	if b.cfg.WriteInterval > 0 {
+		b.pending = pending
+	}
+	return err
+}
+
+// replay sends the queued updates in order, and stops at the first one
+// failing transiently. Updates failing otherwise would fail forever, so
+// they are dropped.
+func (b *batcher) replay(ctx context.Context) error {
+	if b.queue == nil {
+		return nil
+	}
+	for !b.queue.empty() {
+		head := b.queue.head()
+		var err error
+		switch {
+		case head[0].Append:
+			err = b.srv.Append(ctx, b.cfg.SheetId, head[0].Range, head[0].Values)
+		case head[0].AddTab:
+			err = b.replayAddTab(ctx, head[0].Range)
+		default:
+			vrs := []ValueRange{}
+			for _, e := range head {
+				vrs = append(vrs, e.ValueRange)
+			}
+			err = b.srv.BatchUpdate(ctx, b.cfg.SheetId, vrs)
+		}
+		if err != nil && isTransient(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Dropping %v queued updates: %v\n", len(head), err)
+		} else {
+			log.Printf("Replayed %v queued updates\n", len(head))
+		}
+		if err := b.queue.drop(len(head)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayAddTab adds a queued tab, unless the sheet already has it, e.g.
+// because the tabs of the sheet were unknown when it was queued.
+func (b *batcher) replayAddTab(ctx context.Context, tab string) error {
+	layout, err := b.srv.Layout(ctx, b.cfg.SheetId)
+	if err != nil {
+		return err
+	}
+	if toSet(layout.Tabs)[tab] {
+		return nil
+	}
+	return b.srv.AddTabs(ctx, b.cfg.SheetId, []string{tab})
+}
+
+// patch updates the cache of a range and of the ranges overlapping it,
+// i.e. the facets of a setting and the setting's range.
+func (b *batcher) patch(rng string, vals [][]interface{}) {
+	b.cache[rng] = vals
+	if len(vals) == 0 || len(vals[0]) == 0 {
+		return
+	}
+	if s, f, ok := splitFacetRange(rng); ok {
+		v := vals[0][0]
+		switch f {
+		case Want, Sent:
+			b.patchCell(string(s), facetColumns[f], v)
+		case Have:
+			b.patchCell(string(s), facetColumns[Have], v)
+			b.patchCell(facetRange(s, HaveWithDate), 0, v)
+		case HaveWithDate:
+			b.patchCell(string(s), facetColumns[Have], v)
+			b.patchCell(facetRange(s, Have), 0, v)
+		}
+		return
+	}
+	for f, col := range facetColumns {
+		if col < len(vals[0]) {
+			b.patchCell(facetRange(Setting(rng), f), 0, vals[0][col])
+		}
+	}
+	if col := facetColumns[Have]; col < len(vals[0]) {
+		b.patchCell(facetRange(Setting(rng), HaveWithDate), 0, vals[0][col])
+	}
+}
+
+// patchCell updates a cell of a cached range.
+func (b *batcher) patchCell(rng string, col int, v interface{}) {
+	vals, ok := b.cache[rng]
+	if !ok || len(vals) == 0 {
+		return
+	}
+	row := append([]interface{}{}, vals[0]...)
+	for len(row) <= col {
+		row = append(row, "")
+	}
+	row[col] = v
+	b.cache[rng] = append([][]interface{}{row}, vals[1:]...)
+}
+
+func splitFacetRange(rng string) (Setting, Facet, bool) {
+	for _, f := range []Facet{Want, Sent, Have, HaveWithDate} {
+		if suffix := fmt.Sprintf("_%v", f); strings.HasSuffix(rng, suffix) {
+			return Setting(strings.TrimSuffix(rng, suffix)), f, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,135 @@
+package googlesheet_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	gst "parren.ch/ultrasource/pkg/googlesheet/googlesheettest"
+)
+
+func TestBatchReadsKnownRangesTogether(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.SetRow("room_temp", "20", "20", "19")
+	c := gs.NewClient(ctx, sheet, gs.Config{ReadCacheAge: time.Hour})
+	for i := 0; i < 2; i++ {
+		mustReadSettingValues(t, c, gs.DesiredHeatingTemp)
+		mustReadFacetValue(t, c, gs.DesiredHeatingTemp, gs.Have)
+		if n := sheet.Calls(gst.OpBatchGet); n != 2 {
+			t.Fatalf("Have %v gets; want 2", n)
+		}
+	}
+}
+
+func TestBatchWritesPatchCache(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.SetRow("room_temp", "20", "20", "19")
+	sheet.SetRow("Log!A1", "Timestamp")
+	c := gs.NewClient(ctx, sheet, gs.Config{ReadCacheAge: time.Hour, WriteInterval: time.Hour})
+	mustReadSettingValues(t, c, gs.DesiredHeatingTemp)
+	mustReadFacetValue(t, c, gs.DesiredHeatingTemp, gs.Have)
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Have, Value: "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "21"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := sheet.Calls(gst.OpBatchUpdate); n != 0 {
+		t.Fatalf("Have %v updates; want 0", n)
+	}
+	want := gs.SettingValues{Setting: gs.DesiredHeatingTemp, Want: "20", Sent: "21", Have: "20"}
+	if have := mustReadSettingValues(t, c, gs.DesiredHeatingTemp); have != want {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	if err := c.AppendOverwritingRows(ctx, "Log!A2", [][]interface{}{{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := sheet.Calls(gst.OpBatchUpdate); n != 1 {
+		t.Fatalf("Have %v updates; want 1", n)
+	}
+	if err := sheet.CheckRowStart("room_temp", "20", "21", "20"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeferredWriteFailuresStayPending(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.SetRow("Log!A1", "Timestamp")
+	sheet.FailRange("room_temp_sent", &googleapi.Error{Code: http.StatusBadRequest})
+	c := gs.NewClient(ctx, sheet, gs.Config{WriteInterval: time.Hour})
+	for _, v := range []gs.FacetValue{
+		{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "21"},
+		{Setting: gs.DesiredWaterTemp, Facet: gs.Sent, Value: "50"},
+	} {
+		if err := c.WriteFacetValue(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Appending flushes the pending writes first.
+	if err := c.AppendOverwritingRows(ctx, "Log!A2", [][]interface{}{{"x"}}); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+	if err := sheet.CheckRowStart("water_temp_sent", "50"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart("room_temp_sent", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sheet.FailRange("room_temp_sent", nil)
+	if err := c.AppendOverwritingRows(ctx, "Log!A2", [][]interface{}{{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart("room_temp_sent", "21"); err != nil {
+		t.Fatalf("%v; want the failed write written later", err)
+	}
+}
+
+func TestReadFailuresAreReturned(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.SetRow("room_temp", "20")
+	c := gs.NewClient(ctx, sheet, gs.Config{})
+	want := gs.SettingValues{Setting: gs.DesiredHeatingTemp, Want: "20"}
+	if have := mustReadSettingValues(t, c, gs.DesiredHeatingTemp); have != want {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	failAll(sheet, &googleapi.Error{Code: http.StatusServiceUnavailable})
+	if _, err := c.ReadSettingValues(ctx, gs.DesiredHeatingTemp); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "21"}); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+}
+
+// failAll makes all calls of the sheet fail with err, or none if err is
+// nil, like a sheet that is unreachable.
+func failAll(sheet *gst.Sheet, err error) {
+	for _, op := range []gst.Op{gst.OpBatchGet, gst.OpBatchUpdate, gst.OpAppend, gst.OpLayout, gst.OpAddTabs,
+		gst.OpAddNamedRanges, gst.OpDeleteTabs} {
+		sheet.Fail(op, err)
+	}
+}
+
+func mustReadSettingValues(t *testing.T, c gs.Client, s gs.Setting) gs.SettingValues {
+	vs, err := c.ReadSettingValues(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func mustReadFacetValue(t *testing.T, c gs.Client, s gs.Setting, f gs.Facet) string {
+	v, err := c.ReadFacetValue(context.Background(), s, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,331 @@
+package googlesheet
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileService keeps a spreadsheet in a directory, for running without a
+// Google account. Each tab is a CSV file in the tabs directory, and the
+// named ranges are in a CSV file with the columns name and range, e.g.
+// water_temp and Settings!B2:D2. The files are read again when their size
+// or modification time changes, so they can be edited while the agent
+// runs, e.g. on a network share.
+type fileService struct {
+	dir string
+
+	lock sync.Mutex
+	mem  *memoryService
+	// files are the files as last read or written.
+	files map[string]fileState
+}
+
+// fileState tells whether a file changed.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+const (
+	fileTabsDir        = "tabs"
+	fileNamedRangesCsv = "named-ranges.csv"
+)
+
+// NewFileServiceClient returns a ServiceClient that keeps the sheet in
+// CSV files in dir. It resolves ranges like NewMemoryServiceClient.
+func NewFileServiceClient(dir string) (ServiceClient, error) {
+	if err := os.MkdirAll(filepath.Join(dir, fileTabsDir), 0o755); err != nil {
+		return nil, err
+	}
+	f := &fileService{dir: dir}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileService) BatchGet(ctx context.Context, sheetId string, rngs []string) ([][][]interface{}, error) {
+	var vals [][][]interface{}
+	err := f.do(func() error {
+		var err error
+		vals, err = f.mem.BatchGet(ctx, sheetId, rngs)
+		return err
+	})
+	return vals, err
+}
+
+func (f *fileService) BatchUpdate(ctx context.Context, sheetId string, data []ValueRange) error {
+	return f.do(func() error { return f.mem.BatchUpdate(ctx, sheetId, data) })
+}
+
+func (f *fileService) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) error {
+	return f.do(func() error { return f.mem.Append(ctx, sheetId, rng, vals) })
+}
+
+func (f *fileService) Layout(ctx context.Context, sheetId string) (Layout, error) {
+	var layout Layout
+	err := f.do(func() error {
+		var err error
+		layout, err = f.mem.Layout(ctx, sheetId)
+		return err
+	})
+	return layout, err
+}
+
+func (f *fileService) AddTabs(ctx context.Context, sheetId string, titles []string) error {
+	return f.do(func() error { return f.mem.AddTabs(ctx, sheetId, titles) })
+}
+
+func (f *fileService) AddNamedRanges(ctx context.Context, sheetId string, rngs []NamedRange) error {
+	return f.do(func() error { return f.mem.AddNamedRanges(ctx, sheetId, rngs) })
+}
+
+func (f *fileService) DeleteTabs(ctx context.Context, sheetId string, titles []string) error {
+	return f.do(func() error { return f.mem.DeleteTabs(ctx, sheetId, titles) })
+}
+
+// do reads the files again if they changed, calls the in-memory sheet,
+// and writes what it changed. Files edited during the call are read again
+// and the call is repeated, so that writing the changed tabs keeps the
+// edits.
+func (f *fileService) do(call func() error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.reloadIfChanged(); err != nil {
+		return err
+	}
+	err := call()
+	if changed, cerr := f.changed(); cerr != nil {
+		return cerr
+	} else if changed {
+		if err := f.reload(); err != nil {
+			return err
+		}
+		err = call()
+	}
+	if saveErr := f.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func (f *fileService) reloadIfChanged() error {
+	changed, err := f.changed()
+	if err != nil || !changed {
+		return err
+	}
+	return f.reload()
+}
+
+func (f *fileService) reload() error {
+	log.Printf("Reading sheet files in %v again\n", f.dir)
+	return f.load()
+}
+
+// load reads all files.
+func (f *fileService) load() error {
+	mem := newMemoryService()
+	files := map[string]fileState{}
+	entries, err := os.ReadDir(filepath.Join(f.dir, fileTabsDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".csv") {
+			continue
+		}
+		tab, err := url.PathUnescape(strings.TrimSuffix(e.Name(), ".csv"))
+		if err != nil {
+			return fmt.Errorf("bad tab file name %v: %v", e.Name(), err)
+		}
+		path := filepath.Join(f.dir, fileTabsDir, e.Name())
+		rows, state, err := readCsv(path)
+		if err != nil {
+			return err
+		}
+		mem.tabs[tab] = rows
+		files[path] = state
+	}
+	path := filepath.Join(f.dir, fileNamedRangesCsv)
+	rows, state, err := readCsv(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		files[path] = state
+	}
+	for i, row := range rows {
+		name, rng := cellString(row, 0), cellString(row, 1)
+		if i == 0 && name == "Name" {
+			continue
+		}
+		tab, cells, _ := strings.Cut(rng, "!")
+		a, ok := parseCells(cells)
+		if !ok || a.rows != 1 {
+			return fmt.Errorf("bad range %q of %v in %v", rng, name, path)
+		}
+		mem.named[name] = NamedRange{Name: name, Tab: unquoteTab(tab), Row: a.row, Col: a.col, Cols: a.cols}
+	}
+	mem.clean()
+	f.mem, f.files = mem, files
+	return nil
+}
+
+// changed tells whether files were added, removed, or written since they
+// were last read or written.
+func (f *fileService) changed() (bool, error) {
+	paths := []string{filepath.Join(f.dir, fileNamedRangesCsv)}
+	entries, err := os.ReadDir(filepath.Join(f.dir, fileTabsDir))
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".csv") {
+			paths = append(paths, filepath.Join(f.dir, fileTabsDir, e.Name()))
+		}
+	}
+	n := 0
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		n++
+		if state, ok := f.files[path]; !ok || state != newFileState(info) {
+			return true, nil
+		}
+	}
+	return n != len(f.files), nil
+}
+
+// save writes the changed tabs, and the named ranges if they changed.
+func (f *fileService) save() error {
+	tabs, named := f.mem.clean()
+	for _, tab := range tabs {
+		path := filepath.Join(f.dir, fileTabsDir, tabFileName(tab))
+		rows, ok := f.mem.tabs[tab]
+		if !ok {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(f.files, path)
+			continue
+		}
+		if err := f.writeCsv(path, rows); err != nil {
+			return err
+		}
+	}
+	if !named {
+		return nil
+	}
+	rows := [][]interface{}{{"Name", "Range"}}
+	for _, name := range sortedKeys(f.mem.named) {
+		r := f.mem.named[name]
+		rows = append(rows, []interface{}{name, tabRange(r.Tab, formatCells(r))})
+	}
+	return f.writeCsv(filepath.Join(f.dir, fileNamedRangesCsv), rows)
+}
+
+// writeCsv writes a file through a temporary one, so readers never see
+// half of it.
+func (f *fileService) writeCsv(path string, rows [][]interface{}) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	for _, row := range rows {
+		rec := []string{}
+		for i := range row {
+			rec = append(rec, cellString(row, i))
+		}
+		if err := w.Write(rec); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f.files[path] = newFileState(info)
+	return nil
+}
+
+func newFileState(info os.FileInfo) fileState {
+	return fileState{size: info.Size(), modTime: info.ModTime()}
+}
+
+func readCsv(path string) ([][]interface{}, fileState, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	recs, err := r.ReadAll()
+	if err != nil {
+		return nil, fileState{}, fmt.Errorf("%v: %v", path, err)
+	}
+	rows := [][]interface{}{}
+	for _, rec := range recs {
+		row := []interface{}{}
+		for _, v := range rec {
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, newFileState(info), nil
+}
+
+// tabFileName escapes the characters of a tab's title that are not
+// allowed in file names.
+func tabFileName(tab string) string {
+	r := strings.NewReplacer("%", "%25", "/", "%2F", "\\", "%5C", ":", "%3A")
+	return r.Replace(tab) + ".csv"
+}
+
+func cellString(row []interface{}, i int) string {
+	if i >= len(row) || row[i] == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", row[i])
+}
+
+func sortedKeys(named map[string]NamedRange) []string {
+	names := []string{}
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
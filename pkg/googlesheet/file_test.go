@@ -0,0 +1,115 @@
+package googlesheet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileServiceClientPersists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	srv, err := NewFileServiceClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(ctx, srv, Config{})
+	for _, fv := range []FacetValue{
+		{Setting: DesiredWaterTemp, Facet: Want, Value: "45"},
+		{Setting: DesiredWaterTemp, Facet: Sent, Value: "45>"},
+		{Setting: DesiredWaterTemp, Facet: Have, Value: "10"},
+	} {
+		if err := c.WriteFacetValue(ctx, fv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AppendLogRow(ctx, "Log", time.Date(2023, 3, 30, 8, 0, 0, 0, time.Local),
+		[]interface{}{"Timestamp", "temp"}, []interface{}{"2023-03-30 08:00:00", "21"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err = NewFileServiceClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewClient(ctx, srv, Config{})
+	want := SettingValues{Setting: DesiredWaterTemp, Want: "45", Sent: "45>", Have: "10"}
+	if have := mustReadSettingValues(t, c, DesiredWaterTemp); have != want {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	layout, err := srv.Layout(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Tabs) != 2 || layout.Tabs[1] != SettingsTab {
+		t.Fatalf("Have tabs %v; want a log tab and %v", layout.Tabs, SettingsTab)
+	}
+	vals, err := srv.BatchGet(ctx, "", []string{tabRange(layout.Tabs[0], "A1:B")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVals := [][][]interface{}{{{"Timestamp", "temp"}, {"2023-03-30 08:00:00", "21"}}}
+	if !reflect.DeepEqual(vals, wantVals) {
+		t.Fatalf("Have %v; want %v", vals, wantVals)
+	}
+}
+
+func TestFileServiceClientReadsEditedFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	srv, err := NewFileServiceClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(ctx, srv, Config{})
+	if err := c.WriteFacetValue(ctx, FacetValue{Setting: DesiredWaterTemp, Facet: Want, Value: "45"}); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := os.ReadFile(filepath.Join(dir, fileNamedRangesCsv)); err != nil || string(have) !=
+		"Name,Range\nwater_temp_want,'Settings'!B2:B2\n" {
+		t.Fatalf("Have %q, %v; want the range of water_temp_want", have, err)
+	}
+
+	path := filepath.Join(dir, fileTabsDir, "Settings.csv")
+	if err := os.WriteFile(path, []byte("Setting,Want\nwater_temp,50.5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if have := mustReadFacetValue(t, c, DesiredWaterTemp, Want); have != "50.5" {
+		t.Fatalf("Have %v; want 50.5", have)
+	}
+}
+
+func TestFileServiceClientKeepsEditsDuringWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	srv, err := NewFileServiceClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := srv.(*fileService)
+	if err := f.BatchUpdate(ctx, "", []ValueRange{{Range: "water_temp_want", Values: [][]interface{}{{"45"}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone edits the Want value while the Sent value is written.
+	path := filepath.Join(dir, fileTabsDir, "Settings.csv")
+	calls := 0
+	err = f.do(func() error {
+		calls++
+		if calls == 1 {
+			if err := os.WriteFile(path, []byte("Setting,Want\nwater_temp,50.5\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f.mem.BatchUpdate(ctx, "", []ValueRange{{Range: "water_temp_sent", Values: [][]interface{}{{"45>"}}}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := os.ReadFile(path); err != nil || string(have) != "Setting,Want\nwater_temp,50.5,45>\n" {
+		t.Fatalf("Have %q, %v; want the edited Want and the written Sent value", have, err)
+	}
+}
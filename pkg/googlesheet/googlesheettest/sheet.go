@@ -0,0 +1,307 @@
+// Package googlesheettest provides an in-memory googlesheet.ServiceClient
+// for tests of code using the googlesheet package.
+package googlesheettest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+type (
+	// Sheet is the in-memory sheet of gs.NewMemoryServiceClient, with
+	// failure injection and assertions. It resolves ranges, and defines
+	// unknown names, as described there. Set Strict to fail on unknown
+	// names instead. Values are kept as written, without the formatting
+	// of a real sheet.
+	Sheet struct {
+		Strict bool
+
+		srv     gs.ServiceClient
+		lock    sync.Mutex
+		appends []Append
+		fail    map[Op]error
+		failRng map[string]error
+		calls   map[Op]int
+	}
+
+	// Append is a call of Append.
+	Append struct {
+		Range  string
+		Values [][]interface{}
+	}
+
+	// Op is a method of the ServiceClient.
+	Op string
+)
+
+const (
+	OpBatchGet       Op = "BatchGet"
+	OpBatchUpdate    Op = "BatchUpdate"
+	OpAppend         Op = "Append"
+	OpLayout         Op = "Layout"
+	OpAddTabs        Op = "AddTabs"
+	OpAddNamedRanges Op = "AddNamedRanges"
+	OpDeleteTabs     Op = "DeleteTabs"
+)
+
+var _ gs.ServiceClient = (*Sheet)(nil)
+
+// New returns an empty sheet.
+func New() *Sheet {
+	return &Sheet{
+		srv:     gs.NewMemoryServiceClient(),
+		fail:    map[Op]error{},
+		failRng: map[string]error{},
+		calls:   map[Op]int{},
+	}
+}
+
+func (s *Sheet) BatchGet(ctx context.Context, sheetId string, rngs []string) ([][][]interface{}, error) {
+	if err := s.call(ctx, OpBatchGet, rngs...); err != nil {
+		return nil, err
+	}
+	return s.srv.BatchGet(ctx, sheetId, rngs)
+}
+
+func (s *Sheet) BatchUpdate(ctx context.Context, sheetId string, data []gs.ValueRange) error {
+	rngs := []string{}
+	for _, d := range data {
+		rngs = append(rngs, d.Range)
+	}
+	if err := s.call(ctx, OpBatchUpdate, rngs...); err != nil {
+		return err
+	}
+	return s.srv.BatchUpdate(ctx, sheetId, data)
+}
+
+// Append is recorded for Appends.
+func (s *Sheet) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) error {
+	if err := s.call(ctx, OpAppend, rng); err != nil {
+		return err
+	}
+	if err := s.srv.Append(ctx, sheetId, rng, vals); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.appends = append(s.appends, Append{Range: rng, Values: vals})
+	return nil
+}
+
+func (s *Sheet) Layout(ctx context.Context, sheetId string) (gs.Layout, error) {
+	if err := s.call(ctx, OpLayout); err != nil {
+		return gs.Layout{}, err
+	}
+	return s.srv.Layout(ctx, sheetId)
+}
+
+func (s *Sheet) AddTabs(ctx context.Context, sheetId string, titles []string) error {
+	if err := s.call(ctx, OpAddTabs); err != nil {
+		return err
+	}
+	return s.srv.AddTabs(ctx, sheetId, titles)
+}
+
+func (s *Sheet) AddNamedRanges(ctx context.Context, sheetId string, rngs []gs.NamedRange) error {
+	if err := s.call(ctx, OpAddNamedRanges); err != nil {
+		return err
+	}
+	return s.srv.AddNamedRanges(ctx, sheetId, rngs)
+}
+
+func (s *Sheet) DeleteTabs(ctx context.Context, sheetId string, titles []string) error {
+	if err := s.call(ctx, OpDeleteTabs); err != nil {
+		return err
+	}
+	return s.srv.DeleteTabs(ctx, sheetId, titles)
+}
+
+// Define adds named ranges, e.g. the ones of settings in another layout
+// than the one provisioning uses. Their tabs are added if missing. It
+// panics if a range exists already.
+func (s *Sheet) Define(rngs ...gs.NamedRange) {
+	ctx := context.Background()
+	for _, r := range rngs {
+		s.ensureTab(ctx, r.Tab)
+	}
+	if err := s.srv.AddNamedRanges(ctx, "", rngs); err != nil {
+		panic(err)
+	}
+}
+
+// Fail makes all later calls of op fail with err, until it is called
+// again with a nil err.
+func (s *Sheet) Fail(op Op, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		delete(s.fail, op)
+	} else {
+		s.fail[op] = err
+	}
+}
+
+// FailRange makes all later calls with rng fail with err, like a range
+// that cannot be parsed or no longer exists, until it is called again
+// with a nil err.
+func (s *Sheet) FailRange(rng string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		delete(s.failRng, rng)
+	} else {
+		s.failRng[rng] = err
+	}
+}
+
+// Calls returns how often op was called, including failed calls.
+func (s *Sheet) Calls(op Op) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[op]
+}
+
+// Set writes values to a range, like a user editing the sheet. Tabs are
+// added if missing. It panics if rng is invalid or too small.
+func (s *Sheet) Set(rng string, vals [][]interface{}) {
+	ctx := context.Background()
+	if tab, _, ok := strings.Cut(rng, "!"); ok {
+		s.ensureTab(ctx, unquote(tab))
+	}
+	if err := s.checkNames(ctx, rng); err != nil {
+		panic(err)
+	}
+	if err := s.srv.BatchUpdate(ctx, "", []gs.ValueRange{{Range: rng, Values: vals}}); err != nil {
+		panic(err)
+	}
+}
+
+// SetRow writes a row of values to a range, see Set.
+func (s *Sheet) SetRow(rng string, vals ...interface{}) {
+	s.Set(rng, [][]interface{}{vals})
+}
+
+// Get returns the values of a range, as BatchGet does. It panics if rng
+// is invalid.
+func (s *Sheet) Get(rng string) [][]interface{} {
+	ctx := context.Background()
+	if err := s.checkNames(ctx, rng); err != nil {
+		panic(err)
+	}
+	vals, err := s.srv.BatchGet(ctx, "", []string{rng})
+	if err != nil {
+		panic(err)
+	}
+	return vals[0]
+}
+
+// Appends returns the calls of Append in order.
+func (s *Sheet) Appends() []Append {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Append{}, s.appends...)
+}
+
+// CheckRowStart checks the first cells of the first row of a range. Empty
+// cells are "". Values are compared in their %v formatting.
+func (s *Sheet) CheckRowStart(rng string, want ...interface{}) error {
+	vals := s.Get(rng)
+	row := []interface{}{}
+	if len(vals) > 0 {
+		row = vals[0]
+	}
+	for i, w := range want {
+		if have := cell(row, i); have != fmt.Sprintf("%v", w) {
+			return fmt.Errorf("%v should start with %v, is %v", rng, want, row)
+		}
+	}
+	return nil
+}
+
+// CheckLastAppend checks a cell of the last appended row.
+func (s *Sheet) CheckLastAppend(col int, want interface{}) error {
+	appends := s.Appends()
+	if len(appends) == 0 {
+		return fmt.Errorf("expected %v at %v, but nothing was appended", want, col)
+	}
+	vals := appends[len(appends)-1].Values
+	row := vals[len(vals)-1]
+	if have := cell(row, col); have != fmt.Sprintf("%v", want) {
+		return fmt.Errorf("expected %v at %v, but got %v in %v", want, col, have, row)
+	}
+	return nil
+}
+
+// call counts a call of op, and returns the error injected for it or for
+// one of its ranges.
+func (s *Sheet) call(ctx context.Context, op Op, rngs ...string) error {
+	s.lock.Lock()
+	s.calls[op]++
+	err := s.fail[op]
+	for _, rng := range rngs {
+		if err == nil {
+			err = s.failRng[rng]
+		}
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.checkNames(ctx, rngs...)
+}
+
+// checkNames fails on unknown names if the sheet is strict.
+func (s *Sheet) checkNames(ctx context.Context, rngs ...string) error {
+	if !s.Strict {
+		return nil
+	}
+	layout, err := s.srv.Layout(ctx, "")
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, n := range append(layout.Tabs, layout.NamedRanges...) {
+		known[n] = true
+	}
+	for _, rng := range rngs {
+		if !strings.Contains(rng, "!") && !known[unquote(rng)] {
+			return &googleapi.Error{Code: http.StatusBadRequest, Message: "unable to parse range: " + rng}
+		}
+	}
+	return nil
+}
+
+func (s *Sheet) ensureTab(ctx context.Context, tab string) {
+	layout, err := s.srv.Layout(ctx, "")
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range layout.Tabs {
+		if t == tab {
+			return
+		}
+	}
+	if err := s.srv.AddTabs(ctx, "", []string{tab}); err != nil {
+		panic(err)
+	}
+}
+
+func unquote(tab string) string {
+	if len(tab) >= 2 && strings.HasPrefix(tab, "'") && strings.HasSuffix(tab, "'") {
+		return strings.ReplaceAll(tab[1:len(tab)-1], "''", "'")
+	}
+	return tab
+}
+
+func cell(row []interface{}, i int) string {
+	if i >= len(row) {
+		return ""
+	}
+	return fmt.Sprintf("%v", row[i])
+}
@@ -0,0 +1,140 @@
+package googlesheettest
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+)
+
+func TestSettingsAreDefinedOnFirstWrite(t *testing.T) {
+	ctx := context.Background()
+	sheet := New()
+	c := gs.NewClient(ctx, sheet, gs.Config{})
+	sheet.SetRow("water_temp", "45", "45>", "10")
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredWaterTemp, Facet: gs.Sent, Value: "45"}); err != nil {
+		t.Fatal(err)
+	}
+	vs, err := c.ReadSettingValues(ctx, gs.DesiredWaterTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (gs.SettingValues{Setting: gs.DesiredWaterTemp, Want: "45", Sent: "45", Have: "10"}); vs != want {
+		t.Fatalf("Have %v; want %v", vs, want)
+	}
+	if err := sheet.CheckRowStart("Settings!A2:E2", "water_temp", "45", "45", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart("water_temp_dated", "10"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictFailsOnUnknownNames(t *testing.T) {
+	ctx := context.Background()
+	sheet := New()
+	sheet.Strict = true
+	if _, err := sheet.BatchGet(ctx, "", []string{"water_temp"}); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+	req := gs.Requirements{}
+	req.RequireValues(gs.DesiredWaterTemp, gs.Want)
+	if _, err := gs.Provision(ctx, sheet, gs.Config{}, req, true); err != nil {
+		t.Fatal(err)
+	}
+	sheet.SetRow("water_temp_want", "45")
+	if err := sheet.CheckRowStart("water_temp", "45"); err != nil {
+		t.Fatal(err)
+	}
+	layout, err := sheet.Layout(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gs.Layout{Tabs: []string{gs.SettingsTab}, NamedRanges: []string{"water_temp", "water_temp_want"}}
+	if !reflect.DeepEqual(layout, want) {
+		t.Fatalf("Have %v; want %v", layout, want)
+	}
+}
+
+func TestRangesInA1Notation(t *testing.T) {
+	ctx := context.Background()
+	sheet := New()
+	sheet.SetRow("'It''s'!B2:D2", "a", "b", "")
+	sheet.SetRow("'It''s'!B4", "c")
+	vals, err := sheet.BatchGet(ctx, "", []string{"'It''s'!A1:D", "'It''s'!C2", "'It''s'!E1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][][]interface{}{
+		{{}, {"", "a", "b"}, {}, {"", "c"}},
+		{{"b"}},
+		nil,
+	}
+	if !reflect.DeepEqual(vals, want) {
+		t.Fatalf("Have %v; want %v", vals, want)
+	}
+	err = sheet.BatchUpdate(ctx, "", []gs.ValueRange{{Range: "'It''s'!B2:C2", Values: [][]interface{}{{"x", "y", "z"}}}})
+	if err == nil {
+		t.Fatal("Have no error; want one")
+	}
+	if _, err := sheet.BatchGet(ctx, "", []string{"Missing!A1"}); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+}
+
+func TestAppendBelowUsedRows(t *testing.T) {
+	ctx := context.Background()
+	sheet := New()
+	if err := sheet.AddTabs(ctx, "", []string{"Log"}); err != nil {
+		t.Fatal(err)
+	}
+	sheet.SetRow("Log!A1", "Timestamp", "temp")
+	for _, v := range []string{"20", "21"} {
+		if err := sheet.Append(ctx, "", "Log!A1", [][]interface{}{{"now", v}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]interface{}{{"Timestamp", "temp"}, {"now", "20"}, {"now", "21"}}
+	if have := sheet.Get("Log"); !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	if have := len(sheet.Appends()); have != 2 {
+		t.Fatalf("Have %v appends; want 2", have)
+	}
+	if err := sheet.CheckLastAppend(1, "21"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckLastAppend(1, "20"); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+}
+
+func TestFailureInjection(t *testing.T) {
+	ctx := context.Background()
+	sheet := New()
+	c := gs.NewClient(ctx, sheet, gs.Config{})
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	sheet.Fail(OpBatchGet, unavailable)
+	if _, err := c.ReadSettingValues(ctx, gs.DesiredWaterTemp); err != unavailable {
+		t.Fatalf("Have %v; want %v", err, unavailable)
+	}
+	sheet.Fail(OpBatchGet, nil)
+	if _, err := c.ReadSettingValues(ctx, gs.DesiredWaterTemp); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad range is read on its own, and does not fail the others.
+	sheet.FailRange("room_temp", &googleapi.Error{Code: http.StatusBadRequest})
+	if _, err := c.ReadSettingValues(ctx, gs.DesiredHeatingTemp); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+	if _, err := c.ReadSettingValues(ctx, gs.DesiredWaterTemp); err != nil {
+		t.Fatal(err)
+	}
+	if have := sheet.Calls(OpBatchGet); have != 6 {
+		t.Fatalf("Have %v gets; want 6", have)
+	}
+}
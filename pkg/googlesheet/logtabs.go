@@ -0,0 +1,113 @@
+package googlesheet
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AppendLogRow appends a row to the log tab of the month of t and of the
+// header, like logfiles uses a file per day and header. The tab is added
+// with the header as its first row when the first row of the month is
+// logged, or when the header changed. While the sheet is unreachable,
+// adding the tab is queued like the rows. Beyond MaxLogTabs tabs of the
+// same log, the oldest are deleted.
+func (c *clientImpl) AppendLogRow(ctx context.Context, name string, t time.Time, header, row []interface{}) error {
+	tab := logTabTitle(name, t, header)
+	if err := c.ensureLogTab(ctx, name, tab, header); err != nil {
+		return err
+	}
+	return c.AppendOverwritingRows(ctx, tabRange(tab, "A1"), [][]interface{}{row})
+}
+
+func (c *clientImpl) ensureLogTab(ctx context.Context, logName, tab string, header []interface{}) error {
+	c.tabsLock.Lock()
+	defer c.tabsLock.Unlock()
+	if !c.tabsRead {
+		layout, err := c.srv.Layout(ctx, c.cfg.SheetId)
+		switch {
+		case err == nil:
+			for _, t := range layout.Tabs {
+				c.tabs[t] = true
+			}
+			c.tabsRead = true
+		case !isTransient(err) || c.batch.queue == nil:
+			return err
+		default:
+			// Replaying skips the tab if the sheet has it.
+			log.Printf("Failed to read tabs, assuming %v is missing: %v\n", tab, err)
+		}
+	}
+	if c.tabs[tab] {
+		return nil
+	}
+	log.Printf("Adding log tab %v\n", tab)
+	if err := c.batch.addTab(ctx, tab); err != nil {
+		return err
+	}
+	c.tabs[tab] = true
+	if err := c.Write(ctx, tabRange(tab, "A1"), [][]interface{}{header}); err != nil {
+		return err
+	}
+	if err := c.pruneLogTabs(ctx, logName); err != nil {
+		// Tried again with the next new tab.
+		log.Printf("Failed to delete old log tabs: %v\n", err)
+	}
+	return nil
+}
+
+// pruneLogTabs deletes the oldest tabs of a log beyond MaxLogTabs.
+func (c *clientImpl) pruneLogTabs(ctx context.Context, logName string) error {
+	if c.cfg.MaxLogTabs <= 0 || !c.tabsRead {
+		return nil
+	}
+	tabs := []string{}
+	for tab := range c.tabs {
+		if isLogTab(logName, tab) {
+			tabs = append(tabs, tab)
+		}
+	}
+	if len(tabs) <= c.cfg.MaxLogTabs {
+		return nil
+	}
+	// Titles start with the month, so they sort from old to new.
+	sort.Strings(tabs)
+	old := tabs[:len(tabs)-c.cfg.MaxLogTabs]
+	log.Printf("Deleting old log tabs %v\n", old)
+	if err := c.srv.DeleteTabs(ctx, c.cfg.SheetId, old); err != nil {
+		return err
+	}
+	for _, tab := range old {
+		delete(c.tabs, tab)
+	}
+	return nil
+}
+
+// logTabSuffix matches the month and hash of logTabTitle.
+var logTabSuffix = regexp.MustCompile(`^\d{4}-\d{2} [0-9a-f]{8}$`)
+
+// logTabTitle returns e.g. "Log 2023-03 1a2b3c4d".
+func logTabTitle(name string, t time.Time, header []interface{}) string {
+	h := fnv.New32()
+	for _, v := range header {
+		fmt.Fprintf(h, "%v,", v)
+	}
+	return fmt.Sprintf("%v %04d-%02d %08x", name, t.Year(), t.Month(), h.Sum32())
+}
+
+// isLogTab tells whether a tab has a title of logTabTitle, so that tabs
+// like "Log notes" are kept.
+func isLogTab(name, tab string) bool {
+	return strings.HasPrefix(tab, name+" ") && logTabSuffix.MatchString(strings.TrimPrefix(tab, name+" "))
+}
+
+// tabRange returns the A1 notation of cells of a tab, quoting the tab's
+// title as it may contain spaces.
+func tabRange(tab, cells string) string {
+	return fmt.Sprintf("'%v'!%v", strings.ReplaceAll(tab, "'", "''"), cells)
+}
@@ -0,0 +1,104 @@
+package googlesheet_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	gst "parren.ch/ultrasource/pkg/googlesheet/googlesheettest"
+)
+
+func TestAppendLogRowRotatesTabs(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	// Tabs of the user that start like the log's tabs.
+	sheet.SetRow("'Log archive'!A1", "x")
+	sheet.SetRow("'Log notes 2023'!A1", "x")
+	c := gs.NewClient(ctx, sheet, gs.Config{MaxLogTabs: 2})
+
+	h1 := []interface{}{"Timestamp", "Temp"}
+	h2 := []interface{}{"Timestamp", "Temp", "Prog"}
+	t1 := time.Date(2023, 3, 30, 8, 10, 20, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t1.Add(time.Hour * 24 * 5)
+
+	for _, l := range []struct {
+		t      time.Time
+		header []interface{}
+	}{{t1, h1}, {t2, h1}, {t2, h2}, {t3, h2}} {
+		if err := c.AppendLogRow(ctx, "Log", l.t, l.header, []interface{}{l.t}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The tab of March with h1 was deleted, the user's tabs were kept.
+	tabs := mustLayout(t, sheet).Tabs
+	if len(tabs) != 4 || !strings.HasPrefix(tabs[0], "Log 2023-03 ") || !strings.HasPrefix(tabs[1], "Log 2023-04 ") ||
+		tabs[2] != "Log archive" || tabs[3] != "Log notes 2023" {
+		t.Fatalf("Have %v; want the tabs of March and April, and the user's tabs", tabs)
+	}
+	tabs = tabs[:2]
+	for _, tab := range tabs {
+		vals := sheet.Get(tabRange(tab, "A1:C"))
+		if len(vals) != 2 || !reflect.DeepEqual(vals[0], h2) {
+			t.Fatalf("Have %v in %v; want header %v and a row", vals, tab, h2)
+		}
+	}
+	if n := len(sheet.Appends()); n != 4 {
+		t.Fatalf("Have %v appends; want 4", n)
+	}
+}
+
+func TestAppendLogRowQueuesNewTab(t *testing.T) {
+	ctx := context.Background()
+	cfg := gs.Config{QueueFile: filepath.Join(t.TempDir(), "queue.json")}
+	sheet := gst.New()
+	failAll(sheet, &googleapi.Error{Code: http.StatusServiceUnavailable})
+	c := gs.NewClient(ctx, sheet, cfg)
+
+	h := []interface{}{"Timestamp", "Temp"}
+	t1 := time.Date(2023, 3, 30, 8, 10, 20, 0, time.UTC)
+	for _, at := range []time.Time{t1, t1.Add(time.Hour)} {
+		if err := c.AppendLogRow(ctx, "Log", at, h, []interface{}{"20"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if appends := sheet.Appends(); len(appends) != 0 {
+		t.Fatalf("Have %v; want no appends while offline", appends)
+	}
+
+	failAll(sheet, nil)
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredWaterTemp, Facet: gs.Sent, Value: "50"}); err != nil {
+		t.Fatal(err)
+	}
+	tabs := mustLayout(t, sheet).Tabs
+	if len(tabs) != 2 || !strings.HasPrefix(tabs[0], "Log 2023-03 ") || tabs[1] != gs.SettingsTab {
+		t.Fatalf("Have %v; want the tab of March and %v", tabs, gs.SettingsTab)
+	}
+	want := [][]interface{}{h, {"20"}, {"20"}}
+	if have := sheet.Get(tabRange(tabs[0], "A1:B")); !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	if err := sheet.CheckRowStart("water_temp_sent", "50"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustLayout(t *testing.T, sheet *gst.Sheet) gs.Layout {
+	layout, err := sheet.Layout(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func tabRange(tab, cells string) string {
+	return fmt.Sprintf("'%v'!%v", strings.ReplaceAll(tab, "'", "''"), cells)
+}
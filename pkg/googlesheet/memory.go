@@ -0,0 +1,398 @@
+package googlesheet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+)
+
+type (
+	// memoryService keeps a spreadsheet in memory, see
+	// NewMemoryServiceClient.
+	memoryService struct {
+		lock  sync.Mutex
+		tabs  map[string][][]interface{}
+		named map[string]NamedRange
+		// maxRows limits the rows of each tab by dropping the oldest rows
+		// below the first one on appends. Zero keeps all rows.
+		maxRows int
+		// dirty are the tabs changed since the last call of clean, and
+		// dirtyNamed whether the named ranges changed.
+		dirty      map[string]bool
+		dirtyNamed bool
+	}
+
+	// area is a rectangle of cells. Negative rows or cols extend to the
+	// end of the tab. Writes to an anchor, a single cell in A1 notation,
+	// start there and may extend beyond it.
+	area struct {
+		tab        string
+		row, col   int
+		rows, cols int
+		anchor     bool
+	}
+)
+
+// maxMemoryTabRows limits the rows appended to each tab.
+const maxMemoryTabRows = 1000
+
+// NewMemoryServiceClient returns a ServiceClient that keeps all values in
+// memory, for running without a sheet. They are lost when the agent stops.
+// It resolves named ranges and ranges in A1 notation, e.g.
+// 'Log 2023-03'!A2:C, to the cells of its tabs. Like a real sheet, reads
+// omit trailing empty cells and rows.
+//
+// Unknown names are defined as settings when first written, in the
+// setting's row of the settings tab, as if the sheet had been provisioned.
+// Until then, they read as empty.
+func NewMemoryServiceClient() ServiceClient {
+	m := newMemoryService()
+	m.maxRows = maxMemoryTabRows
+	return m
+}
+
+func newMemoryService() *memoryService {
+	return &memoryService{
+		tabs:  map[string][][]interface{}{},
+		named: map[string]NamedRange{},
+		dirty: map[string]bool{},
+	}
+}
+
+func (m *memoryService) BatchGet(ctx context.Context, sheetId string, rngs []string) ([][][]interface{}, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	vals := [][][]interface{}{}
+	for _, rng := range rngs {
+		a, ok, err := m.resolve(rng, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			vals = append(vals, nil)
+			continue
+		}
+		vals = append(vals, m.read(a))
+	}
+	return vals, nil
+}
+
+func (m *memoryService) BatchUpdate(ctx context.Context, sheetId string, data []ValueRange) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// Like a real sheet, apply all of the batch or nothing.
+	areas := []area{}
+	for _, d := range data {
+		a, _, err := m.resolve(d.Range, true)
+		if err != nil {
+			return err
+		}
+		if err := a.check(d.Values); err != nil {
+			return badRequest("%v: %v", d.Range, err)
+		}
+		areas = append(areas, a)
+	}
+	for i, a := range areas {
+		m.write(a, data[i].Values)
+	}
+	return nil
+}
+
+// Append writes the values to the rows below the last used row of the tab
+// of rng, starting in the column of rng.
+func (m *memoryService) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	a, _, err := m.resolve(rng, true)
+	if err != nil {
+		return err
+	}
+	m.write(area{tab: a.tab, row: len(trimRows(m.tabs[a.tab])), col: a.col, rows: -1, cols: -1}, vals)
+	if grid := m.tabs[a.tab]; m.maxRows > 0 && len(grid) > m.maxRows {
+		m.tabs[a.tab] = append(grid[:1], grid[len(grid)-m.maxRows+1:]...)
+	}
+	return nil
+}
+
+func (m *memoryService) Layout(ctx context.Context, sheetId string) (Layout, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	layout := Layout{}
+	for tab := range m.tabs {
+		layout.Tabs = append(layout.Tabs, tab)
+	}
+	for name := range m.named {
+		layout.NamedRanges = append(layout.NamedRanges, name)
+	}
+	sort.Strings(layout.Tabs)
+	sort.Strings(layout.NamedRanges)
+	return layout, nil
+}
+
+func (m *memoryService) AddTabs(ctx context.Context, sheetId string, titles []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, t := range titles {
+		if _, ok := m.tabs[t]; ok {
+			return badRequest("a tab named %q already exists", t)
+		}
+	}
+	for _, t := range titles {
+		m.tabs[t] = [][]interface{}{}
+		m.dirty[t] = true
+	}
+	return nil
+}
+
+func (m *memoryService) AddNamedRanges(ctx context.Context, sheetId string, rngs []NamedRange) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range rngs {
+		if _, ok := m.tabs[r.Tab]; !ok {
+			return badRequest("no tab named %q for range %v", r.Tab, r.Name)
+		}
+		if _, ok := m.named[r.Name]; ok {
+			return badRequest("a range named %q already exists", r.Name)
+		}
+	}
+	for _, r := range rngs {
+		m.named[r.Name] = r
+		m.dirtyNamed = true
+	}
+	return nil
+}
+
+func (m *memoryService) DeleteTabs(ctx context.Context, sheetId string, titles []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, t := range titles {
+		if _, ok := m.tabs[t]; !ok {
+			return badRequest("no tab named %q", t)
+		}
+	}
+	for _, t := range titles {
+		delete(m.tabs, t)
+		m.dirty[t] = true
+		for name, r := range m.named {
+			if r.Tab == t {
+				delete(m.named, name)
+				m.dirtyNamed = true
+			}
+		}
+	}
+	return nil
+}
+
+// clean returns the tabs changed since the last call, and whether the
+// named ranges changed.
+func (m *memoryService) clean() ([]string, bool) {
+	tabs := []string{}
+	for t := range m.dirty {
+		tabs = append(tabs, t)
+	}
+	named := m.dirtyNamed
+	m.dirty, m.dirtyNamed = map[string]bool{}, false
+	return tabs, named
+}
+
+// resolve returns the cells of a named range, of a tab, or of a range in
+// A1 notation. Unknown names are settings, which are defined if define is
+// set. Otherwise, ok is false unless the setting has a row already.
+func (m *memoryService) resolve(rng string, define bool) (a area, ok bool, err error) {
+	if !strings.Contains(rng, "!") {
+		if _, ok := m.tabs[unquoteTab(rng)]; ok {
+			return area{tab: unquoteTab(rng), rows: -1, cols: -1}, true, nil
+		}
+		r, ok := m.named[rng]
+		if !ok && define {
+			r, ok = m.defineSetting(rng), true
+		} else if !ok {
+			r, ok = m.settingRange(rng)
+		}
+		return area{tab: r.Tab, row: r.Row, col: r.Col, rows: 1, cols: r.Cols}, ok, nil
+	}
+	tab, cells, _ := strings.Cut(rng, "!")
+	tab = unquoteTab(tab)
+	if _, ok := m.tabs[tab]; !ok {
+		return area{}, false, badRequest("unable to parse range: %v", rng)
+	}
+	a, ok = parseCells(cells)
+	if !ok {
+		return area{}, false, badRequest("unable to parse range: %v", rng)
+	}
+	a.tab = tab
+	return a, true, nil
+}
+
+// settingRange returns the range of a setting or one of its facets, if
+// the setting has a row in the settings tab.
+func (m *memoryService) settingRange(name string) (NamedRange, bool) {
+	s, _ := SettingNamedRange(name, 0)
+	for i, r := range m.tabs[SettingsTab] {
+		if len(r) > 0 && fmt.Sprintf("%v", r[0]) == string(s) {
+			_, nr := SettingNamedRange(name, i)
+			return nr, true
+		}
+	}
+	return NamedRange{}, false
+}
+
+// defineSetting adds the named range of a setting or one of its facets,
+// in the setting's row of the settings tab. Missing rows are added below
+// the used ones.
+func (m *memoryService) defineSetting(name string) NamedRange {
+	r, ok := m.settingRange(name)
+	if !ok {
+		s, _ := SettingNamedRange(name, 0)
+		row := len(trimRows(m.tabs[SettingsTab]))
+		if row == 0 {
+			m.write(area{tab: SettingsTab, rows: -1, cols: -1}, [][]interface{}{settingsHeader})
+			row++
+		}
+		m.write(area{tab: SettingsTab, row: row, rows: -1, cols: -1}, [][]interface{}{{string(s)}})
+		_, r = SettingNamedRange(name, row)
+	}
+	m.named[name] = r
+	m.dirtyNamed = true
+	return r
+}
+
+func (m *memoryService) read(a area) [][]interface{} {
+	grid := m.tabs[a.tab]
+	vals := [][]interface{}{}
+	for i := a.row; i < len(grid) && (a.rows < 0 || i < a.row+a.rows); i++ {
+		row := []interface{}{}
+		for j := a.col; j < len(grid[i]) && (a.cols < 0 || j < a.col+a.cols); j++ {
+			row = append(row, grid[i][j])
+		}
+		vals = append(vals, trimCells(row))
+	}
+	vals = trimRows(vals)
+	if len(vals) == 0 {
+		return nil
+	}
+	return vals
+}
+
+func (m *memoryService) write(a area, vals [][]interface{}) {
+	grid := m.tabs[a.tab]
+	for i, vs := range vals {
+		for len(grid) <= a.row+i {
+			grid = append(grid, []interface{}{})
+		}
+		row := grid[a.row+i]
+		for len(row) < a.col+len(vs) {
+			row = append(row, "")
+		}
+		copy(row[a.col:], vs)
+		grid[a.row+i] = row
+	}
+	m.tabs[a.tab] = grid
+	m.dirty[a.tab] = true
+}
+
+// check fails if the values do not fit into the area.
+func (a area) check(vals [][]interface{}) error {
+	if a.anchor {
+		return nil
+	}
+	if a.rows >= 0 && len(vals) > a.rows {
+		return fmt.Errorf("%v rows do not fit into %v", len(vals), a.rows)
+	}
+	for _, row := range vals {
+		if a.cols >= 0 && len(row) > a.cols {
+			return fmt.Errorf("%v columns do not fit into %v", len(row), a.cols)
+		}
+	}
+	return nil
+}
+
+// parseCells parses e.g. A2, A2:C, F2:G2 or A:A.
+func parseCells(cells string) (area, bool) {
+	from, to, isRange := strings.Cut(cells, ":")
+	row, col, hasRow, ok := parseCell(from)
+	if !ok {
+		return area{}, false
+	}
+	if !isRange {
+		if !hasRow {
+			return area{}, false
+		}
+		return area{row: row, col: col, rows: 1, cols: 1, anchor: true}, true
+	}
+	toRow, toCol, toHasRow, ok := parseCell(to)
+	if !ok || toCol < col || hasRow && toHasRow && toRow < row {
+		return area{}, false
+	}
+	a := area{row: row, col: col, rows: -1, cols: toCol - col + 1}
+	if toHasRow {
+		a.rows = toRow - row + 1
+	}
+	return a, true
+}
+
+// parseCell parses e.g. C2, or C for a whole column.
+func parseCell(c string) (row, col int, hasRow, ok bool) {
+	i := 0
+	for i < len(c) && c[i] >= 'A' && c[i] <= 'Z' {
+		col = col*26 + int(c[i]-'A'+1)
+		i++
+	}
+	if i == 0 {
+		return 0, 0, false, false
+	}
+	if i == len(c) {
+		return 0, col - 1, false, true
+	}
+	n, err := strconv.Atoi(c[i:])
+	if err != nil || n < 1 {
+		return 0, 0, false, false
+	}
+	return n - 1, col - 1, true, true
+}
+
+// formatCells returns the A1 notation of a named range, e.g. B2:D2.
+func formatCells(r NamedRange) string {
+	return fmt.Sprintf("%v%v:%v%v", columnName(r.Col), r.Row+1, columnName(r.Col+r.Cols-1), r.Row+1)
+}
+
+// columnName returns e.g. A for 0 and AA for 26.
+func columnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// unquoteTab undoes the quoting of tabRange.
+func unquoteTab(tab string) string {
+	if len(tab) >= 2 && strings.HasPrefix(tab, "'") && strings.HasSuffix(tab, "'") {
+		return strings.ReplaceAll(tab[1:len(tab)-1], "''", "'")
+	}
+	return tab
+}
+
+func trimCells(row []interface{}) []interface{} {
+	for len(row) > 0 && (row[len(row)-1] == nil || row[len(row)-1] == "") {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+func trimRows(rows [][]interface{}) [][]interface{} {
+	for len(rows) > 0 && len(trimCells(rows[len(rows)-1])) == 0 {
+		rows = rows[:len(rows)-1]
+	}
+	return rows
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,66 @@
+package googlesheet
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryServiceClient(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient(ctx, NewMemoryServiceClient(), Config{})
+	for _, fv := range []FacetValue{
+		{Setting: DesiredWaterTemp, Facet: Want, Value: "45"},
+		{Setting: DesiredWaterTemp, Facet: Sent, Value: "45>"},
+		{Setting: DesiredWaterTemp, Facet: Have, Value: "10"},
+	} {
+		if err := c.WriteFacetValue(ctx, fv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := SettingValues{Setting: DesiredWaterTemp, Want: "45", Sent: "45>", Have: "10"}
+	if have := mustReadSettingValues(t, c, DesiredWaterTemp); have != want {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	if have := mustReadFacetValue(t, c, DesiredWaterTemp, HaveWithDate); have != "10" {
+		t.Fatalf("Have %v; want 10", have)
+	}
+}
+
+func TestMemoryServiceDefinesNamesOnWrite(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryService()
+	vals, err := m.BatchGet(ctx, "", []string{"water_temp_want"})
+	if err != nil || len(vals) != 1 || vals[0] != nil {
+		t.Fatalf("Have %v, %v; want no values", vals, err)
+	}
+	if layout, _ := m.Layout(ctx, ""); len(layout.Tabs) != 0 || len(layout.NamedRanges) != 0 {
+		t.Fatalf("Have %v after read; want an empty sheet", layout)
+	}
+	if err := m.BatchUpdate(ctx, "", []ValueRange{{Range: "water_temp_want", Values: [][]interface{}{{"45"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if layout, _ := m.Layout(ctx, ""); len(layout.NamedRanges) != 1 {
+		t.Fatalf("Have %v after write; want water_temp_want", layout)
+	}
+	// The row of the setting exists now, so its other facets read from it.
+	vals, err = m.BatchGet(ctx, "", []string{"water_temp"})
+	if err != nil || len(vals) != 1 || len(vals[0]) != 1 || vals[0][0][0] != "45" {
+		t.Fatalf("Have %v, %v; want 45", vals, err)
+	}
+}
+
+func mustReadSettingValues(t *testing.T, c Client, s Setting) SettingValues {
+	vs, err := c.ReadSettingValues(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func mustReadFacetValue(t *testing.T, c Client, s Setting, f Facet) string {
+	v, err := c.ReadFacetValue(context.Background(), s, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
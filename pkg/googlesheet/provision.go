@@ -0,0 +1,249 @@
+package googlesheet
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+)
+
+type (
+	// Requirements are the tabs and named ranges a user of the client
+	// needs. Tabs may have a header row.
+	Requirements struct {
+		tabs     map[string][]interface{}
+		settings map[Setting]map[string]bool
+	}
+
+	// Layout is the structure of a spreadsheet, besides its values.
+	Layout struct {
+		Tabs        []string
+		NamedRanges []string
+	}
+
+	// NamedRange names a range of cells of a tab, counted from 0.
+	NamedRange struct {
+		Name string
+		Tab  string
+		Row  int
+		Col  int
+		Cols int
+	}
+)
+
+// SettingsTab is where provisioning adds the rows of missing settings.
+const SettingsTab = "Settings"
+
+// The columns of a setting's row in the settings tab.
+var (
+	settingsHeader = []interface{}{"Setting", "Want", "Sent", "Have", "Updated"}
+	facetCells     = map[Facet]struct{ col, cols int }{
+		Want:         {1, 1},
+		Sent:         {2, 1},
+		Have:         {3, 1},
+		HaveWithDate: {3, 2},
+	}
+	settingCells = struct{ col, cols int }{1, 3}
+)
+
+// RequireTab requires a tab, with the header row it gets when added.
+func (r *Requirements) RequireTab(tab string, header ...interface{}) {
+	if r.tabs == nil {
+		r.tabs = map[string][]interface{}{}
+	}
+	r.tabs[tab] = header
+}
+
+// RequireValues requires the range of all values of a setting, and the
+// ranges of the given facets.
+func (r *Requirements) RequireValues(s Setting, facets ...Facet) {
+	r.require(s, string(s))
+	r.RequireFacets(s, facets...)
+}
+
+// RequireFacets requires the ranges of the given facets of a setting.
+func (r *Requirements) RequireFacets(s Setting, facets ...Facet) {
+	for _, f := range facets {
+		r.require(s, facetRange(s, f))
+	}
+}
+
+// Tabs returns the required tabs, sorted.
+func (r Requirements) Tabs() []string {
+	tabs := []string{}
+	for tab := range r.tabs {
+		tabs = append(tabs, tab)
+	}
+	sort.Strings(tabs)
+	return tabs
+}
+
+// Ranges returns the required named ranges, sorted.
+func (r Requirements) Ranges() []string {
+	rngs := []string{}
+	for _, ss := range r.settings {
+		for rng := range ss {
+			rngs = append(rngs, rng)
+		}
+	}
+	sort.Strings(rngs)
+	return rngs
+}
+
+func (r *Requirements) require(s Setting, rng string) {
+	if r.settings == nil {
+		r.settings = map[Setting]map[string]bool{}
+	}
+	if r.settings[s] == nil {
+		r.settings[s] = map[string]bool{}
+	}
+	r.settings[s][rng] = true
+}
+
+// Provision checks that the spreadsheet has all required tabs and named
+// ranges. If create is set, it adds the missing tabs with their header
+// rows, and a row in the settings tab for each setting without any of its
+// ranges. It returns what is still missing.
+func Provision(ctx context.Context, srv ServiceClient, cfg Config, req Requirements, create bool) ([]string, error) {
+	layout, err := srv.Layout(ctx, cfg.SheetId)
+	if err != nil {
+		return nil, err
+	}
+	hasTab := toSet(layout.Tabs)
+	hasRange := toSet(layout.NamedRanges)
+
+	missingTabs := []string{}
+	for tab := range req.tabs {
+		if !hasTab[tab] {
+			missingTabs = append(missingTabs, tab)
+		}
+	}
+	// Settings without any of their ranges can be added as a new row.
+	newSettings := []Setting{}
+	missingRanges := []string{}
+	for s, rngs := range req.settings {
+		isNew := true
+		for rng := range rngs {
+			if hasRange[rng] {
+				isNew = false
+			} else {
+				missingRanges = append(missingRanges, rng)
+			}
+		}
+		if isNew {
+			newSettings = append(newSettings, s)
+		}
+	}
+	sort.Strings(missingTabs)
+	sort.Strings(missingRanges)
+	sort.Slice(newSettings, func(i, j int) bool { return newSettings[i] < newSettings[j] })
+	for _, tab := range missingTabs {
+		log.Printf("Sheet is missing tab %v\n", tab)
+	}
+	for _, rng := range missingRanges {
+		log.Printf("Sheet is missing named range %v\n", rng)
+	}
+	if !create || len(missingTabs)+len(newSettings) == 0 {
+		return append(missingTabs, missingRanges...), nil
+	}
+
+	if _, ok := req.tabs[SettingsTab]; len(newSettings) > 0 && !hasTab[SettingsTab] && !ok {
+		missingTabs = append(missingTabs, SettingsTab)
+	}
+	if len(missingTabs) > 0 {
+		log.Printf("Adding tabs %v\n", missingTabs)
+		if err := srv.AddTabs(ctx, cfg.SheetId, missingTabs); err != nil {
+			return nil, err
+		}
+		if err := addHeaders(ctx, srv, cfg, req, missingTabs); err != nil {
+			return nil, err
+		}
+	}
+	if len(newSettings) == 0 {
+		return missingRanges, nil
+	}
+	if err := addSettings(ctx, srv, cfg, req, newSettings); err != nil {
+		return nil, err
+	}
+	added := map[string]bool{}
+	for _, s := range newSettings {
+		for rng := range req.settings[s] {
+			added[rng] = true
+		}
+	}
+	stillMissing := []string{}
+	for _, rng := range missingRanges {
+		if !added[rng] {
+			stillMissing = append(stillMissing, rng)
+		}
+	}
+	return stillMissing, nil
+}
+
+// addHeaders writes the header rows of added tabs.
+func addHeaders(ctx context.Context, srv ServiceClient, cfg Config, req Requirements, tabs []string) error {
+	data := []ValueRange{}
+	for _, tab := range tabs {
+		if header := req.tabs[tab]; len(header) > 0 {
+			data = append(data, ValueRange{Range: tabRange(tab, "A1"), Values: [][]interface{}{header}})
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return srv.BatchUpdate(ctx, cfg.SheetId, data)
+}
+
+// addSettings adds a row for each setting below the used rows of the
+// settings tab, and names the required ranges of the row.
+func addSettings(ctx context.Context, srv ServiceClient, cfg Config, req Requirements, settings []Setting) error {
+	vals, err := srv.BatchGet(ctx, cfg.SheetId, []string{SettingsTab + "!A:A"})
+	if err != nil {
+		return err
+	}
+	row := 0
+	if len(vals) == 1 {
+		row = len(vals[0])
+	}
+	data := []ValueRange{}
+	if row == 0 {
+		data = append(data, ValueRange{Range: fmt.Sprintf("%v!A1", SettingsTab),
+			Values: [][]interface{}{settingsHeader}})
+		row++
+	}
+	rngs := []NamedRange{}
+	for _, s := range settings {
+		log.Printf("Adding setting %v in row %v of tab %v\n", s, row+1, SettingsTab)
+		data = append(data, ValueRange{Range: fmt.Sprintf("%v!A%v", SettingsTab, row+1),
+			Values: [][]interface{}{{string(s)}}})
+		for rng := range req.settings[s] {
+			_, nr := SettingNamedRange(rng, row)
+			rngs = append(rngs, nr)
+		}
+		row++
+	}
+	sort.Slice(rngs, func(i, j int) bool { return rngs[i].Name < rngs[j].Name })
+	if err := srv.BatchUpdate(ctx, cfg.SheetId, data); err != nil {
+		return err
+	}
+	return srv.AddNamedRanges(ctx, cfg.SheetId, rngs)
+}
+
+// SettingNamedRange returns the named range of a setting or of one of its
+// facets, e.g. water_temp_want, if the setting is in the given row of the
+// settings tab.
+func SettingNamedRange(name string, row int) (Setting, NamedRange) {
+	s, cells := Setting(name), settingCells
+	if fs, f, ok := splitFacetRange(name); ok {
+		s, cells = fs, facetCells[f]
+	}
+	return s, NamedRange{Name: name, Tab: SettingsTab, Row: row, Col: cells.col, Cols: cells.cols}
+}
+
+func toSet(ss []string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
@@ -0,0 +1,109 @@
+package googlesheet_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	gst "parren.ch/ultrasource/pkg/googlesheet/googlesheettest"
+)
+
+func TestProvisionReportsMissing(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.SetRow("Log!A1", "Timestamp")
+	sheet.Define(
+		gs.NamedRange{Name: "room_temp", Tab: "Heating", Row: 1, Col: 1, Cols: 3},
+		gs.NamedRange{Name: "room_temp_want", Tab: "Heating", Row: 1, Col: 1, Cols: 1},
+	)
+	req := gs.Requirements{}
+	req.RequireTab("Log")
+	req.RequireTab("Schedule")
+	req.RequireValues(gs.DesiredHeatingTemp, gs.Want, gs.Sent)
+	req.RequireFacets(gs.ActualWaterTempHigher, gs.HaveWithDate)
+
+	missing, err := gs.Provision(ctx, sheet, gs.Config{}, req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Schedule", "actual_water_temp_dated", "room_temp_sent"}
+	if !reflect.DeepEqual(missing, want) {
+		t.Fatalf("Have %v; want %v", missing, want)
+	}
+	if n := sheet.Calls(gst.OpAddTabs) + sheet.Calls(gst.OpAddNamedRanges) + sheet.Calls(gst.OpBatchUpdate); n != 0 {
+		t.Fatalf("Have %v changes; want none", n)
+	}
+}
+
+func TestProvisionCreatesMissing(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	sheet.Define(
+		gs.NamedRange{Name: "room_temp", Tab: "Heating", Row: 1, Col: 1, Cols: 3},
+		gs.NamedRange{Name: "room_temp_want", Tab: "Heating", Row: 1, Col: 1, Cols: 1},
+	)
+	req := gs.Requirements{}
+	req.RequireTab("Log")
+	req.RequireValues(gs.DesiredHeatingTemp, gs.Want, gs.Sent)
+	req.RequireValues(gs.DesiredWaterTemp, gs.Want)
+	req.RequireFacets(gs.ActualWaterTempHigher, gs.HaveWithDate)
+
+	missing, err := gs.Provision(ctx, sheet, gs.Config{}, req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Where room_temp is, is unknown.
+	if want := []string{"room_temp_sent"}; !reflect.DeepEqual(missing, want) {
+		t.Fatalf("Have %v; want %v", missing, want)
+	}
+	layout, err := sheet.Layout(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gs.Layout{
+		Tabs: []string{"Heating", "Log", gs.SettingsTab},
+		NamedRanges: []string{"actual_water_temp_dated", "room_temp", "room_temp_want", "water_temp",
+			"water_temp_want"},
+	}
+	if !reflect.DeepEqual(layout, want) {
+		t.Fatalf("Have %v; want %v", layout, want)
+	}
+	// The added ranges are in the columns of their facets.
+	sheet.Strict = true
+	sheet.SetRow("actual_water_temp_dated", "50", "2023-03-30 08:00:00")
+	sheet.SetRow("water_temp_want", "45")
+	wantVals := [][]interface{}{
+		{"Setting", "Want", "Sent", "Have", "Updated"},
+		{"actual_water_temp", "", "", "50", "2023-03-30 08:00:00"},
+		{"water_temp", "45"},
+	}
+	if have := sheet.Get("Settings!A1:E"); !reflect.DeepEqual(have, wantVals) {
+		t.Fatalf("Have %v; want %v", have, wantVals)
+	}
+}
+
+func TestProvisionAddsHeaders(t *testing.T) {
+	ctx := context.Background()
+	sheet := gst.New()
+	req := gs.Requirements{}
+	req.RequireTab("Schedule", "Start", "Setting")
+	req.RequireTab("My notes")
+	req.RequireValues(gs.DesiredWaterTemp, gs.Want)
+
+	if _, err := gs.Provision(ctx, sheet, gs.Config{}, req, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		rng  string
+		want []interface{}
+	}{
+		{"Schedule!A1:B1", []interface{}{"Start", "Setting"}},
+		{"'My notes'!A1:B1", []interface{}{"", ""}},
+		{"Settings!A1:B1", []interface{}{"Setting", "Want"}},
+	} {
+		if err := sheet.CheckRowStart(tt.rng, tt.want...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
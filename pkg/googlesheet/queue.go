@@ -0,0 +1,117 @@
+package googlesheet
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+type (
+	// queue holds writes, appends and added tabs that could not be sent
+	// while the sheet was unreachable. It is kept in a JSON file, so that it survives
+	// restarts, and is replayed in order. Values are kept as they were
+	// given, so replayed log rows keep their original timestamps.
+	queue struct {
+		file    string
+		entries []queueEntry
+	}
+
+	queueEntry struct {
+		Append bool
+		// AddTab adds the tab named by Range.
+		AddTab bool
+		ValueRange
+	}
+)
+
+func newQueue(file string) (*queue, error) {
+	q := &queue{file: file}
+	if file == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+	return q, json.Unmarshal(data, &q.entries)
+}
+
+func (q *queue) empty() bool {
+	return len(q.entries) == 0
+}
+
+// write queues a write. An earlier write of the same range is superseded.
+func (q *queue) write(vr ValueRange) error {
+	for i, e := range q.entries {
+		if e.isWrite() && e.Range == vr.Range {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	q.entries = append(q.entries, queueEntry{ValueRange: vr})
+	return q.save()
+}
+
+func (q *queue) append(vr ValueRange) error {
+	q.entries = append(q.entries, queueEntry{Append: true, ValueRange: vr})
+	return q.save()
+}
+
+func (q *queue) addTab(tab string) error {
+	q.entries = append(q.entries, queueEntry{AddTab: true, ValueRange: ValueRange{Range: tab}})
+	return q.save()
+}
+
+// writes returns the queued writes, oldest first.
+func (q *queue) writes() []ValueRange {
+	vrs := []ValueRange{}
+	for _, e := range q.entries {
+		if e.isWrite() {
+			vrs = append(vrs, e.ValueRange)
+		}
+	}
+	return vrs
+}
+
+// head returns the leading entries that can be sent together, i.e. a run
+// of writes, or a single append or added tab.
+func (q *queue) head() []queueEntry {
+	if q.empty() {
+		return nil
+	}
+	n := 1
+	if !q.entries[0].isWrite() {
+		return q.entries[:n]
+	}
+	for n < len(q.entries) && q.entries[n].isWrite() {
+		n++
+	}
+	return q.entries[:n]
+}
+
+func (e queueEntry) isWrite() bool {
+	return !e.Append && !e.AddTab
+}
+
+func (q *queue) drop(n int) error {
+	q.entries = q.entries[n:]
+	return q.save()
+}
+
+func (q *queue) save() error {
+	if q.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+	tmp := q.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.file)
+}
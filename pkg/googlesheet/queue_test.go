@@ -0,0 +1,77 @@
+package googlesheet_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	gs "parren.ch/ultrasource/pkg/googlesheet"
+	gst "parren.ch/ultrasource/pkg/googlesheet/googlesheettest"
+)
+
+func TestQueueReplaysAfterOutage(t *testing.T) {
+	ctx := context.Background()
+	cfg := gs.Config{QueueFile: filepath.Join(t.TempDir(), "queue.json")}
+	sheet := gst.New()
+	sheet.SetRow("Log!A1", "Timestamp", "Temp")
+	failAll(sheet, &googleapi.Error{Code: http.StatusServiceUnavailable})
+
+	c := gs.NewClient(ctx, sheet, cfg)
+	for _, err := range []error{
+		c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "20"}),
+		c.AppendOverwritingRows(ctx, "Log!A1", [][]interface{}{{"2023-03-30 08:00:00", "20"}}),
+		c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "21"}),
+		c.AppendOverwritingRows(ctx, "Log!A1", [][]interface{}{{"2023-03-30 08:01:00", "21"}}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if appends := sheet.Appends(); len(appends) != 0 {
+		t.Fatalf("Have %v; want no appends while offline", appends)
+	}
+
+	// A restarted agent picks up the queue.
+	failAll(sheet, nil)
+	c = gs.NewClient(ctx, sheet, cfg)
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredWaterTemp, Facet: gs.Sent, Value: "50"}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{{"Timestamp", "Temp"}, {"2023-03-30 08:00:00", "20"}, {"2023-03-30 08:01:00", "21"}}
+	if have := sheet.Get("Log!A1:B"); !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have %v; want %v", have, want)
+	}
+	for _, tt := range []struct{ rng, want string }{
+		{"room_temp_sent", "21"},
+		{"water_temp_sent", "50"},
+	} {
+		if err := sheet.CheckRowStart(tt.rng, tt.want); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueDropsPermanentFailures(t *testing.T) {
+	ctx := context.Background()
+	cfg := gs.Config{QueueFile: filepath.Join(t.TempDir(), "queue.json")}
+	sheet := gst.New()
+	sheet.Fail(gst.OpBatchUpdate, &googleapi.Error{Code: http.StatusBadRequest})
+
+	c := gs.NewClient(ctx, sheet, cfg)
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredHeatingTemp, Facet: gs.Sent, Value: "20"}); err == nil {
+		t.Fatal("Have no error; want one")
+	}
+
+	// A restarted agent has nothing to replay.
+	sheet.Fail(gst.OpBatchUpdate, nil)
+	c = gs.NewClient(ctx, sheet, cfg)
+	if err := c.WriteFacetValue(ctx, gs.FacetValue{Setting: gs.DesiredWaterTemp, Facet: gs.Sent, Value: "50"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheet.CheckRowStart("room_temp_sent", ""); err != nil {
+		t.Fatal(err)
+	}
+}
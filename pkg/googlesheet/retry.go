@@ -0,0 +1,43 @@
+package googlesheet
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// retry runs call until it succeeds, fails permanently, or the configured
+// retries are used up. The delay before the first retry doubles with every
+// further retry.
+func retry(ctx context.Context, cfg Config, what string, call func() error) error {
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || !isTransient(err) || attempt >= cfg.Retries {
+			return err
+		}
+		log.Printf("Retrying to %v in %v: %v\n", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient tells whether a failed request might succeed when repeated,
+// i.e. it hit the quota, the server failed, or the network broke.
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,36 @@
+package googlesheet
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryTransientErrors(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Retries: 2, RetryBackoff: time.Millisecond}
+	for _, tt := range []struct {
+		err   error
+		calls int
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, 3},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, 3},
+		{&url.Error{Op: "Get", Err: errors.New("connection reset")}, 3},
+		{&googleapi.Error{Code: http.StatusBadRequest}, 1},
+		{errors.New("other"), 1},
+	} {
+		calls := 0
+		err := retry(ctx, cfg, "test", func() error {
+			calls++
+			return tt.err
+		})
+		if err != tt.err || calls != tt.calls {
+			t.Fatalf("Have %v after %v calls for %v; want %v calls", err, calls, tt.err, tt.calls)
+		}
+	}
+}
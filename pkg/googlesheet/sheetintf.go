@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
+	"sync"
 	"time"
 
 	"google.golang.org/api/option"
@@ -12,15 +14,16 @@ import (
 
 type (
 	Client interface {
-		ReadSettingValues(ctx context.Context, setting Setting) SettingValues
-		ReadFacetValue(ctx context.Context, setting Setting, facet Facet) string
-		WriteFacetValue(ctx context.Context, v FacetValue)
-		RefreshFacetValue(ctx context.Context, v FacetValue)
+		ReadSettingValues(ctx context.Context, setting Setting) (SettingValues, error)
+		ReadFacetValue(ctx context.Context, setting Setting, facet Facet) (string, error)
+		Read(ctx context.Context, rng string) ([][]interface{}, error)
+		WriteFacetValue(ctx context.Context, v FacetValue) error
+		RefreshFacetValue(ctx context.Context, v FacetValue) error
 		InvalidateSettingValue(s Setting)
-		RefreshFluctuatingHaveValue(ctx context.Context, v FacetValue)
-		Write(ctx context.Context, rng string, values [][]interface{})
-		AppendOverwritingRows(ctx context.Context, rng string, values [][]interface{})
-		LatestValues() map[Setting]string
+		RefreshFluctuatingHaveValue(ctx context.Context, v FacetValue) error
+		Write(ctx context.Context, rng string, values [][]interface{}) error
+		AppendOverwritingRows(ctx context.Context, rng string, values [][]interface{}) error
+		AppendLogRow(ctx context.Context, name string, t time.Time, header, row []interface{}) error
 	}
 
 	Setting       string
@@ -57,6 +60,24 @@ type Config struct {
 	CredentialsFile string
 	SheetId         string
 	MaxHaveValueAge time.Duration
+	// ReadCacheAge is how long the values of a batch read are reused.
+	// Zero reads all known ranges again on every read.
+	ReadCacheAge time.Duration
+	// WriteInterval coalesces writes into one batch per interval, and
+	// writes failed values again with the next batch. Zero writes
+	// immediately, returning failures to the writer.
+	WriteInterval time.Duration
+	// QueueFile keeps writes and appends while the sheet is unreachable.
+	// Empty drops them.
+	QueueFile string
+	// MaxLogTabs is how many monthly tabs of a log are kept. Zero keeps
+	// all of them.
+	MaxLogTabs int
+	// Retries is how often a request failing transiently is repeated.
+	Retries int
+	// RetryBackoff is the delay before the first retry. It doubles
+	// with every further retry.
+	RetryBackoff time.Duration
 }
 
 func NewServiceClient(ctx context.Context, cfg Config) ServiceClient {
@@ -67,31 +88,55 @@ func NewServiceClient(ctx context.Context, cfg Config) ServiceClient {
 	if err != nil {
 		log.Fatalf("Unable to retrieve Google Sheets client: %v", err)
 	}
-	return &serviceImpl{srv: srv}
+	return &serviceImpl{srv: srv, cfg: cfg}
 }
 
 func NewClient(ctx context.Context, srv ServiceClient, cfg Config) Client {
-	return &clientImpl{cfg: cfg, srv: srv,
-		datedValues:  make(map[Setting]datedValue),
-		latestValues: make(map[Setting]string)}
+	c := &clientImpl{cfg: cfg, srv: srv,
+		datedValues: make(map[Setting]datedValue),
+		batch:       newBatcher(srv, cfg),
+		tabs:        map[string]bool{}}
+	if cfg.WriteInterval > 0 || cfg.QueueFile != "" {
+		go c.batch.flushForever(ctx)
+	}
+	return c
 }
 
 type (
 	ServiceClient interface {
-		Read(ctx context.Context, sheetId, rng string) [][]interface{}
-		Write(ctx context.Context, sheetId, rng string, vals [][]interface{})
-		Append(ctx context.Context, sheetId, rng string, vals [][]interface{})
+		// BatchGet returns the values of each range.
+		BatchGet(ctx context.Context, sheetId string, rngs []string) ([][][]interface{}, error)
+		BatchUpdate(ctx context.Context, sheetId string, data []ValueRange) error
+		Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) error
+		Layout(ctx context.Context, sheetId string) (Layout, error)
+		AddTabs(ctx context.Context, sheetId string, titles []string) error
+		AddNamedRanges(ctx context.Context, sheetId string, rngs []NamedRange) error
+		DeleteTabs(ctx context.Context, sheetId string, titles []string) error
+	}
+
+	ValueRange struct {
+		Range  string
+		Values [][]interface{}
 	}
 
 	serviceImpl struct {
 		srv *sheets.Service
+		cfg Config
 	}
 
 	clientImpl struct {
-		cfg          Config
-		srv          ServiceClient
-		datedValues  map[Setting]datedValue
-		latestValues map[Setting]string
+		cfg Config
+		srv ServiceClient
+		// lock guards datedValues.
+		lock        sync.Mutex
+		datedValues map[Setting]datedValue
+		batch       *batcher
+		// tabsLock guards tabs, the tabs of the sheet read on the first
+		// log row and the ones added since, and tabsRead, which is false
+		// until they could be read.
+		tabsLock sync.Mutex
+		tabs     map[string]bool
+		tabsRead bool
 	}
 
 	datedValue struct {
@@ -100,120 +145,298 @@ type (
 	}
 )
 
-func (c *clientImpl) ReadSettingValues(ctx context.Context, setting Setting) SettingValues {
+func (c *clientImpl) ReadSettingValues(ctx context.Context, setting Setting) (SettingValues, error) {
 	rng := string(setting)
-	rows := c.read(ctx, rng)
+	rows, err := c.Read(ctx, rng)
+	if err != nil {
+		return SettingValues{}, err
+	}
 	log.Printf("Read %v values: %v", rng, rows)
-	row := rows[0]
+	// The sheet omits trailing empty cells.
+	row := []interface{}{}
+	if len(rows) > 0 {
+		row = rows[0]
+	}
+	cell := func(i int) string {
+		if i >= len(row) {
+			return ""
+		}
+		return fmt.Sprintf("%v", row[i])
+	}
 	result := SettingValues{Setting: setting}
-	result.Want = fmt.Sprintf("%v", row[0])
-	result.Sent = fmt.Sprintf("%v", row[1])
-	result.Have = fmt.Sprintf("%v", row[2])
-	return result
+	result.Want = cell(0)
+	result.Sent = cell(1)
+	result.Have = cell(2)
+	return result, nil
 }
 
-func (c *clientImpl) ReadFacetValue(ctx context.Context, setting Setting, facet Facet) string {
+func (c *clientImpl) ReadFacetValue(ctx context.Context, setting Setting, facet Facet) (string, error) {
 	rng := facetRange(setting, facet)
-	rows := c.read(ctx, rng)
+	rows, err := c.Read(ctx, rng)
+	if err != nil {
+		return "", err
+	}
 	log.Printf("Read %v values: %v", rng, rows)
 	if len(rows) < 1 || len(rows[0]) < 1 {
-		return ""
+		return "", nil
 	}
-	return fmt.Sprintf("%v", rows[0][0])
+	return fmt.Sprintf("%v", rows[0][0]), nil
 }
 
-func (c *clientImpl) WriteFacetValue(ctx context.Context, v FacetValue) {
-	c.Write(ctx, facetRange(v.Setting, v.Facet), [][]interface{}{{v.Value}})
+func (c *clientImpl) WriteFacetValue(ctx context.Context, v FacetValue) error {
+	return c.Write(ctx, facetRange(v.Setting, v.Facet), [][]interface{}{{v.Value}})
 }
 
-func (c *clientImpl) RefreshFacetValue(ctx context.Context, v FacetValue) {
-	c.latestValues[v.Setting] = v.Value
-	curr := c.ReadFacetValue(ctx, v.Setting, v.Facet)
+func (c *clientImpl) RefreshFacetValue(ctx context.Context, v FacetValue) error {
+	curr, err := c.ReadFacetValue(ctx, v.Setting, v.Facet)
+	if err != nil {
+		return err
+	}
 	if curr != v.Value {
 		log.Printf("Updating current setting %v\n", v)
-		c.WriteFacetValue(ctx, v)
+		return c.WriteFacetValue(ctx, v)
 	}
+	return nil
 }
 
 func (c *clientImpl) InvalidateSettingValue(s Setting) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	delete(c.datedValues, s)
 }
 
-func (c *clientImpl) RefreshFluctuatingHaveValue(ctx context.Context, v FacetValue) {
+func (c *clientImpl) RefreshFluctuatingHaveValue(ctx context.Context, v FacetValue) error {
 	if v.Facet != Have {
-		log.Fatalf("must be a Have value: %v", v)
+		return fmt.Errorf("must be a Have value: %v", v)
 	}
-	c.latestValues[v.Setting] = v.Value
-	if dv, ok := c.datedValues[v.Setting]; ok {
-		if dv.LastUpdateAt.Add(c.cfg.MaxHaveValueAge).After(time.Now()) {
-			return
-		}
+	c.lock.Lock()
+	dv, ok := c.datedValues[v.Setting]
+	c.lock.Unlock()
+	if ok && dv.LastUpdateAt.Add(c.cfg.MaxHaveValueAge).After(time.Now()) {
+		return nil
+	}
+	curr, err := c.ReadFacetValue(ctx, v.Setting, HaveWithDate)
+	if err != nil {
+		return err
 	}
-	curr := c.ReadFacetValue(ctx, v.Setting, HaveWithDate)
 	if curr == v.Value {
-		return
+		return nil
 	}
 	log.Printf("Updating current setting %v\n", v)
 	timeStamp := time.Now()
 	rangeName := fmt.Sprintf("%v_%v", v.Setting, HaveWithDate)
-	c.Write(ctx, rangeName, [][]interface{}{{v.Value, FormatTimestamp(timeStamp)}})
+	err = c.Write(ctx, rangeName, [][]interface{}{{v.Value, FormatTimestamp(timeStamp)}})
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.datedValues[v.Setting] = datedValue{Value: v.Value, LastUpdateAt: timeStamp}
+	return nil
 }
 
 func facetRange(setting Setting, facet Facet) string {
 	return fmt.Sprintf("%v_%v", setting, facet)
 }
 
-func (c *clientImpl) read(ctx context.Context, rng string) [][]interface{} {
-	return c.srv.Read(ctx, c.cfg.SheetId, rng)
+func (c *clientImpl) Read(ctx context.Context, rng string) ([][]interface{}, error) {
+	return c.batch.read(ctx, rng)
 }
 
-func (c *clientImpl) Write(ctx context.Context, rng string, values [][]interface{}) {
-	c.srv.Write(ctx, c.cfg.SheetId, rng, values)
+func (c *clientImpl) Write(ctx context.Context, rng string, values [][]interface{}) error {
+	return c.batch.write(ctx, rng, values)
 }
 
-func (c *clientImpl) AppendOverwritingRows(ctx context.Context, rng string, values [][]interface{}) {
-	c.srv.Append(ctx, c.cfg.SheetId, rng, values)
+func (c *clientImpl) AppendOverwritingRows(ctx context.Context, rng string, values [][]interface{}) error {
+	return c.batch.append(ctx, rng, values)
 }
 
-func (c *clientImpl) LatestValues() map[Setting]string {
-	return c.latestValues
+func (s *serviceImpl) BatchGet(ctx context.Context, sheetId string, rngs []string) ([][][]interface{}, error) {
+	var rsp *sheets.BatchGetValuesResponse
+	err := retry(ctx, s.cfg, "read ranges", func() (err error) {
+		rsp, err = s.srv.Spreadsheets.Values.
+			BatchGet(sheetId).
+			Ranges(rngs...).
+			ValueRenderOption("UNFORMATTED_VALUE").
+			Context(ctx).Do()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve ranges %v from sheet: %w", rngs, err)
+	}
+	vals := make([][][]interface{}, len(rsp.ValueRanges))
+	for i, vr := range rsp.ValueRanges {
+		vals[i] = vr.Values
+	}
+	return vals, nil
 }
 
-func (s *serviceImpl) Read(ctx context.Context, sheetId, rng string) [][]interface{} {
-	rsp, err := s.srv.Spreadsheets.Values.
-		Get(sheetId, rng).
-		ValueRenderOption("UNFORMATTED_VALUE").
-		Do()
+func (s *serviceImpl) BatchUpdate(ctx context.Context, sheetId string, data []ValueRange) error {
+	rb := &sheets.BatchUpdateValuesRequest{ValueInputOption: "USER_ENTERED"}
+	for _, d := range data {
+		rb.Data = append(rb.Data, &sheets.ValueRange{Range: d.Range, Values: d.Values})
+	}
+	err := retry(ctx, s.cfg, "update ranges", func() error {
+		_, err := s.srv.Spreadsheets.Values.
+			BatchUpdate(sheetId, rb).
+			Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		log.Printf("Unable to retrieve range %v from sheet: %v", rng, err)
-		return [][]interface{}{}
+		return fmt.Errorf("unable to update ranges %v in sheet: %w", data, err)
 	}
-	return rsp.Values
+	return nil
 }
 
-func (s *serviceImpl) Write(ctx context.Context, sheetId, rng string, vals [][]interface{}) {
+func (s *serviceImpl) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) error {
 	rb := &sheets.ValueRange{Values: vals}
-	_, err := s.srv.Spreadsheets.Values.
-		Update(sheetId, rng, rb).
-		ValueInputOption("USER_ENTERED").
-		Context(ctx).Do()
+	err := retry(ctx, s.cfg, "append range", func() error {
+		_, err := s.srv.Spreadsheets.Values.
+			Append(sheetId, rng, rb).
+			ValueInputOption("USER_ENTERED").
+			Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		log.Printf("Unable to append range %v to sheet: %v", rng, err)
+		return fmt.Errorf("unable to append range %v to sheet: %w", rng, err)
 	}
+	return nil
 }
 
-func (s *serviceImpl) Append(ctx context.Context, sheetId, rng string, vals [][]interface{}) {
-	rb := &sheets.ValueRange{Values: vals}
-	_, err := s.srv.Spreadsheets.Values.
-		Append(sheetId, rng, rb).
-		ValueInputOption("USER_ENTERED").
-		Context(ctx).Do()
+func (s *serviceImpl) Layout(ctx context.Context, sheetId string) (Layout, error) {
+	var rsp *sheets.Spreadsheet
+	err := retry(ctx, s.cfg, "read layout", func() (err error) {
+		rsp, err = s.srv.Spreadsheets.
+			Get(sheetId).
+			Fields("sheets.properties.title", "namedRanges.name").
+			Context(ctx).Do()
+		return
+	})
+	if err != nil {
+		return Layout{}, fmt.Errorf("unable to retrieve layout of sheet: %w", err)
+	}
+	layout := Layout{}
+	for _, sh := range rsp.Sheets {
+		layout.Tabs = append(layout.Tabs, sh.Properties.Title)
+	}
+	for _, nr := range rsp.NamedRanges {
+		layout.NamedRanges = append(layout.NamedRanges, nr.Name)
+	}
+	return layout, nil
+}
+
+func (s *serviceImpl) AddTabs(ctx context.Context, sheetId string, titles []string) error {
+	rb := &sheets.BatchUpdateSpreadsheetRequest{}
+	for _, t := range titles {
+		rb.Requests = append(rb.Requests, &sheets.Request{
+			AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: t}}})
+	}
+	if err := s.updateSpreadsheet(ctx, sheetId, rb); err != nil {
+		return fmt.Errorf("unable to add tabs %v to sheet: %w", titles, err)
+	}
+	return nil
+}
+
+func (s *serviceImpl) AddNamedRanges(ctx context.Context, sheetId string, rngs []NamedRange) error {
+	tabIds, err := s.tabIds(ctx, sheetId)
 	if err != nil {
-		log.Printf("Unable to append range %v to sheet: %v", rng, err)
+		return err
+	}
+	rb := &sheets.BatchUpdateSpreadsheetRequest{}
+	for _, r := range rngs {
+		tabId, ok := tabIds[r.Tab]
+		if !ok {
+			return fmt.Errorf("unable to add named range %v to missing tab %v", r.Name, r.Tab)
+		}
+		rb.Requests = append(rb.Requests, &sheets.Request{
+			AddNamedRange: &sheets.AddNamedRangeRequest{NamedRange: &sheets.NamedRange{
+				Name: r.Name,
+				Range: &sheets.GridRange{
+					SheetId:          tabId,
+					StartRowIndex:    int64(r.Row),
+					EndRowIndex:      int64(r.Row + 1),
+					StartColumnIndex: int64(r.Col),
+					EndColumnIndex:   int64(r.Col + r.Cols),
+					// Zero is a valid index, but omitted by default.
+					ForceSendFields: []string{"SheetId", "StartRowIndex", "StartColumnIndex"},
+				}}}})
 	}
+	if err := s.updateSpreadsheet(ctx, sheetId, rb); err != nil {
+		return fmt.Errorf("unable to add named ranges to sheet: %w", err)
+	}
+	return nil
+}
+
+func (s *serviceImpl) DeleteTabs(ctx context.Context, sheetId string, titles []string) error {
+	tabIds, err := s.tabIds(ctx, sheetId)
+	if err != nil {
+		return err
+	}
+	rb := &sheets.BatchUpdateSpreadsheetRequest{}
+	for _, t := range titles {
+		tabId, ok := tabIds[t]
+		if !ok {
+			continue
+		}
+		rb.Requests = append(rb.Requests, &sheets.Request{
+			DeleteSheet: &sheets.DeleteSheetRequest{SheetId: tabId, ForceSendFields: []string{"SheetId"}}})
+	}
+	if len(rb.Requests) == 0 {
+		return nil
+	}
+	if err := s.updateSpreadsheet(ctx, sheetId, rb); err != nil {
+		return fmt.Errorf("unable to delete tabs %v from sheet: %w", titles, err)
+	}
+	return nil
+}
+
+func (s *serviceImpl) tabIds(ctx context.Context, sheetId string) (map[string]int64, error) {
+	var rsp *sheets.Spreadsheet
+	err := retry(ctx, s.cfg, "read tabs", func() (err error) {
+		rsp, err = s.srv.Spreadsheets.
+			Get(sheetId).
+			Fields("sheets.properties(sheetId,title)").
+			Context(ctx).Do()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve tabs of sheet: %w", err)
+	}
+	tabIds := map[string]int64{}
+	for _, sh := range rsp.Sheets {
+		tabIds[sh.Properties.Title] = sh.Properties.SheetId
+	}
+	return tabIds, nil
+}
+
+func (s *serviceImpl) updateSpreadsheet(ctx context.Context, sheetId string, rb *sheets.BatchUpdateSpreadsheetRequest) error {
+	return retry(ctx, s.cfg, "update sheet", func() error {
+		_, err := s.srv.Spreadsheets.
+			BatchUpdate(sheetId, rb).
+			Context(ctx).Do()
+		return err
+	})
 }
 
 func FormatTimestamp(t time.Time) string {
 	return t.Format("2006-01-02 15:04:05")
 }
+
+// ParseTimestamp parses a local time read from the sheet. Unformatted
+// dates are read as days since 1899-12-30, while text is parsed like
+// FormatTimestamp, with optional seconds.
+func ParseTimestamp(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case float64:
+		days := math.Floor(v)
+		secs := math.Round((v - days) * 24 * 60 * 60)
+		return time.Date(1899, 12, 30, 0, 0, int(secs), 0, time.Local).AddDate(0, 0, int(days)), nil
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("not a timestamp: %v", v)
+}
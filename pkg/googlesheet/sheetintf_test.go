@@ -0,0 +1,26 @@
+package googlesheet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2023, 3, 30, 8, 10, 0, 0, time.Local)
+	for _, v := range []interface{}{
+		"2023-03-30 08:10:00",
+		"2023-03-30 08:10",
+		45015 + (8*60+10)/(24*60.0),
+	} {
+		have, err := ParseTimestamp(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !have.Equal(want) {
+			t.Fatalf("Have %v for %v; want %v", have, v, want)
+		}
+	}
+	if _, err := ParseTimestamp("tomorrow"); err == nil {
+		t.Fatal("Have no error for tomorrow; want one")
+	}
+}
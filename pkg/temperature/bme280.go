@@ -0,0 +1,137 @@
+package temperature
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+// bme280 measures temperature, humidity and pressure.
+// https://www.bosch-sensortec.com/media/boschsensortec/downloads/datasheets/bst-bme280-ds002.pdf
+type (
+	bme280 struct {
+		dev *i2c.Dev
+		cal bme280Calibration
+	}
+
+	bme280Calibration struct {
+		t1                             uint16
+		t2, t3                         int16
+		p1                             uint16
+		p2, p3, p4, p5, p6, p7, p8, p9 int16
+		h1, h3                         uint8
+		h2, h4, h5                     int16
+		h6                             int8
+	}
+)
+
+const (
+	bme280ChipId       = 0x60
+	bme280RegChipId    = 0xd0
+	bme280RegCalib1    = 0x88
+	bme280RegCalib2    = 0xe1
+	bme280RegCtrlHum   = 0xf2
+	bme280RegCtrlMeas  = 0xf4
+	bme280RegData      = 0xf7
+	bme280MeasureDelay = 10 * time.Millisecond
+
+	// Oversampling x1 of humidity.
+	bme280CtrlHum = 0x01
+	// Oversampling x1 of temperature and pressure, forced mode.
+	bme280CtrlMeas = 0x25
+)
+
+func probeBme280(dev *i2c.Dev) (i2cSensor, error) {
+	id := []byte{0}
+	if err := dev.Tx([]byte{bme280RegChipId}, id); err != nil {
+		return nil, err
+	}
+	if id[0] != bme280ChipId {
+		return nil, fmt.Errorf("unexpected chip id 0x%x", id[0])
+	}
+	c1 := make([]byte, 26)
+	if err := dev.Tx([]byte{bme280RegCalib1}, c1); err != nil {
+		return nil, err
+	}
+	c2 := make([]byte, 7)
+	if err := dev.Tx([]byte{bme280RegCalib2}, c2); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	s16 := func(b []byte) int16 { return int16(le.Uint16(b)) }
+	cal := bme280Calibration{
+		t1: le.Uint16(c1[0:]), t2: s16(c1[2:]), t3: s16(c1[4:]),
+		p1: le.Uint16(c1[6:]), p2: s16(c1[8:]), p3: s16(c1[10:]),
+		p4: s16(c1[12:]), p5: s16(c1[14:]), p6: s16(c1[16:]),
+		p7: s16(c1[18:]), p8: s16(c1[20:]), p9: s16(c1[22:]),
+		h1: c1[25],
+		h2: s16(c2[0:]), h3: c2[2],
+		h4: int16(int8(c2[3]))<<4 | int16(c2[4]&0x0f),
+		h5: int16(int8(c2[5]))<<4 | int16(c2[4]>>4),
+		h6: int8(c2[6]),
+	}
+	return &bme280{dev: dev, cal: cal}, nil
+}
+
+func (s *bme280) sense() (Measurement, error) {
+	if err := s.dev.Tx([]byte{bme280RegCtrlHum, bme280CtrlHum, bme280RegCtrlMeas, bme280CtrlMeas}, nil); err != nil {
+		return Measurement{}, err
+	}
+	time.Sleep(bme280MeasureDelay)
+	d := make([]byte, 8)
+	if err := s.dev.Tx([]byte{bme280RegData}, d); err != nil {
+		return Measurement{}, err
+	}
+	adcP := int32(d[0])<<12 | int32(d[1])<<4 | int32(d[2])>>4
+	adcT := int32(d[3])<<12 | int32(d[4])<<4 | int32(d[5])>>4
+	adcH := int32(d[6])<<8 | int32(d[7])
+	t, tFine := s.cal.temperature(adcT)
+	return Measurement{Temperature: float32(t), Quantities: map[Quantity]float32{
+		Humidity: float32(s.cal.humidity(adcH, tFine)),
+		// In hPa.
+		Pressure: float32(s.cal.pressure(adcP, tFine) / 100),
+	}}, nil
+}
+
+// The compensation formulas in double precision from the datasheet.
+
+func (c bme280Calibration) temperature(adc int32) (celsius, tFine float64) {
+	v1 := (float64(adc)/16384 - float64(c.t1)/1024) * float64(c.t2)
+	v2 := float64(adc)/131072 - float64(c.t1)/8192
+	v2 = v2 * v2 * float64(c.t3)
+	tFine = v1 + v2
+	return tFine / 5120, tFine
+}
+
+func (c bme280Calibration) pressure(adc int32, tFine float64) (pascal float64) {
+	v1 := tFine/2 - 64000
+	v2 := v1 * v1 * float64(c.p6) / 32768
+	v2 = v2 + v1*float64(c.p5)*2
+	v2 = v2/4 + float64(c.p4)*65536
+	v1 = (float64(c.p3)*v1*v1/524288 + float64(c.p2)*v1) / 524288
+	v1 = (1 + v1/32768) * float64(c.p1)
+	if v1 == 0 {
+		return 0
+	}
+	p := 1048576 - float64(adc)
+	p = (p - v2/4096) * 6250 / v1
+	v1 = float64(c.p9) * p * p / 2147483648
+	v2 = p * float64(c.p8) / 32768
+	return p + (v1+v2+float64(c.p7))/16
+}
+
+func (c bme280Calibration) humidity(adc int32, tFine float64) (percent float64) {
+	h := tFine - 76800
+	h = (float64(adc) - (float64(c.h4)*64 + float64(c.h5)/16384*h)) *
+		(float64(c.h2) / 65536 * (1 + float64(c.h6)/67108864*h*(1+float64(c.h3)/67108864*h)))
+	h = h * (1 - float64(c.h1)*h/524288)
+	if h > 100 {
+		return 100
+	}
+	if h < 0 {
+		return 0
+	}
+	return h
+}
@@ -0,0 +1,58 @@
+package temperature
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Calibration corrects a sensor's temperature to Gain * t + Offset.
+type Calibration struct {
+	Offset float32
+	Gain   float32
+}
+
+var noCalibration = Calibration{Offset: 0, Gain: 1}
+
+func (c Calibration) Apply(t float32) float32 {
+	return c.Gain*t + c.Offset
+}
+
+// suffix formats the calibration for a sensor entry.
+func (c Calibration) suffix() string {
+	switch {
+	case c == noCalibration || c == Calibration{}:
+		return ""
+	case c.Gain == 1:
+		return fmt.Sprintf(":%v", c.Offset)
+	}
+	return fmt.Sprintf(":%v:%v", c.Offset, c.Gain)
+}
+
+// parseEntry parses a sensor entry of the form name[:offset[:gain]].
+func parseEntry(e string) (name string, c Calibration, err error) {
+	parts := strings.Split(e, ":")
+	name = strings.TrimSpace(parts[0])
+	c = noCalibration
+	if len(parts) > 3 {
+		err = fmt.Errorf("expected name[:offset[:gain]], got %v", e)
+		return
+	}
+	if len(parts) > 1 {
+		var v float64
+		if v, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 32); err != nil {
+			err = fmt.Errorf("invalid offset in %v: %v", e, err)
+			return
+		}
+		c.Offset = float32(v)
+	}
+	if len(parts) > 2 {
+		var v float64
+		if v, err = strconv.ParseFloat(strings.TrimSpace(parts[2]), 32); err != nil {
+			err = fmt.Errorf("invalid gain in %v: %v", e, err)
+			return
+		}
+		c.Gain = float32(v)
+	}
+	return
+}
@@ -0,0 +1,291 @@
+package temperature
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// Directory tracks the sensors present on the bus and their names.
+	//
+	// Names are kept in a file with one id:name line per sensor, the same
+	// format as the --temperature-sensor flag. A calibration can follow
+	// as id:name:offset or id:name:offset:gain. Newly discovered sensors are
+	// added as id: lines, so that someone can name them. Until then they
+	// are reported under their id.
+	Directory struct {
+		lock         sync.Mutex
+		file         string
+		initial      map[string]string
+		names        map[string]string
+		calibrations map[string]Calibration
+		present      map[string]bool
+		scanned      bool
+		// quantities holds what sensors measure besides the temperature.
+		quantities map[string][]Quantity
+	}
+
+	// Changes are the differences between two scans of the bus.
+	Changes struct {
+		New     []string
+		Missing []string
+		// Replaced maps missing named sensors to new unnamed ones
+		// that showed up in the same scan.
+		Replaced map[string]string
+	}
+)
+
+func NewDirectory(file string, names map[string]string) (*Directory, error) {
+	d := &Directory{file: file, initial: names, present: map[string]bool{},
+		quantities: map[string][]Quantity{}}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetNames replaces the names given to NewDirectory. If they are invalid,
+// the directory keeps the previous ones.
+func (d *Directory) SetNames(names map[string]string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	old := d.initial
+	d.initial = names
+	if err := d.load(); err != nil {
+		d.initial = old
+		return err
+	}
+	return nil
+}
+
+// Name returns the name of a sensor, or its id if it has none.
+func (d *Directory) Name(id string) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.name(id)
+}
+
+func (d *Directory) name(id string) string {
+	if n := d.names[id]; n != "" {
+		return n
+	}
+	return id
+}
+
+// QuantityName names a further quantity of a sensor, e.g. bathroom_humidity.
+func (d *Directory) QuantityName(id string, q Quantity) string {
+	return fmt.Sprintf("%s_%s", d.Name(id), q)
+}
+
+// Observe records the further quantities a sensor reported.
+func (d *Directory) Observe(r TemperatureReading) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(r.Quantities) == len(d.quantities[r.Id]) {
+		return
+	}
+	qs := make([]Quantity, 0, len(r.Quantities))
+	for q := range r.Quantities {
+		qs = append(qs, q)
+	}
+	d.quantities[r.Id] = qs
+}
+
+// Calibrate corrects the temperature of a reading.
+func (d *Directory) Calibrate(r TemperatureReading) TemperatureReading {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if c, ok := d.calibrations[r.Id]; ok {
+		r.Temperature = c.Apply(r.Temperature)
+	}
+	return r
+}
+
+// Ids returns the sensors to read. These are all named sensors, and all
+// sensors found in the last scan. Named sensors are read even when missing,
+// so that the failed reads reset the bus.
+func (d *Directory) Ids() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ids := []string{}
+	for id, n := range d.names {
+		if n != "" && !d.present[id] {
+			ids = append(ids, id)
+		}
+	}
+	for id := range d.present {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Names returns the sorted names of all named and all present sensors, and
+// of the further quantities they measure.
+func (d *Directory) Names() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	set := map[string]bool{}
+	for _, n := range d.names {
+		if n != "" {
+			set[n] = true
+		}
+	}
+	for id := range d.present {
+		set[d.name(id)] = true
+	}
+	for id, qs := range d.quantities {
+		for _, q := range qs {
+			set[fmt.Sprintf("%s_%s", d.name(id), q)] = true
+		}
+	}
+	ns := make([]string, 0, len(set))
+	for n := range set {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// Update records the sensors found on the bus and returns what changed since
+// the last scan. The names file is reloaded, so that edits take effect.
+func (d *Directory) Update(ids []string) (Changes, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.load(); err != nil {
+		return Changes{}, err
+	}
+	ch := Changes{Replaced: map[string]string{}}
+	present := map[string]bool{}
+	for _, id := range ids {
+		present[id] = true
+		if !d.present[id] {
+			ch.New = append(ch.New, id)
+		}
+	}
+	if d.scanned {
+		for id := range d.present {
+			if !present[id] {
+				ch.Missing = append(ch.Missing, id)
+			}
+		}
+	} else {
+		for id, n := range d.names {
+			if n != "" && !present[id] {
+				ch.Missing = append(ch.Missing, id)
+			}
+		}
+	}
+	sort.Strings(ch.New)
+	sort.Strings(ch.Missing)
+	unnamed := []string{}
+	for _, id := range ch.New {
+		if d.names[id] == "" {
+			unnamed = append(unnamed, id)
+		}
+	}
+	for _, id := range ch.Missing {
+		if d.names[id] != "" && len(unnamed) > 0 {
+			ch.Replaced[id] = unnamed[0]
+			unnamed = unnamed[1:]
+		}
+	}
+	d.present = present
+	d.scanned = true
+
+	added := false
+	for _, id := range ch.New {
+		if _, ok := d.names[id]; !ok {
+			d.names[id] = ""
+			d.calibrations[id] = noCalibration
+			added = true
+		}
+	}
+	if added {
+		return ch, d.save()
+	}
+	return ch, nil
+}
+
+func (d *Directory) load() error {
+	entries := map[string]string{}
+	for id, e := range d.initial {
+		entries[id] = e
+	}
+	if d.file != "" {
+		if err := readEntries(d.file, entries); err != nil {
+			return err
+		}
+	}
+	names := map[string]string{}
+	calibrations := map[string]Calibration{}
+	for id, e := range entries {
+		n, c, err := parseEntry(e)
+		if err != nil {
+			return fmt.Errorf("invalid sensor %v: %v", id, err)
+		}
+		names[id] = n
+		calibrations[id] = c
+	}
+	d.names = names
+	d.calibrations = calibrations
+	return nil
+}
+
+// readEntries adds the entries of the file, keeping the given names of
+// sensors that are unnamed in the file.
+func readEntries(fn string, entries map[string]string) error {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open sensor names %v: %v", fn, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, e, _ := strings.Cut(line, ":")
+		id, e = strings.TrimSpace(id), strings.TrimSpace(e)
+		if e != "" || entries[id] == "" {
+			entries[id] = e
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to read sensor names %v: %v", fn, err)
+	}
+	return nil
+}
+
+func (d *Directory) save() error {
+	if d.file == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(d.names))
+	for id := range d.names {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	b := strings.Builder{}
+	b.WriteString("# Sensors as id:name[:offset[:gain]], unnamed sensors are reported by id\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%s:%s%s\n", id, d.names[id], d.calibrations[id].suffix())
+	}
+	tmp := d.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0666); err != nil {
+		return fmt.Errorf("failed to write sensor names %v: %v", tmp, err)
+	}
+	return os.Rename(tmp, d.file)
+}
+
+func (c Changes) Empty() bool {
+	return len(c.New) == 0 && len(c.Missing) == 0
+}
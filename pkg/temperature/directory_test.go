@@ -0,0 +1,127 @@
+package temperature
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDirectory(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"28-3c01f0961954": "21375\n",
+		"28-3c710457683d": "21000\n",
+	})
+	c, err := NewClient(context.Background(), Config{SysfsRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "sensors.txt")
+	d, err := NewDirectory(fn, map[string]string{"28-3c01f0961954": "temp5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := d.Ids(), []string{"28-3c01f0961954"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have ids %v before scan; want %v", have, want)
+	}
+
+	ch := mustUpdate(t, c, d)
+	if want := []string{"28-3c01f0961954", "28-3c710457683d"}; !reflect.DeepEqual(ch.New, want) {
+		t.Fatalf("Have new %v; want %v", ch.New, want)
+	}
+	if have, want := d.Names(), []string{"28-3c710457683d", "temp5m"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have names %v; want %v", have, want)
+	}
+	if ch := mustUpdate(t, c, d); !ch.Empty() {
+		t.Fatalf("Have changes %v on rescan", ch)
+	}
+
+	// Someone names the new sensor.
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, append(b, []byte("28-3c710457683d:temp1m\n")...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	mustUpdate(t, c, d)
+	if have, want := d.Name("28-3c710457683d"), "temp1m"; have != want {
+		t.Fatalf("Have name %v; want %v", have, want)
+	}
+
+	// The sensor is swapped.
+	if err := os.RemoveAll(filepath.Join(root, "28-3c710457683d")); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeSensor(t, root, "28-000000000001", "20000\n")
+	ch = mustUpdate(t, c, d)
+	if want := []string{"28-3c710457683d"}; !reflect.DeepEqual(ch.Missing, want) {
+		t.Fatalf("Have missing %v; want %v", ch.Missing, want)
+	}
+	if want := map[string]string{"28-3c710457683d": "28-000000000001"}; !reflect.DeepEqual(ch.Replaced, want) {
+		t.Fatalf("Have replaced %v; want %v", ch.Replaced, want)
+	}
+	if have, want := d.Names(), []string{"28-000000000001", "temp1m", "temp5m"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have names %v; want %v", have, want)
+	}
+	// The missing sensor is still read, so that the bus gets reset.
+	if have, want := d.Ids(), []string{"28-000000000001", "28-3c01f0961954", "28-3c710457683d"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("Have ids %v; want %v", have, want)
+	}
+}
+
+func mustUpdate(t *testing.T, c Client, d *Directory) Changes {
+	ids, err := c.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := d.Update(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestCalibration(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sensors.txt")
+	if err := os.WriteFile(fn, []byte("28-3c710457683d:temp1m:0.5:1.1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDirectory(fn, map[string]string{"28-3c01f0961954": "temp5m:-0.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		id   string
+		t    float32
+		want float32
+	}{
+		{"28-3c01f0961954", 21.5, 21.1},
+		{"28-3c710457683d", 20, 22.5},
+		{"28-000000000001", 20, 20},
+	} {
+		r := d.Calibrate(TemperatureReading{Id: tt.id, Temperature: tt.t})
+		if r.Temperature != tt.want {
+			t.Fatalf("Have %v for %v; want %v", r.Temperature, tt.id, tt.want)
+		}
+	}
+	if _, err := d.Update([]string{"28-000000000001"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Sensors as id:name[:offset[:gain]], unnamed sensors are reported by id\n" +
+		"28-000000000001:\n" +
+		"28-3c01f0961954:temp5m:-0.4\n" +
+		"28-3c710457683d:temp1m:0.5:1.1\n"
+	if string(b) != want {
+		t.Fatalf("Have file %q; want %q", b, want)
+	}
+
+	if _, err := NewDirectory("", map[string]string{"28-3c01f0961954": "temp5m:x"}); err == nil {
+		t.Fatal("Have no error; want invalid offset")
+	}
+}
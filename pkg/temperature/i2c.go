@@ -0,0 +1,103 @@
+package temperature
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+type (
+	// i2cBackend reads environmental sensors on an I²C bus. Sensors are
+	// probed at their usual addresses, and named by type and address,
+	// e.g. "bme280-76". Only the sampler goroutine uses it, so that bus
+	// transactions never interleave.
+	i2cBackend struct {
+		bus     i2c.Bus
+		sensors map[string]i2cSensor
+	}
+
+	i2cSensor interface {
+		sense() (Measurement, error)
+	}
+
+	i2cKind struct {
+		name  string
+		addrs []uint16
+		probe func(d *i2c.Dev) (i2cSensor, error)
+	}
+)
+
+var i2cKinds = []i2cKind{
+	{name: "sht3x", addrs: []uint16{0x44, 0x45}, probe: probeSht3x},
+	{name: "bme280", addrs: []uint16{0x76, 0x77}, probe: probeBme280},
+}
+
+func NewI2CBackend(bus i2c.Bus) Backend {
+	return &i2cBackend{bus: bus, sensors: map[string]i2cSensor{}}
+}
+
+func (b *i2cBackend) Owns(id string) bool {
+	for _, k := range i2cKinds {
+		if strings.HasPrefix(id, k.name+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *i2cBackend) Discover() ([]string, error) {
+	ids := []string{}
+	for _, k := range i2cKinds {
+		for _, addr := range k.addrs {
+			id := fmt.Sprintf("%s-%x", k.name, addr)
+			if _, err := b.sensor(id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (b *i2cBackend) Read(id string) (Measurement, error) {
+	s, err := b.sensor(id)
+	if err != nil {
+		return Measurement{}, err
+	}
+	m, err := s.sense()
+	if err != nil {
+		// Probe again next time, e.g. after the sensor was replugged.
+		delete(b.sensors, id)
+		return Measurement{}, fmt.Errorf("failed to read %v: %v", id, err)
+	}
+	return m, nil
+}
+
+func (b *i2cBackend) Bogus(t float32) bool {
+	return false
+}
+
+// sensor returns the probed sensor for the id, probing it if necessary.
+func (b *i2cBackend) sensor(id string) (i2cSensor, error) {
+	if s, ok := b.sensors[id]; ok {
+		return s, nil
+	}
+	name, hex, _ := strings.Cut(id, "-")
+	addr, err := strconv.ParseUint(hex, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid I²C sensor id %v: %v", id, err)
+	}
+	for _, k := range i2cKinds {
+		if k.name != name {
+			continue
+		}
+		s, err := k.probe(&i2c.Dev{Bus: b.bus, Addr: uint16(addr)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe %v: %v", id, err)
+		}
+		b.sensors[id] = s
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown I²C sensor type of %v", id)
+}
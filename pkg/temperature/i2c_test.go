@@ -0,0 +1,126 @@
+package temperature
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2ctest"
+)
+
+// Calibration and ADC values from the BME280 datasheet example.
+var (
+	bme280Calib1 = mustHex("706b436718fc7d8e43d6d00b270b8c00f9ff8c3cf8c67017004b")
+	bme280Calib2 = mustHex("6a01001329031e")
+	bme280Data   = mustHex("655ac07eed007530")
+
+	bme280Probe = []i2ctest.IO{
+		{Addr: 0x76, W: []byte{0xd0}, R: []byte{0x60}},
+		{Addr: 0x76, W: []byte{0x88}, R: bme280Calib1},
+		{Addr: 0x76, W: []byte{0xe1}, R: bme280Calib2},
+	}
+	bme280Sense = []i2ctest.IO{
+		{Addr: 0x76, W: []byte{0xf2, 0x01, 0xf4, 0x25}},
+		{Addr: 0x76, W: []byte{0xf7}, R: bme280Data},
+	}
+
+	sht3xProbe = []i2ctest.IO{
+		{Addr: 0x44, W: []byte{0xf3, 0x2d}, R: []byte{0x00, 0x00, 0x81}},
+	}
+	sht3xSense = []i2ctest.IO{
+		{Addr: 0x44, W: []byte{0x24, 0x00}},
+		{Addr: 0x44, R: mustHex("6666938000a2")},
+	}
+)
+
+// nackBus fails all transfers to missing addresses like a real bus.
+type nackBus struct {
+	i2c.Bus
+	present map[uint16]bool
+}
+
+func (b nackBus) Tx(addr uint16, w, r []byte) error {
+	if !b.present[addr] {
+		return errors.New("nack")
+	}
+	return b.Bus.Tx(addr, w, r)
+}
+
+func TestI2CDiscover(t *testing.T) {
+	pb := &i2ctest.Playback{Ops: append(append([]i2ctest.IO{}, sht3xProbe...), bme280Probe...)}
+	b := NewI2CBackend(nackBus{Bus: pb, present: map[uint16]bool{0x44: true, 0x76: true}})
+	ids, err := b.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sht3x-44", "bme280-76"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("Have %v; want %v", ids, want)
+	}
+	if err := pb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBme280(t *testing.T) {
+	pb := &i2ctest.Playback{Ops: append(append([]i2ctest.IO{}, bme280Probe...), bme280Sense...)}
+	c := NewClientWithBackends(context.Background(), Config{}, NewI2CBackend(pb))
+	readings := c.Subscribe(1)
+	c.RequestTemp("bme280-76")
+	r := <-readings
+	if r.Error != nil || r.Quality != Good {
+		t.Fatalf("Have %v; want good reading", r)
+	}
+	checkNear(t, "temperature", r.Temperature, 25.08)
+	checkNear(t, "pressure", r.Quantities[Pressure], 1006.53)
+	checkNear(t, "humidity", r.Quantities[Humidity], 55.00)
+	if err := pb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSht3x(t *testing.T) {
+	pb := &i2ctest.Playback{Ops: append(append([]i2ctest.IO{}, sht3xProbe...), sht3xSense...)}
+	c := NewClientWithBackends(context.Background(), Config{}, NewI2CBackend(pb))
+	readings := c.Subscribe(1)
+	c.RequestTemp("sht3x-44")
+	r := <-readings
+	if r.Error != nil || r.Quality != Good {
+		t.Fatalf("Have %v; want good reading", r)
+	}
+	checkNear(t, "temperature", r.Temperature, 25)
+	checkNear(t, "humidity", r.Quantities[Humidity], 50)
+	if err := pb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSht3xChecksum(t *testing.T) {
+	pb := &i2ctest.Playback{Ops: []i2ctest.IO{
+		sht3xProbe[0],
+		sht3xSense[0],
+		{Addr: 0x44, R: mustHex("6666008000a2")},
+	}}
+	b := NewI2CBackend(pb)
+	if _, err := b.Read("sht3x-44"); err == nil {
+		t.Fatal("Have no error; want checksum mismatch")
+	}
+}
+
+func checkNear(t *testing.T, what string, have, want float32) {
+	t.Helper()
+	if math.Abs(float64(have-want)) > 0.01 {
+		t.Fatalf("Have %v %v; want %v", what, have, want)
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,160 @@
+package temperature
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"periph.io/x/conn/v3/driver/driverreg"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// The family code of DS18B20 sensors.
+const ds18b20Family = "28-"
+
+var errReadTimeout = errors.New("read timed out")
+
+// onewireBackend reads DS18B20 sensors through the w1 kernel driver.
+type onewireBackend struct {
+	cfg       Config
+	powerPin  gpio.PinIO
+	lastReset time.Time
+	// hung holds the reads that timed out and have not finished yet, by
+	// file name.
+	hung map[string]chan readResult
+}
+
+type readResult struct {
+	bs  []byte
+	err error
+}
+
+func newOnewireBackend(cfg Config) (*onewireBackend, error) {
+	if cfg.SysfsRoot == "" {
+		cfg.SysfsRoot = DefaultSysfsRoot
+	}
+	var powerPin gpio.PinIO
+	if cfg.PowerPin != "" {
+		if _, err := driverreg.Init(); err != nil {
+			return nil, fmt.Errorf("failed to initialize GPIO drivers: %v", err)
+		}
+		powerPin = gpioreg.ByName(cfg.PowerPin)
+		if powerPin == nil {
+			return nil, fmt.Errorf("failed to find power pin %v", cfg.PowerPin)
+		}
+		if err := powerPin.Out(gpio.High); err != nil {
+			return nil, fmt.Errorf("failed to power sensors on %v: %v", cfg.PowerPin, err)
+		}
+	}
+	return &onewireBackend{cfg: cfg, powerPin: powerPin, hung: map[string]chan readResult{}}, nil
+}
+
+// Owns all ids, so that configured sensors are read before discovery.
+func (b *onewireBackend) Owns(id string) bool {
+	return true
+}
+
+func (b *onewireBackend) Discover() ([]string, error) {
+	es, err := os.ReadDir(b.cfg.SysfsRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list 1-wire devices in %v: %v", b.cfg.SysfsRoot, err)
+	}
+	ids := []string{}
+	for _, e := range es {
+		if strings.HasPrefix(e.Name(), ds18b20Family) {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (b *onewireBackend) Bogus(t float32) bool {
+	for _, v := range b.cfg.Validation.BogusValues {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *onewireBackend) Read(id string) (Measurement, error) {
+	t, err := b.readTemp(id)
+	return Measurement{Temperature: t}, err
+}
+
+func (b *onewireBackend) readTemp(id string) (float32, error) {
+	fn := filepath.Join(b.cfg.SysfsRoot, id, "temperature")
+	bs, err := b.readFile(fn)
+	if os.IsNotExist(err) || errors.Is(err, errReadTimeout) {
+		reset, rerr := b.resetOnewireBus()
+		if rerr != nil {
+			return 0, fmt.Errorf("failed to reset 1-wire bus: %v", rerr)
+		}
+		if reset {
+			bs, err = b.readFile(fn)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read temperature file %v: %v", fn, err)
+	}
+	s := strings.TrimSpace(string(bs))
+	i, err := strconv.ParseInt(string(s), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse temperature %v from %v: %v", s, fn, err)
+	}
+	return float32(i) / 1000, nil
+}
+
+// readFile gives up on reads that hang on the bus. The abandoned read
+// finishes in the background, and the next read of the file waits for it
+// instead of starting another one, so hung reads do not pile up.
+func (b *onewireBackend) readFile(fn string) ([]byte, error) {
+	if b.cfg.ReadTimeout <= 0 {
+		return os.ReadFile(fn)
+	}
+	ch, ok := b.hung[fn]
+	if !ok {
+		ch = make(chan readResult, 1)
+		go func() {
+			bs, err := os.ReadFile(fn)
+			ch <- readResult{bs, err}
+		}()
+	}
+	timer := time.NewTimer(b.cfg.ReadTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		delete(b.hung, fn)
+		return r.bs, r.err
+	case <-timer.C:
+		b.hung[fn] = ch
+		return nil, errReadTimeout
+	}
+}
+
+// resetOnewireBus power cycles the sensors, unless the bus was reset within
+// the cooldown. Several missing sensors thus only cause a single reset.
+// https://forums.raspberrypi.com/viewtopic.php?t=164059
+func (b *onewireBackend) resetOnewireBus() (reset bool, err error) {
+	if b.powerPin == nil {
+		return false, nil
+	}
+	if time.Since(b.lastReset) < b.cfg.ResetCooldown {
+		return false, nil
+	}
+	log.Println("Resetting 1-wire bus")
+	b.lastReset = time.Now()
+	err = b.powerPin.Out(gpio.Low)
+	if err != nil {
+		return
+	}
+	time.Sleep(time.Second * 3)
+	err = b.powerPin.Out(gpio.High)
+	return err == nil, err
+}
@@ -0,0 +1,69 @@
+package temperature
+
+import (
+	"fmt"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+// sht3x measures temperature and humidity.
+// https://sensirion.com/media/documents/213E6A3B/63A5A569/Datasheet_SHT3x_DIS.pdf
+type sht3x struct {
+	dev *i2c.Dev
+}
+
+var (
+	sht3xReadStatus = []byte{0xf3, 0x2d}
+	// Single shot, high repeatability, no clock stretching.
+	sht3xMeasure = []byte{0x24, 0x00}
+)
+
+const sht3xMeasureDelay = 16 * time.Millisecond
+
+func probeSht3x(dev *i2c.Dev) (i2cSensor, error) {
+	status := make([]byte, 3)
+	if err := dev.Tx(sht3xReadStatus, status); err != nil {
+		return nil, err
+	}
+	if crc8(status[:2]) != status[2] {
+		return nil, fmt.Errorf("status checksum mismatch")
+	}
+	return &sht3x{dev: dev}, nil
+}
+
+func (s *sht3x) sense() (Measurement, error) {
+	if err := s.dev.Tx(sht3xMeasure, nil); err != nil {
+		return Measurement{}, err
+	}
+	time.Sleep(sht3xMeasureDelay)
+	d := make([]byte, 6)
+	if err := s.dev.Tx(nil, d); err != nil {
+		return Measurement{}, err
+	}
+	if crc8(d[0:2]) != d[2] || crc8(d[3:5]) != d[5] {
+		return Measurement{}, fmt.Errorf("measurement checksum mismatch")
+	}
+	rawT := float32(uint16(d[0])<<8 | uint16(d[1]))
+	rawH := float32(uint16(d[3])<<8 | uint16(d[4]))
+	return Measurement{
+		Temperature: -45 + 175*rawT/65535,
+		Quantities:  map[Quantity]float32{Humidity: 100 * rawH / 65535},
+	}, nil
+}
+
+// crc8 is the Sensirion checksum with polynomial 0x31 and init 0xff.
+func crc8(data []byte) byte {
+	crc := byte(0xff)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -1,94 +1,294 @@
 package temperature
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
-	"periph.io/x/conn/v3/driver/driverreg"
-	"periph.io/x/conn/v3/gpio"
-	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/i2c/i2creg"
 	_ "periph.io/x/host/v3/rpi"
 )
 
 type (
+	// Quantity is a value measured by a sensor in addition to its temperature.
+	Quantity string
+
 	TemperatureReading struct {
 		Id          string
 		Temperature float32
-		Error       error
+		// Quantities holds further values of sensors measuring more than
+		// the temperature.
+		Quantities map[Quantity]float32
+		Quality    Quality
+		Error      error
 	}
 
 	Client interface {
+		// Discover lists the sensors on all buses. It waits for the sampler
+		// to finish the read in progress.
+		Discover() ([]string, error)
+		// RequestTemp queues a read of the sensor. It never blocks.
 		RequestTemp(id string)
-		TemperatureReadings() <-chan TemperatureReading
+		// Schedule sets the sensors read every SampleInterval.
+		Schedule(ids []string)
+		// Subscribe returns a channel of all readings. If the subscriber
+		// falls behind by more than buffer readings, the oldest are dropped.
+		// It panics if buffer is below 1.
+		Subscribe(buffer int) <-chan TemperatureReading
+	}
+
+	// Backend reads one kind of sensors. The sampler calls it one read or
+	// discovery at a time.
+	Backend interface {
+		// Owns tells whether the id belongs to one of the backend's sensors.
+		Owns(id string) bool
+		Discover() ([]string, error)
+		Read(id string) (Measurement, error)
+		// Bogus tells whether a temperature is a known error value.
+		Bogus(t float32) bool
 	}
+
+	Measurement struct {
+		Temperature float32
+		Quantities  map[Quantity]float32
+	}
+
+	Config struct {
+		// PowerPin is the GPIO that the 3.3V of the sensors are connected to.
+		// This allows us to reset the bus. Leave empty if the sensors are
+		// powered permanently.
+		PowerPin string
+		// SysfsRoot is where the w1 kernel driver lists its devices.
+		SysfsRoot string
+		// I2CBus is the name of the I²C bus with BME280 or SHT3x sensors.
+		// Leave empty to only use the 1-wire bus.
+		I2CBus string
+		// SampleInterval is the schedule of reading the scheduled sensors.
+		// Zero only reads requested sensors.
+		SampleInterval time.Duration
+		// ReadTimeout limits a single read of a sensor. Zero waits forever.
+		ReadTimeout time.Duration
+		// ResetCooldown is the minimum time between two bus resets.
+		ResetCooldown time.Duration
+		Validation    ValidationConfig
+	}
+)
+
+const (
+	Humidity Quantity = "humidity"
+	Pressure Quantity = "pressure"
+
+	DefaultPowerPin  = "GPIO17"
+	DefaultSysfsRoot = "/sys/bus/w1/devices"
+
+	maxQueuedRequests = 64
 )
 
-// Connect 3.3V of the sensors to this pin. This allows us to reset the bus.
-const powerPinName = "GPIO17"
+var errStopped = errors.New("sampler stopped")
+
+// discovery is the result of discovering the sensors on all buses.
+type discovery struct {
+	ids []string
+	err error
+}
 
+// clientImpl owns the buses. All reads, resets and discoveries are done one
+// at a time by the sampler goroutine.
 type clientImpl struct {
-	powerPin            gpio.PinIO
-	ch                  chan TemperatureReading
-	temperatureReadings <-chan TemperatureReading
+	cfg         Config
+	validator   *validator
+	backends    []Backend
+	requests    chan string
+	discoveries chan chan discovery
+	done        <-chan struct{}
+
+	lock        sync.Mutex
+	queued      map[string]bool
+	scheduled   []string
+	subscribers []chan TemperatureReading
 }
 
-func NewClient() Client {
-	if _, err := driverreg.Init(); err != nil {
-		log.Fatal(err)
+func NewClient(ctx context.Context, cfg Config) (Client, error) {
+	backends := []Backend{}
+	if cfg.I2CBus != "" {
+		bus, err := i2creg.Open(cfg.I2CBus)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open I²C bus %v: %v", cfg.I2CBus, err)
+		}
+		backends = append(backends, NewI2CBackend(bus))
 	}
-	powerPin := gpioreg.ByName(powerPinName)
-	if powerPin == nil {
-		log.Fatalf("Failed to find %v\n", powerPinName)
+	ow, err := newOnewireBackend(cfg)
+	if err != nil {
+		return nil, err
 	}
-	powerPin.Out(gpio.High)
-	ch := make(chan TemperatureReading)
-	return &clientImpl{powerPin: powerPin, ch: ch, temperatureReadings: ch}
+	// Last, since it takes all ids.
+	backends = append(backends, ow)
+	return NewClientWithBackends(ctx, cfg, backends...), nil
 }
 
-func (c *clientImpl) TemperatureReadings() <-chan TemperatureReading {
-	return c.temperatureReadings
+// NewClientWithBackends samples the sensors of the given backends. An id is
+// read by the first backend owning it.
+func NewClientWithBackends(ctx context.Context, cfg Config, backends ...Backend) Client {
+	c := &clientImpl{cfg: cfg, validator: newValidator(cfg.Validation), backends: backends,
+		requests:    make(chan string, maxQueuedRequests),
+		discoveries: make(chan chan discovery),
+		done:        ctx.Done(),
+		queued:      map[string]bool{}}
+	go c.sampleForever(ctx)
+	return c
 }
 
-func (c *clientImpl) RequestTemp(id string) {
-	go func() {
-		t, err := c.readTemp(id)
-		c.ch <- TemperatureReading{Id: id, Temperature: t, Error: err}
-	}()
+func (c *clientImpl) Discover() ([]string, error) {
+	reply := make(chan discovery, 1)
+	select {
+	case c.discoveries <- reply:
+	case <-c.done:
+		return nil, errStopped
+	}
+	d := <-reply
+	return d.ids, d.err
 }
 
-func (c *clientImpl) readTemp(id string) (float32, error) {
-	fn := fmt.Sprintf("/sys/bus/w1/devices/%s/temperature", id)
-	bs, err := os.ReadFile(fn)
-	if os.IsNotExist(err) {
-		err = c.resetOnewireBus()
+func (c *clientImpl) discover() ([]string, error) {
+	ids := []string{}
+	for _, b := range c.backends {
+		bids, err := b.Discover()
 		if err != nil {
-			return 0, fmt.Errorf("failed to reset 1-wire bus: %v", err)
+			return nil, err
 		}
-		bs, err = os.ReadFile(fn)
+		ids = append(ids, bids...)
 	}
-	if err != nil {
-		return 0, fmt.Errorf("failed to read temperature file %v: %v", fn, err)
+	return ids, nil
+}
+
+func (c *clientImpl) RequestTemp(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.queued[id] {
+		return
 	}
-	s := strings.TrimSpace(string(bs))
-	i, err := strconv.ParseInt(string(s), 10, 32)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse temperature %v from %v: %v", s, fn, err)
+	select {
+	case c.requests <- id:
+		c.queued[id] = true
+	default:
+		log.Printf("Too many queued sensor reads, dropping %v\n", id)
 	}
-	return float32(i) / 1000, nil
 }
 
-// https://forums.raspberrypi.com/viewtopic.php?t=164059
-func (c *clientImpl) resetOnewireBus() (err error) {
-	log.Println("Resetting 1-wire bus")
-	err = c.powerPin.Out(gpio.Low)
-	if err != nil {
-		return
+func (c *clientImpl) Schedule(ids []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scheduled = append([]string{}, ids...)
+}
+
+func (c *clientImpl) Subscribe(buffer int) <-chan TemperatureReading {
+	if buffer < 1 {
+		// publish could never make room for a reading.
+		panic(fmt.Sprintf("subscription buffer must be at least 1: %v", buffer))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan TemperatureReading, buffer)
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+func (c *clientImpl) sampleForever(ctx context.Context) {
+	var tick <-chan time.Time
+	if c.cfg.SampleInterval > 0 {
+		ticker := time.NewTicker(c.cfg.SampleInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-c.requests:
+			c.lock.Lock()
+			delete(c.queued, id)
+			c.lock.Unlock()
+			c.publish(c.readValidTemp(ctx, id))
+		case reply := <-c.discoveries:
+			ids, err := c.discover()
+			reply <- discovery{ids, err}
+		case <-tick:
+			c.lock.Lock()
+			ids := c.scheduled
+			c.lock.Unlock()
+			for _, id := range ids {
+				c.publish(c.readValidTemp(ctx, id))
+			}
+		}
+	}
+}
+
+func (c *clientImpl) publish(r TemperatureReading) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, ch := range c.subscribers {
+		for {
+			select {
+			case ch <- r:
+			default:
+				// Make room by dropping the oldest reading.
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (c *clientImpl) backend(id string) Backend {
+	for _, b := range c.backends {
+		if b.Owns(id) {
+			return b
+		}
+	}
+	return nil
+}
+
+// readValidTemp reads a sensor until it returns a good reading or runs out
+// of retries, or ctx is done. The last reading is returned either way.
+func (c *clientImpl) readValidTemp(ctx context.Context, id string) TemperatureReading {
+	b := c.backend(id)
+	if b == nil {
+		return TemperatureReading{Id: id, Quality: Failed, Error: fmt.Errorf("no backend for sensor %v", id)}
+	}
+	backoff := c.cfg.Validation.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		r := TemperatureReading{Id: id}
+		m, err := b.Read(id)
+		r.Temperature, r.Quantities, r.Error = m.Temperature, m.Quantities, err
+		if r.Error != nil {
+			r.Quality = Failed
+		} else if b.Bogus(r.Temperature) {
+			r.Quality = Bogus
+		} else {
+			r.Quality = c.validator.check(id, r.Temperature, time.Now())
+		}
+		if r.Quality == Good {
+			r.Temperature = c.validator.smooth(id, r.Temperature)
+			return r
+		}
+		if attempt >= c.cfg.Validation.Retries {
+			return r
+		}
+		log.Printf("Retrying %v reading %v of sensor %v in %v\n", r.Quality, r.Temperature, id, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return r
+		case <-timer.C:
+		}
+		backoff *= 2
 	}
-	time.Sleep(time.Second * 3)
-	err = c.powerPin.Out(gpio.High)
-	return
 }
@@ -0,0 +1,167 @@
+package temperature
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadTemp(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"28-3c01f0961954": "21375\n",
+		"28-3c710457683d": "-1250\n",
+		"28-000000000bad": "garbage\n",
+	})
+	c, err := NewClient(context.Background(), Config{SysfsRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := c.Subscribe(1)
+	for _, tt := range []struct {
+		id      string
+		want    float32
+		wantErr bool
+	}{
+		{"28-3c01f0961954", 21.375, false},
+		{"28-3c710457683d", -1.25, false},
+		{"28-000000000bad", 0, true},
+		{"28-00000000dead", 0, true},
+	} {
+		t.Run(tt.id, func(t *testing.T) {
+			c.RequestTemp(tt.id)
+			r := <-readings
+			if r.Id != tt.id || r.Temperature != tt.want || (r.Error != nil) != tt.wantErr {
+				t.Fatalf("Have %v; want %v, %v, error=%v", r, tt.id, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func fakeSysfs(t *testing.T, temps map[string]string) string {
+	root := t.TempDir()
+	for id, temp := range temps {
+		writeFakeSensor(t, root, id, temp)
+	}
+	return root
+}
+
+func writeFakeSensor(t *testing.T, root, id, temp string) {
+	d := filepath.Join(root, id)
+	if err := os.MkdirAll(d, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "temperature"), []byte(temp), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduledSampling(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"28-3c01f0961954": "21375\n",
+		"28-3c710457683d": "-1250\n",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := NewClient(ctx, Config{SysfsRoot: root, SampleInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := c.Subscribe(2)
+	c.Schedule([]string{"28-3c01f0961954", "28-3c710457683d"})
+
+	time.Sleep(50 * time.Millisecond)
+	writeFakeSensor(t, root, "28-3c01f0961954", "22000\n")
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if len(slow) != 2 {
+		t.Fatalf("Have %v buffered readings; want 2", len(slow))
+	}
+	for r := range slow {
+		if r.Id == "28-3c01f0961954" && r.Temperature != 22 {
+			t.Fatalf("Have %v; want latest reading 22", r)
+		}
+		if len(slow) == 0 {
+			break
+		}
+	}
+}
+
+// exclusiveBackend fails if it is called by two goroutines at once.
+type exclusiveBackend struct {
+	busy atomic.Bool
+}
+
+func (b *exclusiveBackend) enter() error {
+	if !b.busy.CompareAndSwap(false, true) {
+		return errors.New("concurrent use of the bus")
+	}
+	time.Sleep(time.Millisecond)
+	b.busy.Store(false)
+	return nil
+}
+
+func (b *exclusiveBackend) Owns(id string) bool { return true }
+
+func (b *exclusiveBackend) Discover() ([]string, error) {
+	return []string{"s"}, b.enter()
+}
+
+func (b *exclusiveBackend) Read(id string) (Measurement, error) {
+	return Measurement{Temperature: 20}, b.enter()
+}
+
+func (b *exclusiveBackend) Bogus(t float32) bool { return false }
+
+func TestDiscoverWhileSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClientWithBackends(ctx, Config{SampleInterval: time.Millisecond}, &exclusiveBackend{})
+	readings := c.Subscribe(100)
+	c.Schedule([]string{"s"})
+	for i := 0; i < 20; i++ {
+		if _, err := c.Discover(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	for len(readings) > 0 {
+		if r := <-readings; r.Error != nil {
+			t.Fatal(r.Error)
+		}
+	}
+}
+
+func TestHungReadsDoNotPileUp(t *testing.T) {
+	// Opening a FIFO blocks until a writer opens it, like a hung bus.
+	fn := filepath.Join(t.TempDir(), "temperature")
+	if err := syscall.Mkfifo(fn, 0666); err != nil {
+		t.Skip(err)
+	}
+	b, err := newOnewireBackend(Config{ReadTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := b.readFile(fn); !errors.Is(err, errReadTimeout) {
+			t.Fatalf("Have %v; want %v", err, errReadTimeout)
+		}
+	}
+	if len(b.hung) != 1 {
+		t.Fatalf("Have %v hung reads; want 1", len(b.hung))
+	}
+	if err := os.WriteFile(fn, []byte("21375\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// The hung read finished meanwhile.
+	bs, err := b.readFile(fn)
+	if err != nil || string(bs) != "21375\n" || len(b.hung) != 0 {
+		t.Fatalf("Have %q, %v, %v hung reads; want the temperature", bs, err, len(b.hung))
+	}
+}
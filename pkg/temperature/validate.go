@@ -0,0 +1,128 @@
+package temperature
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Quality tells whether a reading can be trusted.
+	Quality int
+
+	ValidationConfig struct {
+		// BogusValues are returned by DS18B20s on glitches instead of
+		// an error, e.g. 85 on power-up, and -127 or 0 on read failures.
+		// They don't apply to other sensors. Sensors that can measure
+		// 0°C need values without 0.
+		BogusValues []float32
+		// MaxChangePerMinute limits the rate of change since the last good
+		// reading. A reading beyond the limit is rejected, until enough time
+		// has passed for the change to be plausible. Quick retries thus
+		// cannot confirm a glitch. Zero disables the limit.
+		MaxChangePerMinute float32
+		// Retries is how often a failed or rejected read is repeated.
+		Retries int
+		// RetryBackoff is the delay before the first retry. It doubles
+		// with every further retry.
+		RetryBackoff time.Duration
+		// MedianOf smooths readings over the median of the last N good
+		// raw readings. Zero or one disables smoothing.
+		MedianOf int
+	}
+
+	validator struct {
+		cfg     ValidationConfig
+		lock    sync.Mutex
+		sensors map[string]*sensorHistory
+	}
+
+	sensorHistory struct {
+		last   sample
+		recent []float32
+	}
+
+	sample struct {
+		t  float32
+		at time.Time
+	}
+)
+
+const (
+	Good Quality = iota
+	// Bogus readings are known error values of the sensor.
+	Bogus
+	// Implausible readings change faster than the configured limit.
+	Implausible
+	// Failed readings could not be read at all.
+	Failed
+)
+
+var DefaultBogusValues = []float32{85, -127, 0}
+
+func (q Quality) String() string {
+	switch q {
+	case Good:
+		return "good"
+	case Bogus:
+		return "bogus"
+	case Implausible:
+		return "implausible"
+	case Failed:
+		return "failed"
+	}
+	return "?"
+}
+
+func newValidator(cfg ValidationConfig) *validator {
+	return &validator{cfg: cfg, sensors: map[string]*sensorHistory{}}
+}
+
+// check returns the quality of a raw reading. Good readings become the
+// reference for the rate limit of the following ones.
+func (v *validator) check(id string, t float32, at time.Time) Quality {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	h, ok := v.sensors[id]
+	if !ok {
+		h = &sensorHistory{}
+		v.sensors[id] = h
+	}
+	s := sample{t: t, at: at}
+	if ok && v.cfg.MaxChangePerMinute > 0 && !v.withinRate(h.last, s) {
+		return Implausible
+	}
+	h.last = s
+	return Good
+}
+
+func (v *validator) withinRate(from, to sample) bool {
+	d := to.t - from.t
+	if d < 0 {
+		d = -d
+	}
+	minutes := float32(to.at.Sub(from.at).Minutes())
+	// Allow for the resolution of the sensor even for quick reads.
+	return d <= v.cfg.MaxChangePerMinute*minutes+0.5
+}
+
+// smooth returns the median of the recent good readings including t.
+func (v *validator) smooth(id string, t float32) float32 {
+	if v.cfg.MedianOf <= 1 {
+		return t
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	h := v.sensors[id]
+	h.recent = append(h.recent, t)
+	if len(h.recent) > v.cfg.MedianOf {
+		h.recent = h.recent[len(h.recent)-v.cfg.MedianOf:]
+	}
+	sorted := append([]float32{}, h.recent...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
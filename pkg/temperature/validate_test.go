@@ -0,0 +1,110 @@
+package temperature
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidatorCheck(t *testing.T) {
+	v := newValidator(ValidationConfig{MaxChangePerMinute: 1})
+	t0 := time.Date(2023, 3, 30, 8, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		minute int
+		t      float32
+		want   Quality
+	}{
+		{0, 20, Good},
+		{1, 21, Good},
+		{3, 35, Implausible},
+		{4, 22, Good},
+		{5, 40, Implausible},
+		// A retry right away does not confirm it.
+		{5, 40, Implausible},
+		{6, 40.5, Implausible},
+		// Accepted once the change is plausible since minute 4.
+		{22, 40, Good},
+		{23, 41, Good},
+	} {
+		if have := v.check("s", tt.t, t0.Add(time.Duration(tt.minute)*time.Minute)); have != tt.want {
+			t.Fatalf("Have %v for %v at minute %v; want %v", have, tt.t, tt.minute, tt.want)
+		}
+	}
+}
+
+func TestValidatorSmooth(t *testing.T) {
+	v := newValidator(ValidationConfig{MedianOf: 3})
+	for _, tt := range []struct {
+		t    float32
+		want float32
+	}{
+		{20, 20},
+		{22, 21},
+		{30, 22},
+		{21, 22},
+		{21, 21},
+	} {
+		v.check("s", tt.t, time.Now())
+		if have := v.smooth("s", tt.t); have != tt.want {
+			t.Fatalf("Have %v for %v; want %v", have, tt.t, tt.want)
+		}
+	}
+}
+
+func TestReadTempRetries(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"28-3c01f0961954": "85000\n",
+	})
+	c, err := NewClient(context.Background(), Config{SysfsRoot: root, Validation: ValidationConfig{
+		BogusValues:  DefaultBogusValues,
+		Retries:      2,
+		RetryBackoff: 10 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := c.Subscribe(1)
+	c.RequestTemp("28-3c01f0961954")
+	if r := <-readings; r.Quality != Bogus {
+		t.Fatalf("Have %v; want bogus reading", r)
+	}
+
+	fn := filepath.Join(root, "28-3c01f0961954", "temperature")
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		if err := os.WriteFile(fn, []byte("21500\n"), 0666); err != nil {
+			t.Error(err)
+		}
+	}()
+	c.RequestTemp("28-3c01f0961954")
+	if r := <-readings; r.Quality != Good || r.Temperature != 21.5 {
+		t.Fatalf("Have %v; want good reading 21.5 after retry", r)
+	}
+}
+
+func TestReadTempAcceptsZeroUnlessBogus(t *testing.T) {
+	for _, tt := range []struct {
+		bogus []float32
+		want  Quality
+	}{
+		{DefaultBogusValues, Bogus},
+		{[]float32{85, -127}, Good},
+	} {
+		root := fakeSysfs(t, map[string]string{
+			"28-3c01f0961954": "0\n",
+		})
+		c, err := NewClient(context.Background(), Config{SysfsRoot: root, Validation: ValidationConfig{
+			BogusValues: tt.bogus,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readings := c.Subscribe(1)
+		c.RequestTemp("28-3c01f0961954")
+		if r := <-readings; r.Quality != tt.want {
+			t.Fatalf("Have %v with bogus values %v; want %v", r, tt.bogus, tt.want)
+		}
+	}
+}
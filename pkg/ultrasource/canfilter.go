@@ -0,0 +1,56 @@
+package ultrasource
+
+import (
+	"go.einride.tech/can"
+)
+
+// Filter selects received frames by the sending device.
+//
+// The device is encoded in the two low bytes of the extended CAN ID of
+// both start and continuation frames, so the kernel can drop frames of
+// other devices before they reach user space. The message type is part of
+// the payload and must still be checked after parsing.
+type Filter struct {
+	Device Device
+}
+
+const (
+	canEffFlag    uint32 = 0x80000000
+	canDeviceMask uint32 = 0x0000ffff
+)
+
+func DeviceFilters(ds []Device) []Filter {
+	fs := make([]Filter, 0, len(ds))
+	for _, d := range ds {
+		fs = append(fs, Filter{Device: d})
+	}
+	return fs
+}
+
+// IdAndMask returns the filter in the form of a SocketCAN can_filter.
+func (f Filter) IdAndMask() (id, mask uint32) {
+	id = canEffFlag | uint32(f.Device.Type)<<8 | uint32(f.Device.Id)
+	mask = canEffFlag | canDeviceMask
+	return
+}
+
+func (f Filter) Match(fr can.Frame) bool {
+	if !fr.IsExtended {
+		return false
+	}
+	id, mask := f.IdAndMask()
+	return (canEffFlag|fr.ID)&mask == id&mask
+}
+
+// MatchAny mimics the kernel: no filters at all pass every frame.
+func MatchAny(fs []Filter, fr can.Frame) bool {
+	if fs == nil {
+		return true
+	}
+	for _, f := range fs {
+		if f.Match(fr) {
+			return true
+		}
+	}
+	return false
+}
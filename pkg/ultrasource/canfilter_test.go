@@ -0,0 +1,35 @@
+package ultrasource
+
+import (
+	"testing"
+
+	"go.einride.tech/can"
+)
+
+func TestFilterMatch(t *testing.T) {
+	fs := DeviceFilters([]Device{Controller})
+	for _, tt := range []struct {
+		frame string
+		want  bool
+	}{
+		{"1FC00FFF#014201000BEA01", true},
+		{"1FC00FFF#0142000000000019", true},
+		{"0FC00FFF#0019", true},
+		{"1FE00801#014601000BEA01", false},
+		{"1FE00802#014601000BEA01", false},
+		{"0FF#0142", false},
+	} {
+		t.Run(tt.frame, func(t *testing.T) {
+			f := can.Frame{}
+			if err := f.UnmarshalString(tt.frame); err != nil {
+				t.Fatalf(`Failed to unmarshal %v`, tt.frame)
+			}
+			if have := MatchAny(fs, f); have != tt.want {
+				t.Fatalf(`Have %v; want %v`, have, tt.want)
+			}
+		})
+	}
+	if !MatchAny(nil, can.Frame{ID: 0x123}) {
+		t.Fatal(`Nil filters should match everything`)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"net"
+	"os"
 
 	"go.einride.tech/can"
 	"go.einride.tech/can/pkg/socketcan"
@@ -22,21 +23,32 @@ type Receiver interface {
 type Client interface {
 	Transmitter
 	Receiver
+	// SetReceiveFilters replaces the filters of received frames.
+	// Nil filters receive all frames.
+	SetReceiveFilters(fs []Filter) error
 }
 
 type clientImpl struct {
-	conn net.Conn
+	conn *os.File
 	xmit *socketcan.Transmitter
 	recv *socketcan.Receiver
 }
 
+// fileConn turns the raw socket file into the net.Conn the transmitter wants.
+type fileConn struct {
+	*os.File
+}
+
+func (fileConn) LocalAddr() net.Addr  { return nil }
+func (fileConn) RemoteAddr() net.Addr { return nil }
+
 func NewClient(ctx context.Context) Client {
-	conn, err := socketcan.DialContext(ctx, "can", "can0")
+	conn, err := dialRaw("can0")
 	if err != nil {
 		log.Fatalf("Unable to dial can0: %v", err)
 	}
 	return &clientImpl{conn: conn,
-		xmit: socketcan.NewTransmitter(conn),
+		xmit: socketcan.NewTransmitter(fileConn{conn}),
 		recv: socketcan.NewReceiver(conn)}
 }
 
@@ -45,3 +57,8 @@ func (c *clientImpl) TransmitFrame(ctx context.Context, f can.Frame) error {
 }
 func (c *clientImpl) Receive() bool    { return c.recv.Receive() }
 func (c *clientImpl) Frame() can.Frame { return c.recv.Frame() }
+
+func (c *clientImpl) SetReceiveFilters(fs []Filter) error {
+	log.Printf("Setting CAN receive filters %v\n", fs)
+	return setRawFilters(c.conn, fs)
+}
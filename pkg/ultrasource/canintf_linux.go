@@ -0,0 +1,54 @@
+package ultrasource
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialRaw opens the SocketCAN device like socketcan.Dial does, but keeps the
+// file around so that we can configure the socket.
+func dialRaw(device string) (*os.File, error) {
+	ifi, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", device, err)
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	// Non-blocking so that the file is registered with the runtime poller.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("set nonblock: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+	return os.NewFile(uintptr(fd), device), nil
+}
+
+func setRawFilters(f *os.File, fs []Filter) error {
+	cfs := []unix.CanFilter{{Id: 0, Mask: 0}}
+	if fs != nil {
+		cfs = make([]unix.CanFilter, len(fs))
+		for i, f := range fs {
+			cfs[i].Id, cfs[i].Mask = f.IdAndMask()
+		}
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptCanRawFilter(int(fd), unix.SOL_CAN_RAW, unix.CAN_RAW_FILTER, cfs)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
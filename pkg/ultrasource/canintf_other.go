@@ -0,0 +1,18 @@
+//go:build !linux
+
+package ultrasource
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoSocketCan = errors.New("SocketCAN is only supported on linux")
+
+func dialRaw(device string) (*os.File, error) {
+	return nil, errNoSocketCan
+}
+
+func setRawFilters(f *os.File, fs []Filter) error {
+	return errNoSocketCan
+}
@@ -52,6 +52,8 @@ type (
 	valueConverter struct {
 		toValue     func([]byte) (interface{}, error)
 		appendValue func([]byte, interface{}) ([]byte, error)
+		// options are the values of a list, if settable.
+		options []string
 	}
 
 	ValueDesc struct {
@@ -152,6 +154,7 @@ func listParser(options []string) func(b []byte) (interface{}, error) {
 func listConverter(len int, options []string) valueConverter {
 	return valueConverter{
 		toValue: listParser(options),
+		options: options,
 		appendValue: func(b []byte, v interface{}) ([]byte, error) {
 			s := v.(string)
 			for i, o := range options {
@@ -320,6 +323,17 @@ func (p Parser) parseMessage(dev Device, raw []byte) (m *Message, err error) {
 	return
 }
 
+// Settable tells whether values of the datapoint can be set.
+func (d ValueDesc) Settable() bool {
+	return d.Conv.appendValue != nil
+}
+
+// Options returns the values of a settable list, or nil for other
+// datapoints.
+func (d ValueDesc) Options() []string {
+	return d.Conv.options
+}
+
 func (id ValueId) Unknown() bool {
 	d, ok := ValueDescs[id]
 	return !ok || len(d.Name) == 0